@@ -5,23 +5,38 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"changkun.de/x/login"
 	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/models"
+	"changkun.de/x/redir/internal/passwd"
+	"changkun.de/x/redir/internal/short"
+	"changkun.de/x/redir/internal/token"
 	"changkun.de/x/redir/internal/utils"
 )
 
-var errUnauthorized = errors.New("request unauthorized")
+var (
+	errUnauthorized = errors.New("request unauthorized")
+	errForbidden    = errors.New("request forbidden")
+)
 
 // blocklist holds the ip that should be blocked for further requests.
+// It is keyed by the real IP rather than the pseudonymized one, so that
+// a truncated IP does not block a whole network. The IPs are never
+// stored.
 //
 // This map may keep grow without releasing memory because of
 // continuously attempts. we also do not persist this type of block info
@@ -30,16 +45,21 @@ var errUnauthorized = errors.New("request unauthorized")
 // We clear the map very month.
 var blocklist sync.Map // map[string]*blockinfo{}
 
-func init() {
+// clearBlocklist clears the blocklist every month until ctx is done.
+func clearBlocklist(ctx context.Context) {
 	t := time.NewTicker(time.Hour * 24 * 30)
-	go func() {
-		for range t.C {
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
 			blocklist.Range(func(k, v interface{}) bool {
 				blocklist.Delete(k)
 				return true
 			})
 		}
-	}()
+	}
 }
 
 type blockinfo struct {
@@ -50,20 +70,75 @@ type blockinfo struct {
 
 const maxFailureAttempts = 3
 
-func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (user string, err error) {
-	switch config.Conf.Auth.Enable {
+// blocked reports whether the IP of the given block info is currently
+// blocked.
+func blocked(info *blockinfo, now time.Time) bool {
+	if atomic.LoadInt64(&info.failCount) <= maxFailureAttempts {
+		return false
+	}
+	last := info.lastFail.Load().(time.Time)
+	bloc := info.blockTime.Load().(time.Duration)
+	return now.Sub(last.Add(bloc)) < 0
+}
+
+// identity is the authenticated caller of a request. The token is nil
+// unless the caller is authenticated by an API token, in which case the
+// user is the owner of the token. The role and the groups decide which
+// links the caller can edit.
+type identity struct {
+	user   string
+	role   config.Role
+	groups []string
+	token  *models.Token
+}
+
+// actor returns the identity as the actor of link edits.
+func (id *identity) actor() *short.Actor {
+	return &short.Actor{User: id.user, Role: id.role, Groups: id.groups}
+}
+
+// can reports whether the identity allows the given operation on the
+// given alias.
+func (id *identity) can(op short.Op, alias string) bool {
+	return id.token == nil || token.Allows(id.token, op, alias)
+}
+
+// canRead reports whether the identity allows reading the statistics of
+// the given alias, or of all aliases if the alias is empty.
+func (id *identity) canRead(alias string) bool {
+	return id.token == nil || token.CanRead(id.token, alias)
+}
+
+// forbid responds that the authenticated caller is not allowed to
+// access the request.
+func forbid(w http.ResponseWriter) error {
+	w.WriteHeader(http.StatusForbidden)
+	return errForbidden
+}
+
+func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (id *identity, err error) {
+	if tok, ok := bearerToken(r); ok {
+		return s.tokenAuth(w, r, tok)
+	}
+
+	conf := config.Get()
+	switch conf.Auth.Enable {
 	case config.None:
-		return
+		return &identity{role: config.RoleAdmin}, nil
 	case config.SSO:
 		user, err := login.HandleAuth(w, r)
 		if err != nil {
-			uu, _ := url.Parse(config.Conf.Auth.SSO)
+			authFailures.Inc("sso")
+			uu, _ := url.Parse(conf.Auth.SSO)
 			q := uu.Query()
 			q.Set("redirect", "https://"+r.Host+r.URL.String())
 			uu.RawQuery = q.Encode()
 			http.Redirect(w, r, uu.String(), http.StatusFound)
+			return nil, err
 		}
-		return user, err
+		return &identity{user: user, role: config.RoleAdmin}, nil
+	case config.OIDC:
+		return s.oidcAuth(w, r)
 	case config.Basic:
 	}
 
@@ -71,14 +146,133 @@ func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (user string
 
 	u, p, ok := r.BasicAuth()
 	if !ok {
+		authFailures.Inc("missing")
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%w: failed to parsing basic auth", errUnauthorized)
+	}
+
+	record, err := guard(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { record(err) }()
+
+	a := checkAccount(conf.Auth.Basic, u, p)
+	if a == nil {
+		authFailures.Inc("invalid")
 		w.WriteHeader(http.StatusUnauthorized)
-		err = fmt.Errorf("%w: failed to parsing basic auth", errUnauthorized)
-		return
+		return nil, fmt.Errorf("%w: username or password is invalid", errUnauthorized)
+	}
+	id = &identity{user: u, role: a.Role, groups: a.Groups}
+	if id.role == "" {
+		id.role = config.RoleAdmin
 	}
+	return id, nil
+}
+
+// tokenTouchInterval is the minimum interval of updating the last used
+// time of a token, so that busy tokens do not write on every request.
+const tokenTouchInterval = time.Minute
+
+// bearerToken returns the token of the Authorization: Bearer header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+// tokenAuth authenticates the request by the given API token.
+func (s *server) tokenAuth(w http.ResponseWriter, r *http.Request, tok string) (id *identity, err error) {
+	record, err := guard(r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { record(err) }()
 
+	ctx := r.Context()
+	now := time.Now().UTC()
+	t, err := s.db.FetchToken(ctx, token.Hash(tok))
+	if errors.Is(err, db.ErrTokenNotFound) || err == nil && token.Expired(t, now) {
+		authFailures.Inc("token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="redir"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%w: token is invalid or expired", errUnauthorized)
+	}
+	if err != nil {
+		return nil, err
+	}
+	role, groups, ok := tokenUser(t)
+	if !ok {
+		authFailures.Inc("token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="redir"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%w: user of the token does not exist", errUnauthorized)
+	}
+
+	if now.Sub(t.LastUsed) >= tokenTouchInterval {
+		if err := s.db.TouchToken(ctx, t.ID, now); err != nil {
+			logging.FromContext(ctx).Warn("cannot update token", "token", t.ID, "err", err)
+		}
+	}
+	logging.AddAttrs(ctx, slog.String("token", t.ID))
+
+	// Tokens that were created before roles existed act as editors. A
+	// token never exceeds the current role and groups of its user.
+	id = &identity{user: t.User, role: config.Role(t.Role), token: t}
+	if id.role == "" {
+		id.role = config.RoleEditor
+	}
+	if !role.Allows(id.role) {
+		id.role = role
+	}
+	for _, g := range t.Groups {
+		for _, gg := range groups {
+			if g == gg {
+				id.groups = append(id.groups, g)
+				break
+			}
+		}
+	}
+	return id, nil
+}
+
+// tokenUser returns the current role and groups of the user of the given
+// token, and reports whether the user still exists. Only the accounts of
+// basic authentication are known. OIDC users have the role and groups of
+// their latest login, and the users of sso and none are admins.
+func tokenUser(t *models.Token) (role config.Role, groups []string, ok bool) {
+	conf := config.Get()
+	switch conf.Auth.Enable {
+	case config.None, config.SSO:
+		return config.RoleAdmin, t.Groups, true
+	case config.OIDC:
+		if t.UserRole == "" {
+			// The user did not log in since the token was created,
+			// whose role and groups are taken from the login.
+			return config.RoleAdmin, t.Groups, true
+		}
+		return config.Role(t.UserRole), t.UserGroups, true
+	}
+	for _, a := range conf.Auth.Basic {
+		if a.Username == t.User {
+			if a.Role == "" {
+				return config.RoleAdmin, a.Groups, true
+			}
+			return a.Role, a.Groups, true
+		}
+	}
+	return "", nil, false
+}
+
+// guard rejects the request if its IP is blocked after too many failed
+// attempts. The returned function records the result of the attempt,
+// i.e. an errUnauthorized counts as a failure.
+func guard(r *http.Request) (record func(err error), err error) {
 	// check if the IP failure attempts are too much
 	// if so, direct abort the request without checking credentials
-	ip := utils.ReadIP(r)
+	ip := utils.RealIP(r)
 	if i, ok := blocklist.Load(ip); ok {
 		info := i.(*blockinfo)
 		count := atomic.LoadInt64(&info.failCount)
@@ -88,10 +282,10 @@ func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (user string
 			bloc := info.blockTime.Load().(time.Duration)
 
 			if time.Now().UTC().Sub(last.Add(bloc)) < 0 {
-				log.Printf("block ip %v, too much failure attempts. Block time: %v, release until: %v\n",
-					ip, bloc, last.Add(bloc))
-				err = fmt.Errorf("%w: too much failure attempts", errUnauthorized)
-				return
+				logging.FromContext(r.Context()).Warn("blocked ip, too much failure attempts",
+					"ip", utils.Pseudonymize(ip), "block_time", bloc, "release_until", last.Add(bloc))
+				authFailures.Inc("blocked")
+				return nil, fmt.Errorf("%w: too much failure attempts", errUnauthorized)
 			}
 
 			// clear the failcount, but increase the next block time
@@ -100,7 +294,7 @@ func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (user string
 		}
 	}
 
-	defer func() {
+	return func(err error) {
 		if !errors.Is(err, errUnauthorized) {
 			return
 		}
@@ -118,18 +312,40 @@ func (s *server) handleAuth(w http.ResponseWriter, r *http.Request) (user string
 			atomic.AddInt64(&info.failCount, 1)
 			info.lastFail.Store(time.Now().UTC())
 		}
-	}()
+	}, nil
+}
 
-	found := false
-	for _, account := range config.Conf.Auth.Basic {
-		if u == account.Username && p == account.Password {
-			found = true
-			break
+// checkAccount returns the account that matches the given credentials,
+// or nil if none matches. Unknown users take about the same time as
+// known users, so that the time does not reveal whether a user exists.
+func checkAccount(accounts []config.Account, user, pass string) *config.Account {
+	var match *config.Account
+	for i := range accounts {
+		if subtle.ConstantTimeCompare([]byte(user), []byte(accounts[i].Username)) == 1 {
+			match = &accounts[i]
 		}
 	}
-	if !found {
-		w.WriteHeader(http.StatusUnauthorized)
-		return "", fmt.Errorf("%w: username or password is invalid", errUnauthorized)
+	var ok bool
+	switch {
+	case match == nil:
+		ok = passwd.CompareDummy(pass)
+	case match.PasswordHash != "":
+		ok = passwd.Compare(match.PasswordHash, pass)
+	default:
+		ok = passwd.ComparePlain(match.Password, pass)
+	}
+	if !ok {
+		return nil
+	}
+	return match
+}
+
+// warnPlaintext warns about the accounts with plaintext passwords.
+func warnPlaintext() {
+	for _, a := range config.Get().Auth.Basic {
+		if a.Password != "" {
+			slog.Warn("plaintext password is deprecated, use a password_hash generated by redir passwd",
+				"username", a.Username)
+		}
 	}
-	return u, nil
 }
@@ -0,0 +1,210 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/passwd"
+	"changkun.de/x/redir/internal/stats"
+	"changkun.de/x/redir/internal/token"
+)
+
+// subcommands are commands that come with their own flags, for instance
+// redir stats purge -apply.
+var subcommands = map[string]func(args []string){
+	"stats":  runStats,
+	"config": runConfig,
+	"passwd": runPasswd,
+	"token":  runToken,
+}
+
+func runStats(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `usage: redir stats <command> [options]
+
+commands:
+	purge	Preview or apply a purge of expired visit records
+	erase	Erase visit records of a visitor ID or an IP address
+	backfill	Parse information of existing visit records
+	export	Export visit records or daily PV/UV as CSV or JSON Lines
+`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	switch args[0] {
+	case "purge":
+		fs := flag.NewFlagSet("purge", flag.ExitOnError)
+		days := fs.Int("days", config.Get().Stats.Retention.Days, "Retention days of visit records, default to stats.retention.days")
+		apply := fs.Bool("apply", false, "Apply the purge, otherwise only preview the number of records to be purged")
+		_ = fs.Parse(args[1:])
+		stats.PurgeCmd(*days, *apply)
+	case "erase":
+		fs := flag.NewFlagSet("erase", flag.ExitOnError)
+		vid := fs.String("vid", "", "Visitor ID, the value of the redir_vid cookie")
+		ip := fs.String("ip", "", "IP address as stored, i.e. hashed or truncated if gdpr.hide_ip is enabled")
+		_ = fs.Parse(args[1:])
+		stats.EraseCmd(*vid, *ip)
+	case "backfill":
+		stats.BackfillCmd()
+	case "export":
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		a := fs.String("a", "", "Alias to export, default to all aliases")
+		t0 := fs.String("t0", "", "Start time, a date 2006-01-02 or RFC3339 timestamp, default to the beginning")
+		t1 := fs.String("t1", "", "End time (exclusive), same format as t0, a date includes the whole day, default to now")
+		format := fs.String("format", string(stats.FormatCSV), "Export format, csv or ndjson")
+		data := fs.String("data", string(stats.DataVisits), "Exported data, visits for raw visit records or daily for daily PV/UV")
+		traffic := fs.String("traffic", string(db.TrafficAll), "Exported traffic, all, human or bot")
+		out := fs.String("o", "", "Output file, default to the standard output")
+		_ = fs.Parse(args[1:])
+
+		opts := stats.ExportOptions{
+			Alias:   *a,
+			End:     time.Now().UTC(),
+			Traffic: db.Traffic(*traffic),
+			Format:  stats.Format(*format),
+			Data:    stats.Data(*data),
+		}
+		var err error
+		if *t0 != "" {
+			opts.Start, err = parseTime(*t0, time.UTC)
+			if err != nil {
+				log.Fatalf("invalid start time: %v", err)
+			}
+		}
+		if *t1 != "" {
+			opts.End, err = parseEnd(*t1, time.UTC)
+			if err != nil {
+				log.Fatalf("invalid end time: %v", err)
+			}
+		}
+		stats.ExportCmd(opts, *out)
+	default:
+		usage()
+	}
+}
+
+func runConfig(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `usage: redir config <command>
+
+commands:
+	check	Validate the configuration and print the effective configuration with secrets redacted
+`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	switch args[0] {
+	case "check":
+		// An invalid configuration is already rejected when it is
+		// loaded, hence the effective configuration is valid.
+		if err := config.WriteRedacted(os.Stdout); err != nil {
+			log.Fatalf("cannot print configuration: %v", err)
+		}
+	default:
+		usage()
+	}
+}
+
+func runPasswd(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `usage: redir passwd [-cost <cost>]
+
+Reads a password from the standard input and prints its bcrypt hash,
+which can be used as the password_hash of a basic auth account.
+
+options:
+`)
+		fs.PrintDefaults()
+	}
+	cost := fs.Int("cost", passwd.DefaultCost, "bcrypt cost, higher is slower to compute and to guess")
+	_ = fs.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	p, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.Fatalf("cannot read password: %v", err)
+	}
+	p = strings.TrimRight(p, "\r\n")
+	if p == "" {
+		log.Fatalf("password is empty")
+	}
+	h, err := passwd.Hash(p, *cost)
+	if err != nil {
+		log.Fatalf("cannot hash password: %v", err)
+	}
+	fmt.Println(h)
+}
+
+func runToken(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, `usage: redir token <command> [options]
+
+commands:
+	create	Create an API token of a user
+	list	List the API tokens of a user, or of all users
+	revoke	Revoke an API token
+`)
+		os.Exit(2)
+	}
+	if len(args) == 0 {
+		usage()
+	}
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		user := fs.String("u", "", "User of the token")
+		name := fs.String("name", "", "Name of the token, e.g. the job that uses it")
+		scope := fs.String("scope", string(token.Read), "Scope of the token, read, create or admin")
+		prefix := fs.String("prefix", "", "Restrict the token to aliases that start with the prefix")
+		ttl := fs.Duration("ttl", 0, "Lifetime of the token, e.g. 2160h, default to never expire")
+		role := fs.String("role", string(config.RoleEditor), "Role of the token, viewer, editor or admin")
+		groups := fs.String("groups", "", "Comma separated groups of the token")
+		_ = fs.Parse(args[1:])
+		token.CreateCmd(*user, *name, token.Scope(*scope), *prefix, *ttl,
+			config.Role(*role), splitList(*groups))
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		user := fs.String("u", "", "User of the tokens, default to all users")
+		_ = fs.Parse(args[1:])
+		token.ListCmd(*user)
+	case "revoke":
+		fs := flag.NewFlagSet("revoke", flag.ExitOnError)
+		id := fs.String("id", "", "ID of the token")
+		_ = fs.Parse(args[1:])
+		token.RevokeCmd(*id)
+	default:
+		usage()
+	}
+}
+
+// splitList splits a comma separated list and drops empty elements.
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
@@ -15,6 +15,8 @@ const App = () => {
     const showImpressum = root.getAttribute('show-impressum')
     const showPrivacy = root.getAttribute('show-privacy')
     const showContact = root.getAttribute('show-contact')
+    const user = root.getAttribute('user')
+    const role = root.getAttribute('role')
     return <Home
         isAdmin={isAdmin === 'true' ? true : false}
         statsMode={statsMode === 'true' ? true : false}
@@ -22,6 +24,8 @@ const App = () => {
         showImpressum={showImpressum === 'true' ? true : false}
         showPrivacy={showPrivacy === 'true' ? true : false}
         showContact={showContact === 'true' ? true : false}
+        user={user}
+        canEdit={role !== 'viewer'}
     />
 }
 
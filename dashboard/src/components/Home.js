@@ -8,6 +8,7 @@ import RedirTable from './RedirTable'
 import RedirCreate from './RedirCreate'
 import './Home.css'
 import Login from './Login'
+import Overview from './Overview'
 
 const { Header, Content, Footer } = Layout;
 
@@ -33,10 +34,12 @@ const Home = (props) => {
             width: 'max-content',
             justifyContent: 'flex-end',
           }}>
-          {props.isAdmin ? <RedirCreate refreshRef={tableRefresh}/> : <div></div>}
+          {props.isAdmin && props.canEdit ? <RedirCreate refreshRef={tableRefresh}/> : <div></div>}
           </div>
 
-          <RedirTable isAdmin={props.isAdmin} statsMode={props.statsMode} devMode={props.devMode} refreshRef={tableRefresh}/>
+          {props.isAdmin && props.statsMode ? <Overview devMode={props.devMode}/> : ''}
+
+          <RedirTable isAdmin={props.isAdmin} canEdit={props.canEdit} user={props.user} statsMode={props.statsMode} devMode={props.devMode} refreshRef={tableRefresh}/>
         </div>
       </Content>
       <Footer style={{ textAlign: 'center' }}>
@@ -0,0 +1,144 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+import React, { useState, useEffect } from 'react'
+import { Row, Col, PageHeader, Divider, DatePicker, Switch } from 'antd';
+import { Line, Bar, Column } from '@ant-design/charts'
+import moment from 'moment';
+
+// Overview shows the statistics across all aliases, admin only.
+const Overview = (props) => {
+  // The end date includes the whole day.
+  const today = new Date()
+  const start = new Date()
+  start.setDate(today.getDate() - 29)
+  const begin = start.toISOString().slice(0, 10)
+  const end = today.toISOString().slice(0, 10)
+  const timezone = Intl.DateTimeFormat().resolvedOptions().timeZone || 'UTC'
+
+  const [range, setRange] = useState([begin, end])
+  const [traffic, setTraffic] = useState('human')
+  const [timeData, setTimeData] = useState([])
+  const [aliasData, setAliasData] = useState([])
+  const [refData, setRefData] = useState([])
+  const [linkData, setLinkData] = useState([])
+
+  let endpoint = '/s/?'
+  if (props.devMode) {
+    endpoint = 'http://localhost:9123/s/?'
+  }
+
+  const fetchStat = (stat, t0, t1, tr, setData) => {
+    fetch(endpoint + new URLSearchParams({
+      mode: 'stats',
+      stat: stat,
+      t0: t0,
+      t1: t1,
+      tz: timezone,
+      granularity: 'day',
+      traffic: tr,
+    }))
+    .then((response) => response.json())
+    .then((json) => {
+      if (json === null) json = []
+      setData(json)
+    })
+    .catch((error) => {
+      console.log('fetch data failed', error)
+    })
+  }
+  const fetchAll = (t0, t1, tr) => {
+    fetchStat('time', t0, t1, tr, setTimeData)
+    fetchStat('aliases', t0, t1, tr, setAliasData)
+    fetchStat('referer-domain', t0, t1, tr, setRefData)
+    fetchStat('links', t0, t1, tr, setLinkData)
+  }
+  useEffect(() => fetchAll(begin, end, traffic), [])
+
+  const dateRangeOnChange = (_, dateString) => {
+    setRange(dateString)
+    fetchAll(dateString[0], dateString[1], traffic)
+  }
+  const trafficOnChange = (humanOnly) => {
+    const tr = humanOnly ? 'human' : 'all'
+    setTraffic(tr)
+    fetchAll(range[0], range[1], tr)
+  }
+
+  const traffics = []
+  for (const category of ['PV', 'UV']) {
+    for (const entry of timeData) {
+      traffics.push({
+        time: entry.time.slice(0, 10),
+        value: category === 'PV' ? entry.pv : entry.uv,
+        category: category,
+      })
+    }
+  }
+
+  return (
+    <div>
+      <PageHeader
+        className="site-page-header"
+        onBack={false}
+        title="Overview"
+      />
+      <DatePicker.RangePicker style={{float: 'right', bottom: '5px'}} defaultValue={[moment(begin), moment(end)]} onChange={dateRangeOnChange}/>
+      <Switch style={{float: 'right', margin: '5px 12px'}} checkedChildren="Human" unCheckedChildren="All" defaultChecked onChange={trafficOnChange}/>
+      <Divider />
+      <Line
+        theme='dark'
+        appendPadding={20}
+        data={traffics}
+        xField='time'
+        yField='value'
+        seriesField='category'
+        smooth={true}
+        color={['#5B8FF9', '#5AD8A6']}
+        style={{height: '300px'}}
+      />
+      <Row>
+        <Col span={12}>
+          <PageHeader className="site-page-header" title="Top Aliases" />
+          <Bar
+            theme='dark'
+            appendPadding={20}
+            data={aliasData}
+            xField='pv'
+            yField='alias'
+            seriesField='alias'
+            legend={false}
+          />
+        </Col>
+        <Col span={12}>
+          <PageHeader className="site-page-header" title="Top Referrers" />
+          <Bar
+            theme='dark'
+            appendPadding={20}
+            data={refData.slice(0, 10)}
+            xField='count'
+            yField='host'
+            seriesField='class'
+            legend={{ position: 'top-right' }}
+          />
+        </Col>
+      </Row>
+      <Divider />
+      <PageHeader className="site-page-header" title="New Links" />
+      <Column
+        theme='dark'
+        appendPadding={20}
+        data={linkData.map(entry => {
+          return {time: entry.time.slice(0, 10), count: entry.count}
+        })}
+        xField='time'
+        yField='count'
+        style={{height: '200px'}}
+      />
+      <Divider />
+    </div>
+  )
+}
+
+export default Overview
@@ -92,6 +92,7 @@ const RedirCreate = (props) => {
               private: values.private === 'true' ? true : false,
               trust: values.trust === 'true' ? true : false,
               valid_from: rfc3339(values.valid_from),
+              group: values.group,
             }
           })
         })
@@ -184,6 +185,15 @@ const RedirCreate = (props) => {
         tooltip="The shortened link is avaliable since the time specified. Before the specified time, the link shows a countdown page."
       />
       </ProForm.Group>
+      <ProForm.Group>
+        <ProFormText
+          width="md"
+          name="group"
+          label="Group"
+          placeholder="Share with one of your groups"
+          tooltip="Members of the group can modify the link as well. The link is only yours if the group is empty."
+        />
+      </ProForm.Group>
     </ModalForm>
     </ConfigProvider>
   )
@@ -4,10 +4,11 @@
 
 import React, { useState } from 'react'
 import { EditableProTable } from '@ant-design/pro-table'
-import { ConfigProvider, message } from 'antd'
+import { ConfigProvider, Input, message } from 'antd'
 import enUS from 'antd/lib/locale/en_US'
 import './RedirTable.css'
 import Stats from './Stats'
+import RedirTransfer from './RedirTransfer'
 
 const waitTime = (time = 100) => {
   return new Promise((resolve) => {
@@ -49,6 +50,7 @@ const RedirTable = (props) => {
   const refreshRef = props.refreshRef
   const [editableKeys, setEditableRowKeys] = useState([])
   const [dataSource, setDataSource] = useState([])
+  const [owner, setOwner] = useState('')
 
   let columns = [
     {
@@ -114,6 +116,20 @@ const RedirTable = (props) => {
         hideInSearch: true,
         tip: 'The shortened link is avaliable since the time specified. Before the specified time, the link shows a countdown page.',
       },
+      {
+        title: 'Owner',
+        dataIndex: 'owner',
+        hideInSearch: true,
+        editable: false,
+        tip: 'The person who owns this alias. Links created before owners existed are owned by their creator.',
+      },
+      {
+        title: 'Group',
+        dataIndex: 'group',
+        hideInSearch: true,
+        editable: false,
+        tip: 'Members of the group can modify this alias as well.',
+      },
       {
         title: 'Created By',
         dataIndex: 'created_by',
@@ -131,12 +147,13 @@ const RedirTable = (props) => {
       {
         title: 'Operation',
         valueType: 'option',
-        render: (text, record, _, action) => [
+        render: (text, record, _, action) => props.canEdit ? [
           /* eslint-disable-next-line jsx-a11y/anchor-is-valid */
           <a key='editable' onClick={() => {
               action.startEditable?.(record.alias);
-          }}>Edit</a>
-        ],
+          }}>Edit</a>,
+          <RedirTransfer key='transfer' record={record} refreshRef={refreshRef}/>,
+        ] : [],
       },
     ])
   }
@@ -155,6 +172,13 @@ const RedirTable = (props) => {
         columns={columns}
         pagination={{pageSize: pageSize}}
         expandable={props.isAdmin && props.statsMode ? { expandedRowRender } : false}
+        params={{ owner }}
+        toolBarRender={props.isAdmin ? () => [
+          <Input.Search key='owner' allowClear placeholder='Filter by owner'
+            onSearch={value => setOwner(value.trim())}/>,
+          /* eslint-disable-next-line jsx-a11y/anchor-is-valid */
+          props.user ? <a key='mine' onClick={() => setOwner(props.user)}>My links</a> : '',
+        ] : false}
         request={async (params) => {
           const mode = props.isAdmin ? 'index-pro' : 'index'
 
@@ -170,7 +194,13 @@ const RedirTable = (props) => {
               window.location.pathname;
           }
 
-          const url = `${host}${path}/?mode=${mode}&pn=${params.current}&ps=${params.pageSize}`
+          let url = `${host}${path}/?mode=${mode}&pn=${params.current}&ps=${params.pageSize}`
+          if (props.isAdmin) {
+            url += '&traffic=human'
+          }
+          if (props.isAdmin && params.owner) {
+            url += `&owner=${encodeURIComponent(params.owner)}`
+          }
           const resp = await fetch(url, {
             method: 'GET',
           })
@@ -185,6 +215,7 @@ const RedirTable = (props) => {
                 redirs.data[i].valid_from = null
               }
               redirs.data[i].visits = `${redirs.data[i].pv}/${redirs.data[i].uv}`
+              redirs.data[i].owner = redirs.data[i].owner || redirs.data[i].created_by
             }
           }
           return redirs
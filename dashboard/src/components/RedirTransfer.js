@@ -0,0 +1,75 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+import { ConfigProvider, message } from 'antd';
+import ProForm, { ModalForm, ProFormText } from '@ant-design/pro-form';
+import enUS from 'antd/lib/locale/en_US'
+
+const RedirTransfer = (props) => {
+  const ref = props.refreshRef
+  const record = props.record
+
+  return (
+    <ConfigProvider locale={enUS}>
+    <ModalForm
+      title={`Transfer /s/${record.alias}`}
+      initialValues={{ owner: record.owner || record.created_by, group: record.group }}
+      submitter={{
+        searchConfig: {
+          submitText: 'Confirm',
+          resetText: 'Cancel',
+        },
+      }}
+      /* eslint-disable-next-line jsx-a11y/anchor-is-valid */
+      trigger={<a>Transfer</a>}
+      onFinish={async (values) => {
+        const path = window.location.pathname.endsWith('/') ?
+          window.location.pathname.slice(0, -1) :
+          window.location.pathname
+        const resp = await fetch(path+'/', {
+          method: 'POST',
+          headers: {
+            'Accept': 'application/json',
+            'Content-Type': 'application/json',
+          },
+          body: JSON.stringify({
+            op: 'transfer',
+            alias: record.alias,
+            data: {
+              owner: values.owner,
+              group: values.group || '',
+            }
+          })
+        })
+        if (!resp.ok) {
+          const data = await resp.json()
+          message.error(data.message)
+          return false
+        }
+        message.success(`/s/${record.alias} is transferred to ${values.owner}!`, 10)
+        ref.current.reload() // refresh table.
+        return true
+      }}
+    >
+      <ProForm.Group>
+        <ProFormText
+          rules={[{ required: true, message: 'Please input the new owner' }]}
+          width="md"
+          name="owner"
+          label="Owner"
+          tooltip="Only the owner and admins can transfer the link."
+        />
+        <ProFormText
+          width="md"
+          name="group"
+          label="Group"
+          tooltip="Members of the group can modify the link as well. Empty shares the link with nobody."
+        />
+      </ProForm.Group>
+    </ModalForm>
+    </ConfigProvider>
+  )
+}
+
+export default RedirTransfer
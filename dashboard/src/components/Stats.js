@@ -3,18 +3,15 @@
 // license that can be found in the LICENSE file.
 
 import React, { useState, useEffect } from 'react'
-import { Row, Col, PageHeader, Divider, DatePicker } from 'antd';
+import { Row, Col, PageHeader, Divider, DatePicker, Switch } from 'antd';
 import { Line, Pie, Bar } from '@ant-design/charts'
-import UAParser from 'ua-parser-js'
 import moment from 'moment';
 
-const uaparser = new UAParser()
-
 const Stats = (props) => {
+  // The end date includes the whole day.
   const today = new Date()
-  today.setDate(today.getDate() + 1)
   const start = new Date()
-  start.setDate(today.getDate() - 30)
+  start.setDate(today.getDate() - 29)
   let begin = start.toISOString().slice(0, 10)
   let end = today.toISOString().slice(0, 10)
 
@@ -29,6 +26,9 @@ const Stats = (props) => {
     setT1(t1)
   }
 
+  const [traffic, setTraffic] = useState('human')
+  const timezone = Intl.DateTimeFormat().resolvedOptions().timeZone || 'UTC'
+
   let endpoint = '/s/?'
   if (props.devMode) {
     endpoint = 'http://localhost:9123/s/?'
@@ -38,13 +38,16 @@ const Stats = (props) => {
 
   const [pvuvData, setPVUVData] = useState([])
   useEffect(() => asyncFetchTime(t0, t1), [])
-  const asyncFetchTime = (t0, t1) => {
+  const asyncFetchTime = (t0, t1, tr = traffic) => {
     fetch(endpoint+ new URLSearchParams({
       mode: 'stats',
       a: props.alias,
       stat: 'time',
       t0: t0,
       t1: t1,
+      granularity: 'day',
+      tz: timezone,
+      traffic: tr,
     }))
     .then((response) => response.json())
     .then((json) => {
@@ -56,95 +59,62 @@ const Stats = (props) => {
     })
   }
   const [refData, setRefData] = useState([])
+  const [refDomain, setRefDomain] = useState(true)
   useEffect(() => asyncFetchRef(t0, t1), [])
-  const asyncFetchRef = (t0, t1) => {
+  const asyncFetchRef = (t0, t1, tr = traffic, domain = refDomain) => {
     fetch(endpoint+ new URLSearchParams({
       mode: 'stats',
       a: props.alias,
-      stat: 'referer',
+      stat: domain ? 'referer-domain' : 'referer',
       t0: t0,
       t1: t1,
+      traffic: tr,
     }))
     .then((response) => response.json())
     .then((json) => {
       if (json === null) json = []
-      setRefData(json)
+      setRefData(json.map(entry => {
+        if (domain) {
+          return {referer: entry.host, count: entry.count}
+        }
+        return entry
+      }))
     })
     .catch((error) => {
       console.log('fetch data failed', error)
     })
   }
-  const [uaData, setUAData] = useState([])
+  const [browserData, setBrowserData] = useState([])
+  const [osData, setOSData] = useState([])
+  const [deviceData, setDeviceData] = useState([])
+  const [countryData, setCountryData] = useState([])
   useEffect(() => {asyncFetchUA(t0, t1)}, [])
-  const asyncFetchUA = (t0, t1) => {
-    fetch(endpoint+ new URLSearchParams({
-      mode: 'stats',
-      a: props.alias,
-      stat: 'ua',
-      t0: t0,
-      t1: t1,
-    }))
-    .then((response) => response.json())
-    .then((json) => {
-      if (json === null) json = []
-      setUAData(json)
-    })
-    .catch((error) => {
-      console.log('fetch data failed', error)
-    })
-  }
-  const validUAData = []
-  for (let i = 0; i < uaData.length; i++) {
-    const entry = uaData[i]
-    if (entry.ua.includes('bot') || entry.ua.includes('unknown')) {
-      continue
+  const asyncFetchUA = (t0, t1, tr = traffic) => {
+    const fetchName = (stat, setData) => {
+      fetch(endpoint+ new URLSearchParams({
+        mode: 'stats',
+        a: props.alias,
+        stat: stat,
+        t0: t0,
+        t1: t1,
+        traffic: tr,
+      }))
+      .then((response) => response.json())
+      .then((json) => {
+        if (json === null) json = []
+        setData(json.map(entry => {
+          return {value: entry.count, name: entry.name}
+        }))
+      })
+      .catch((error) => {
+        console.log('fetch data failed', error)
+      })
     }
-    const r = uaparser.setUA(entry.ua).getResult()
-    uaData[i].browser = r.browser.name
-    uaData[i].device = r.os.name
-    validUAData.push(uaData[i])
+    fetchName('browser', setBrowserData)
+    fetchName('os', setOSData)
+    fetchName('device', setDeviceData)
+    fetchName('country', setCountryData)
   }
-
-  let browsers = {}
-  let devices = {}
-  for (let i = 0; i < validUAData.length; i++) {
-    if (validUAData[i].browser === undefined) {
-      validUAData[i].browser = 'Others'
-    }
-    if (browsers[validUAData[i].browser] === undefined) {
-      browsers[validUAData[i].browser] = validUAData[i].count
-    } else {
-      browsers[validUAData[i].browser] += validUAData[i].count
-    }
-
-    if (validUAData[i].device === undefined) {
-      validUAData[i].device = 'Others'
-    }
-    if (devices[validUAData[i].device] === undefined) {
-      devices[validUAData[i].device] = validUAData[i].count
-    } else {
-      devices[validUAData[i].device] += validUAData[i].count
-    }
-  }
-  const browserArray = []
-  for (const [key, value] of Object.entries(browsers)) {
-    browserArray.push({value: value, name: key})
-  }
-  const deviceArray = []
-  for (const [key, value] of Object.entries(devices)) {
-    deviceArray.push({value: value, name: key})
-  }
-
-  browserArray.sort((a, b) => {
-    if (a.value < b.value) return 1
-    if (a.value > b.value) return -1
-    return 0
-  })
-  deviceArray.sort((a, b) => {
-    if (a.value < b.value) return 1
-    if (a.value > b.value) return -1
-    return 0
-  })
   const dateRangeOnChange = (_, dateString) => {
     const d0 = dateString[0]
     const d1 = dateString[1]
@@ -154,6 +124,17 @@ const Stats = (props) => {
     asyncFetchRef(d0, d1)
     asyncFetchUA(d0, d1)
   }
+  const refDomainOnChange = (domain) => {
+    setRefDomain(domain)
+    asyncFetchRef(t0, t1, traffic, domain)
+  }
+  const trafficOnChange = (humanOnly) => {
+    const tr = humanOnly ? 'human' : 'all'
+    setTraffic(tr)
+    asyncFetchTime(t0, t1, tr)
+    asyncFetchRef(t0, t1, tr)
+    asyncFetchUA(t0, t1, tr)
+  }
   return (
     <div>
       <PageHeader
@@ -162,6 +143,7 @@ const Stats = (props) => {
         title="Visitors"
       />
       <DatePicker.RangePicker style={{float: 'right', bottom: '5px'}} defaultValue={[moment(begin), moment(end)]} onChange={dateRangeOnChange}/>
+      <Switch style={{float: 'right', margin: '5px 12px'}} checkedChildren="Human" unCheckedChildren="All" defaultChecked onChange={trafficOnChange}/>
       <Divider />
       <StatLine alias={props.alias} data={pvuvData} t0={t0} t1={t1}/>
       <Row>
@@ -169,6 +151,7 @@ const Stats = (props) => {
           <PageHeader
             className="site-page-header"
             title="Referrers"
+            extra={<Switch checkedChildren="Domain" unCheckedChildren="URL" defaultChecked onChange={refDomainOnChange}/>}
           />
           <StatPieRef data={refData} t0={t0} t1={t1}/>
         </Col>
@@ -177,65 +160,52 @@ const Stats = (props) => {
             className="site-page-header"
             title="Browsers"
           />
-          <StatBarUA data={browserArray} t0={t0} t1={t1}/>
+          <StatBarUA data={browserData} t0={t0} t1={t1}/>
         </Col>
       </Row>
       <Divider />
       <Row>
-      <Col span={24} style={{height: '200px'}}>
+      <Col span={12} style={{height: '200px'}}>
+        <PageHeader
+          className="site-page-header"
+          title="Operating Systems"
+        />
+        <StatBarUA data={osData} t0={t0} t1={t1}/>
+      </Col>
+      <Col span={12} style={{height: '200px'}}>
         <PageHeader
           className="site-page-header"
           title="Devices"
         />
-        <StatBarUA data={deviceArray} t0={t0} t1={t1}/>
+        <StatBarUA data={deviceData} t0={t0} t1={t1}/>
+      </Col>
+      </Row>
+      <Divider />
+      <Row>
+      <Col span={12} style={{height: '200px'}}>
+        <PageHeader
+          className="site-page-header"
+          title="Countries"
+        />
+        <StatBarUA data={countryData} t0={t0} t1={t1}/>
       </Col>
       </Row>
       <Divider />
     </div>
   )
 }
-const formatDate = (date) => {
-  return new Date(date).toISOString().slice(0, 10)
-}
-const dateRange = (startDate, endDate, steps = 1) => {
-  const dates = {}
-  let currentDate = new Date(startDate)
-
-  while (currentDate <= new Date(endDate)) {
-    dates[formatDate(new Date(currentDate))] = 0
-    currentDate.setUTCDate(currentDate.getUTCDate() + steps)
-  }
-  return dates
-}
-
 const StatLine = (props) => {
-  const begin = props.t0
-  const end = props.t1  
-  const pv = dateRange(begin, end)
-  const uv = dateRange(begin, end)
-  for (let i = 0; i < props.data.length; i++) {
-    const d = formatDate(new Date(props.data[i].time))
-      if (pv[d] !== undefined) {
-        pv[d] += props.data[i].pv
-      }
-      if (uv[d] !== undefined) {
-        uv[d] += props.data[i].uv
-      }
-  }
+  // The buckets are zero-filled and formatted in the requested timezone
+  // by the server, so the date prefix is the local date of a bucket.
   const allData = []
-  for (const [k, v] of Object.entries(pv)) {
-    allData.push({
-      time: k,
-      value: v,
-      category: 'PV'
-    })
-  }
-  for (const [k, v] of Object.entries(uv)) {
-    allData.push({
-      time: k,
-      value: v,
-      category: 'UV'
-    })
+  for (const category of ['PV', 'UV']) {
+    for (let i = 0; i < props.data.length; i++) {
+      allData.push({
+        time: props.data[i].time.slice(0, 10),
+        value: category === 'PV' ? props.data[i].pv : props.data[i].uv,
+        category: category,
+      })
+    }
   }
 
   const config = {
@@ -263,7 +233,7 @@ const StatPieRef = (props) => {
     theme: 'dark',
     appendPadding: 20,
     data: props.data.map(entry => {
-      if (entry.referer === 'unknown') {
+      if (entry.referer === 'unknown' || entry.referer === 'direct') {
         entry.referer = 'Direct'
       }
       return {
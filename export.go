@@ -0,0 +1,103 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/short"
+	"changkun.de/x/redir/internal/stats"
+)
+
+// export streams the visit records or the daily PV/UV of an alias, or of
+// all aliases, as a CSV or JSON Lines file, require admin access.
+func (s *server) export(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := s.handleAuth(w, r)
+	if err != nil {
+		return err
+	}
+
+	params := r.URL.Query()
+	opts := stats.ExportOptions{
+		Alias:   params.Get("a"),
+		Traffic: db.TrafficAll,
+		Format:  stats.FormatCSV,
+		Data:    stats.DataVisits,
+	}
+	if opts.Alias != "" && !short.Validity.MatchString(opts.Alias) {
+		return short.ErrInvalidAlias
+	}
+	if !id.canRead(opts.Alias) {
+		return forbid(w)
+	}
+	if v := params.Get("traffic"); v != "" {
+		opts.Traffic = db.Traffic(v)
+	}
+	if v := params.Get("format"); v != "" {
+		opts.Format = stats.Format(v)
+	}
+	if v := params.Get("data"); v != "" {
+		opts.Data = stats.Data(v)
+	}
+
+	loc := time.UTC
+	if tz := params.Get("tz"); tz != "" {
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%v: %v", errInvalidStatParam, err), http.StatusBadRequest)
+			return nil
+		}
+	}
+	opts.Start, opts.End, err = parseDuration(params, loc)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v: %v", errInvalidStatParam, err), http.StatusBadRequest)
+		return nil
+	}
+	if !opts.Traffic.Valid() || !opts.Format.Valid() || !opts.Data.Valid() {
+		http.Error(w, errInvalidStatParam.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	// The export may last longer than the write timeout of the server.
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	name := opts.Alias
+	if name == "" {
+		name = "all"
+	}
+	w.Header().Set("Content-Type", opts.Format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		`attachment; filename="redir-%s-%s.%s"`, name, opts.Data, opts.Format))
+	sw := &startedWriter{w: w}
+	err = stats.Export(ctx, sw, s.db, opts)
+	if err != nil && sw.started {
+		// The response cannot be redirected to the error page once it
+		// has started.
+		logging.FromContext(ctx).Error("export is interrupted", "err", err)
+		return nil
+	}
+	return err
+}
+
+// startedWriter records whether anything has been written to w.
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (w *startedWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.w.Write(b)
+}
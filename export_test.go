@@ -0,0 +1,71 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+)
+
+// slowWriter delays every write, as if the exported records were read
+// slowly from the database.
+type slowWriter struct {
+	http.ResponseWriter
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *slowWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestExportWriteTimeout(t *testing.T) {
+	ctx := context.Background()
+	store, err := db.NewStore(ctx, "mongodb://0.0.0.0:27018")
+	if err != nil {
+		t.Skip("cannot connect to data store")
+	}
+	t.Cleanup(func() { store.Close() })
+
+	t.Cleanup(func() { config.Reload() })
+	t.Setenv("REDIR_AUTH_ENABLE", "none")
+	t.Setenv("REDIR_SERVER_WRITE_TIMEOUT", "100ms")
+	if _, err := config.Reload(); err != nil {
+		t.Fatalf("cannot reload config: %v", err)
+	}
+
+	s := &server{db: store}
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.sHandlerGet(&slowWriter{ResponseWriter: w, delay: 200 * time.Millisecond}, r)
+	})
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config = newHTTPServer("", h)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + config.Get().S.Prefix + ".export?data=daily")
+	if err != nil {
+		t.Fatalf("cannot export: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("export is interrupted by the write timeout: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(b) != "date,alias,pv,uv\n" {
+		t.Fatalf("unexpected export: %d %q", resp.StatusCode, b)
+	}
+}
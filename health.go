@@ -0,0 +1,95 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/version"
+)
+
+// pingTimeout is the timeout of the database check of readiness.
+const pingTimeout = 2 * time.Second
+
+// healthz reports that the process is alive.
+func (s *server) healthz(w http.ResponseWriter, r *http.Request) {
+	logging.SetLevel(r.Context(), slog.LevelDebug)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// readyz reports whether the server is ready to serve requests, which is
+// not the case if the database is unreachable or the server is draining
+// on shutdown.
+func (s *server) readyz(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	logging.SetLevel(ctx, slog.LevelDebug)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "draining\n")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := s.db.Ping(ctx); err != nil {
+		logging.FromContext(ctx).Warn("database is not ready", "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "database unavailable\n")
+		return
+	}
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+type versionInfo struct {
+	Version       string   `json:"version"`
+	GoVersion     string   `json:"go_version"`
+	SchemaVersion int      `json:"schema_version"`
+	Features      []string `json:"features"`
+}
+
+// versionz serves the build information and the enabled features.
+func (s *server) versionz(w http.ResponseWriter, r *http.Request) {
+	c := config.Get()
+	features := []string{}
+	for _, f := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"stats", c.Stats.Enable},
+		{"geoip", s.geo != nil},
+		{"vcs", c.X.Enable},
+		{"metrics", c.Metrics.Enable},
+		{"tracing", c.Tracing.Enable},
+		{"tls", c.TLS.Enable},
+		{"acme", c.TLS.Enable && c.TLS.ACME.Enable},
+	} {
+		if f.enabled {
+			features = append(features, f.name)
+		}
+	}
+
+	b, _ := json.Marshal(versionInfo{
+		Version:       strings.TrimSpace(version.Version),
+		GoVersion:     runtime.Version(),
+		SchemaVersion: db.SchemaVersion,
+		Features:      features,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
@@ -7,6 +7,7 @@ package cache
 import (
 	"container/list"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"changkun.de/x/redir/internal/models"
@@ -23,7 +24,12 @@ type LRU struct {
 	size  uint
 	elems *list.List // of redirect
 
-	mu sync.RWMutex
+	hits   uint64
+	misses uint64
+
+	mu   sync.RWMutex
+	done chan struct{}
+	once sync.Once
 }
 
 func NewLRU(doexpire bool) *LRU {
@@ -32,6 +38,7 @@ func NewLRU(doexpire bool) *LRU {
 		size:  0,
 		elems: list.New(),
 		mu:    sync.RWMutex{},
+		done:  make(chan struct{}),
 	}
 	if doexpire {
 		go l.clear()
@@ -44,11 +51,22 @@ func NewLRU(doexpire bool) *LRU {
 // not synced.
 func (l *LRU) clear() {
 	t := time.NewTicker(5 * time.Minute)
-	for range t.C {
-		l.Flush()
+	defer t.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-t.C:
+			l.Flush()
+		}
 	}
 }
 
+// Stop stops clearing the lru. It is safe to call Stop more than once.
+func (l *LRU) Stop() {
+	l.once.Do(func() { close(l.done) })
+}
+
 func (l *LRU) Flush() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -65,6 +83,11 @@ func (l *LRU) Len() uint {
 	return l.size
 }
 
+// Stats returns the number of cache hits and misses of Get.
+func (l *LRU) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&l.hits), atomic.LoadUint64(&l.misses)
+}
+
 func (l *LRU) Get(k string) (*models.Redir, bool) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -72,9 +95,11 @@ func (l *LRU) Get(k string) (*models.Redir, bool) {
 	for e := l.elems.Front(); e != nil; e = e.Next() {
 		if e.Value.(*item).k == k {
 			l.elems.MoveToFront(e)
+			atomic.AddUint64(&l.hits, 1)
 			return e.Value.(*item).v.(*models.Redir), true
 		}
 	}
+	atomic.AddUint64(&l.misses, 1)
 	return nil, false
 }
 
@@ -181,3 +181,14 @@ func BenchmarkLRU(b *testing.B) {
 		})
 	})
 }
+
+func TestLRUStats(t *testing.T) {
+	l := NewLRU(false)
+	l.Get("a")
+	l.Put("a", &models.Redir{Alias: "a"})
+	l.Get("a")
+	l.Get("a")
+	if hits, misses := l.Stats(); hits != 2 || misses != 1 {
+		t.Fatalf("wrong stats, want 2 hits and 1 miss, got %v hits and %v misses", hits, misses)
+	}
+}
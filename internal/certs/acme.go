@@ -0,0 +1,446 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Certificates are renewed if they expire within renewBefore, and the
+// renewal is checked in renewInterval, or retried in retryInterval if
+// the renewal failed.
+const (
+	renewBefore   = 30 * 24 * time.Hour
+	renewInterval = 12 * time.Hour
+	retryInterval = 10 * time.Minute
+)
+
+// After a failed attempt to obtain a certificate, the host is not tried
+// again for a backoff, which starts at minBackoff and doubles after each
+// failure up to retryInterval. Meanwhile, handshakes fail immediately
+// instead of waiting for another attempt.
+const minBackoff = time.Minute
+
+// challengePrefix is the path prefix of HTTP-01 challenges.
+const challengePrefix = "/.well-known/acme-challenge/"
+
+// accountKeyFile is the file name of the ACME account key in the cache
+// directory.
+const accountKeyFile = "acme_account.key"
+
+// Manager obtains and renews certificates of the allowed hosts from an
+// ACME CA using HTTP-01 challenges. The account key and certificates are
+// cached in a directory, so that they survive restarts.
+type Manager struct {
+	client   *acme.Client
+	email    string
+	hosts    map[string]bool
+	cacheDir string
+
+	tokens sync.Map // challenge path -> key authorization
+
+	mu         sync.Mutex // protects certs and failures
+	certs      map[string]*tls.Certificate
+	failures   map[string]*failure
+	obtainMu   sync.Mutex // serializes requests to the CA
+	registered bool
+}
+
+// failure is the last failed attempt to obtain the certificate of a
+// host.
+type failure struct {
+	err     error
+	at      time.Time
+	backoff time.Duration
+}
+
+// NewManager returns a manager that uses the CA of the given directory
+// URL, e.g. acme.LetsEncryptURL, to obtain certificates of the given
+// hosts. The email is the optional contact of the ACME account.
+func NewManager(directoryURL, email, cacheDir string, hosts []string) (*Manager, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts are allowed for ACME")
+	}
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create certificate cache: %w", err)
+	}
+	key, err := accountKey(filepath.Join(cacheDir, accountKeyFile))
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		client:   &acme.Client{Key: key, DirectoryURL: directoryURL},
+		email:    email,
+		hosts:    map[string]bool{},
+		cacheDir: cacheDir,
+		certs:    map[string]*tls.Certificate{},
+		failures: map[string]*failure{},
+	}
+	for _, h := range hosts {
+		m.hosts[strings.ToLower(h)] = true
+	}
+	return m, nil
+}
+
+// accountKey loads the account key from the given file, or creates a
+// new key if the file does not exist.
+func accountKey(file string) (crypto.Signer, error) {
+	b, err := os.ReadFile(file)
+	if err == nil {
+		p, _ := pem.Decode(b)
+		if p == nil || p.Type != "EC PRIVATE KEY" {
+			return nil, fmt.Errorf("invalid ACME account key %s", file)
+		}
+		return x509.ParseECPrivateKey(p.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(file, b, 0600); err != nil {
+		return nil, fmt.Errorf("cannot save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// GetCertificate returns the certificate of the requested server name,
+// it can be used as the GetCertificate of a tls.Config. The certificate
+// is obtained from the CA if there is no valid certificate yet.
+func (m *Manager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, errors.New("missing server name")
+	}
+	if !m.hosts[name] {
+		return nil, fmt.Errorf("host %q is not allowed", name)
+	}
+
+	ctx := hello.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	return m.cert(ctx, name, time.Now())
+}
+
+// HTTPHandler returns a handler that responds to HTTP-01 challenges,
+// and passes all other requests to the fallback handler. A nil
+// fallback responds not found.
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, challengePrefix) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		v, ok := m.tokens.Load(r.URL.Path)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, v.(string))
+	})
+}
+
+// Watch renews the certificates of all allowed hosts before they expire
+// until ctx is done.
+func (m *Manager) Watch(ctx context.Context) {
+	for {
+		d := renewInterval
+		if err := m.Renew(ctx); err != nil {
+			slog.Error("cannot renew certificates", "err", err)
+			d = retryInterval
+		}
+
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Renew obtains certificates for all allowed hosts that have no
+// certificate, or whose certificates expire soon.
+func (m *Manager) Renew(ctx context.Context) error {
+	var errs []error
+	for h := range m.hosts {
+		if _, err := m.cert(ctx, h, time.Now().Add(renewBefore)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// cert returns a certificate of the given host that is still valid at
+// the given time.
+func (m *Manager) cert(ctx context.Context, host string, at time.Time) (*tls.Certificate, error) {
+	m.mu.Lock()
+	c := m.certs[host]
+	m.mu.Unlock()
+	if c != nil && at.Before(c.Leaf.NotAfter) {
+		return c, nil
+	}
+	if err := m.failed(host); err != nil {
+		return nil, err
+	}
+
+	m.obtainMu.Lock()
+	defer m.obtainMu.Unlock()
+
+	// The certificate might be obtained while waiting, or cached by a
+	// previous run. An attempt might also have failed while waiting.
+	m.mu.Lock()
+	c = m.certs[host]
+	m.mu.Unlock()
+	if c == nil {
+		c, _ = m.load(host)
+	}
+	if c == nil || !at.Before(c.Leaf.NotAfter) {
+		if err := m.failed(host); err != nil {
+			return nil, err
+		}
+		var err error
+		c, err = m.obtain(ctx, host)
+		if err != nil {
+			err = fmt.Errorf("cannot obtain certificate for %s: %w", host, err)
+			m.fail(host, err)
+			return nil, err
+		}
+		if err := m.save(host, c); err != nil {
+			slog.Error("cannot cache certificate", "host", host, "err", err)
+		}
+		slog.Info("obtained certificate", "host", host, "expire", c.Leaf.NotAfter)
+	}
+
+	m.mu.Lock()
+	m.certs[host] = c
+	delete(m.failures, host)
+	m.mu.Unlock()
+	return c, nil
+}
+
+// failed returns the error of the last failed attempt of the given host
+// if its backoff is not over yet.
+func (m *Manager) failed(host string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if f := m.failures[host]; f != nil && time.Since(f.at) < f.backoff {
+		return f.err
+	}
+	return nil
+}
+
+// fail records a failed attempt of the given host.
+func (m *Manager) fail(host string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	backoff := minBackoff
+	if f := m.failures[host]; f != nil {
+		backoff = f.backoff * 2
+		if backoff > retryInterval {
+			backoff = retryInterval
+		}
+	}
+	m.failures[host] = &failure{err: err, at: time.Now(), backoff: backoff}
+}
+
+// obtain obtains a new certificate of the given host from the CA.
+func (m *Manager) obtain(ctx context.Context, host string) (*tls.Certificate, error) {
+	if err := m.register(ctx); err != nil {
+		return nil, err
+	}
+
+	o, err := m.client.AuthorizeOrder(ctx, acme.DomainIDs(host))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range o.AuthzURLs {
+		z, err := m.client.GetAuthorization(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		if z.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range z.Challenges {
+			if c.Type == "http-01" {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return nil, errors.New("CA does not offer HTTP-01 challenges")
+		}
+		resp, err := m.client.HTTP01ChallengeResponse(chal.Token)
+		if err != nil {
+			return nil, err
+		}
+		path := m.client.HTTP01ChallengePath(chal.Token)
+		m.tokens.Store(path, resp)
+		defer m.tokens.Delete(path)
+
+		if _, err := m.client.Accept(ctx, chal); err != nil {
+			return nil, err
+		}
+		if _, err := m.client.WaitAuthorization(ctx, z.URI); err != nil {
+			return nil, err
+		}
+	}
+	o, err = m.client.WaitOrder(ctx, o.URI)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := m.client.CreateOrderCert(ctx, o.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+	return certificate(host, der, key)
+}
+
+// register registers the ACME account if it is not registered yet.
+func (m *Manager) register(ctx context.Context) error {
+	if m.registered {
+		return nil
+	}
+	a := &acme.Account{}
+	if m.email != "" {
+		a.Contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, a, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("cannot register ACME account: %w", err)
+	}
+	m.registered = true
+	return nil
+}
+
+// certificate returns the certificate of the given chain and key, and
+// verifies that the leaf certificate is valid for the given host.
+func certificate(host string, der [][]byte, key crypto.Signer) (*tls.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+	if err := leaf.VerifyHostname(host); err != nil {
+		return nil, err
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return nil, errors.New("certificate is expired or not yet valid")
+	}
+	if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(leaf.PublicKey) {
+		return nil, errors.New("certificate does not match the private key")
+	}
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// load loads the cached certificate of the given host. The cache file
+// contains the PEM encoded private key followed by the certificate
+// chain.
+func (m *Manager) load(host string) (*tls.Certificate, error) {
+	b, err := os.ReadFile(filepath.Join(m.cacheDir, host))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		key crypto.Signer
+		der [][]byte
+	)
+	for {
+		var p *pem.Block
+		p, b = pem.Decode(b)
+		if p == nil {
+			break
+		}
+		switch p.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(p.Bytes)
+			if err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			der = append(der, p.Bytes)
+		}
+	}
+	if key == nil {
+		return nil, errors.New("missing private key")
+	}
+	return certificate(host, der, key)
+}
+
+// save caches the certificate of the given host.
+func (m *Manager) save(host string, c *tls.Certificate) error {
+	der, err := x509.MarshalECPrivateKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	_ = pem.Encode(&buf, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	for _, b := range c.Certificate {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: b})
+	}
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// partial certificate.
+	f := filepath.Join(m.cacheDir, host)
+	if err := os.WriteFile(f+".tmp", buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(f+".tmp", f)
+}
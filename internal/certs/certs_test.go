@@ -0,0 +1,338 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/certs"
+)
+
+// issue issues a certificate of the given public key and hosts, which is
+// self-signed if the parent is nil.
+func issue(t *testing.T, pub, priv interface{}, parent *x509.Certificate, hosts ...string) []byte {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent = tmpl
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, priv)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %v", err)
+	}
+	return der
+}
+
+// writeKeyPair writes a new self-signed certificate of the given host.
+func writeKeyPair(t *testing.T, certFile, keyFile, host string, mod time.Time) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der := issue(t, &key.PublicKey, key, nil, host)
+	kder, _ := x509.MarshalECPrivateKey(key)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	os.Chtimes(certFile, mod, mod)
+	os.Chtimes(keyFile, mod, mod)
+}
+
+func leafName(t *testing.T, c *tls.Certificate) string {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatalf("cannot parse certificate: %v", err)
+	}
+	return leaf.DNSNames[0]
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	now := time.Now()
+	writeKeyPair(t, certFile, keyFile, "a.example.org", now.Add(-time.Minute))
+
+	r, err := certs.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("cannot load certificate: %v", err)
+	}
+	c, _ := r.GetCertificate(nil)
+	if got := leafName(t, c); got != "a.example.org" {
+		t.Fatalf("loaded certificate of %s, want a.example.org", got)
+	}
+	if ok, err := r.Reload(); ok || err != nil {
+		t.Fatalf("unchanged files are reloaded: %v, %v", ok, err)
+	}
+
+	writeKeyPair(t, certFile, keyFile, "b.example.org", now)
+	if ok, err := r.Reload(); !ok || err != nil {
+		t.Fatalf("changed files are not reloaded: %v, %v", ok, err)
+	}
+	c, _ = r.GetCertificate(nil)
+	if got := leafName(t, c); got != "b.example.org" {
+		t.Fatalf("reloaded certificate of %s, want b.example.org", got)
+	}
+
+	// Invalid files keep the loaded certificate.
+	os.WriteFile(certFile, []byte("invalid"), 0600)
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	if _, err := r.Reload(); err == nil {
+		t.Fatalf("invalid files are reloaded")
+	}
+	c, _ = r.GetCertificate(nil)
+	if got := leafName(t, c); got != "b.example.org" {
+		t.Fatalf("invalid files replace the certificate: %s", got)
+	}
+}
+
+// fakeCA is a minimal ACME CA that implements the HTTP-01 flow of
+// RFC 8555. It does not verify request signatures.
+type fakeCA struct {
+	t       *testing.T
+	srv     *httptest.Server
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	solver  http.Handler // the HTTP-01 challenge handler of the client
+	mu      sync.Mutex
+	host    string
+	authz   string // status of the authorization
+	chain   []byte
+	issued  int
+	orders  int
+	reject  bool // reject new orders
+	nonceID int
+}
+
+func newFakeCA(t *testing.T) *fakeCA {
+	ca := &fakeCA{t: t, authz: "pending"}
+	ca.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.cert, _ = x509.ParseCertificate(issue(t, &ca.key.PublicKey, ca.key, nil, "fake ca"))
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonceID++
+	w.Header().Set("Replay-Nonce", "nonce"+strings.Repeat("x", ca.nonceID%3))
+	u := ca.srv.URL
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	order := func(status string) map[string]interface{} {
+		o := map[string]interface{}{
+			"status":         status,
+			"identifiers":    []map[string]string{{"type": "dns", "value": ca.host}},
+			"authorizations": []string{u + "/authz"},
+			"finalize":       u + "/finalize",
+		}
+		if status == "valid" {
+			o["certificate"] = u + "/cert"
+		}
+		return o
+	}
+
+	switch r.URL.Path {
+	case "/dir":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   u + "/nonce",
+			"newAccount": u + "/account",
+			"newOrder":   u + "/order",
+		})
+	case "/nonce":
+	case "/account":
+		w.Header().Set("Location", u+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/order":
+		ca.orders++
+		if ca.reject {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{
+				"type":   "urn:ietf:params:acme:error:rejectedIdentifier",
+				"detail": "identifier is rejected",
+			})
+			return
+		}
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		ca.host = req.Identifiers[0].Value
+		w.Header().Set("Location", u+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order("pending"))
+	case "/order/1":
+		w.Header().Set("Location", u+"/order/1")
+		status := "pending"
+		if ca.authz == "valid" {
+			status = "ready"
+		}
+		json.NewEncoder(w).Encode(order(status))
+	case "/authz":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     ca.authz,
+			"identifier": map[string]string{"type": "dns", "value": ca.host},
+			"challenges": []map[string]string{{
+				"type": "http-01", "url": u + "/chal", "token": "token", "status": ca.authz,
+			}},
+		})
+	case "/chal":
+		// Validate the challenge right away.
+		rec := httptest.NewRecorder()
+		ca.solver.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+			"http://"+ca.host+"/.well-known/acme-challenge/token", nil))
+		if rec.Code == http.StatusOK && strings.HasPrefix(rec.Body.String(), "token.") {
+			ca.authz = "valid"
+		} else {
+			ca.authz = "invalid"
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"type": "http-01", "url": u + "/chal", "token": "token", "status": ca.authz,
+		})
+	case "/finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		leaf := issue(ca.t, csr.PublicKey, ca.key, ca.cert, csr.DNSNames...)
+		ca.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})...)
+		ca.issued++
+		w.Header().Set("Location", u+"/order/1")
+		json.NewEncoder(w).Encode(order("valid"))
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestManager(t *testing.T) {
+	ca := newFakeCA(t)
+	dir := t.TempDir()
+
+	m, err := certs.NewManager(ca.srv.URL+"/dir", "admin@example.org", dir,
+		[]string{"Example.org"})
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	ca.solver = m.HTTPHandler(nil)
+
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "evil.org"}); err == nil {
+		t.Fatalf("certificate of a disallowed host is obtained")
+	}
+
+	c, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	if err != nil {
+		t.Fatalf("cannot obtain certificate: %v", err)
+	}
+	if got := leafName(t, c); got != "example.org" {
+		t.Fatalf("obtained certificate of %s, want example.org", got)
+	}
+	if len(c.Certificate) != 2 {
+		t.Fatalf("certificate chain has %d certificates, want 2", len(c.Certificate))
+	}
+
+	// The certificate is served from memory.
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err != nil {
+		t.Fatalf("cannot get certificate: %v", err)
+	}
+	// The certificate is loaded from the cache after restart.
+	m, err = certs.NewManager(ca.srv.URL+"/dir", "", dir, []string{"example.org"})
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err != nil {
+		t.Fatalf("cannot get cached certificate: %v", err)
+	}
+	if ca.issued != 1 {
+		t.Fatalf("CA issued %d certificates, want 1", ca.issued)
+	}
+
+	// The challenge handler passes other requests to the fallback.
+	h := m.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/s/alias", nil))
+	if rec.Code != http.StatusTeapot {
+		t.Fatalf("request is not passed to the fallback: %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/acme-challenge/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown challenge responds %d, want 404", rec.Code)
+	}
+}
+
+func TestManagerBackoff(t *testing.T) {
+	ca := newFakeCA(t)
+	ca.reject = true
+
+	m, err := certs.NewManager(ca.srv.URL+"/dir", "", t.TempDir(), []string{"example.org"})
+	if err != nil {
+		t.Fatalf("cannot create manager: %v", err)
+	}
+	ca.solver = m.HTTPHandler(nil)
+
+	// A failed order is not retried by the following handshakes.
+	for i := 0; i < 3; i++ {
+		if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"}); err == nil {
+			t.Fatalf("certificate of a rejected order is obtained")
+		}
+	}
+	if ca.orders != 1 {
+		t.Fatalf("CA received %d orders, want 1", ca.orders)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package certs provides TLS certificates for the redir server, either
+// from certificate and key files that are reloaded when they change, or
+// obtained and renewed automatically from an ACME CA such as Let's
+// Encrypt.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reloader serves the certificate of a pair of certificate and key
+// files, and reloads the files when they change.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	mod  time.Time // the latest modification time of the loaded files
+}
+
+// NewReloader loads the given certificate and key files.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the loaded certificate, it can be used as the
+// GetCertificate of a tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload reloads the files if they are modified since the last load,
+// and reports whether the certificate is reloaded. The loaded
+// certificate is kept if the files are invalid, e.g. while they are
+// partially written.
+func (r *Reloader) Reload() (bool, error) {
+	mod, err := modTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	r.mu.RLock()
+	same := r.cert != nil && mod.Equal(r.mod)
+	r.mu.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert, r.mod = &cert, mod
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Watch reloads the files in the given interval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ok, err := r.Reload()
+		if err != nil {
+			slog.Error("cannot reload certificate", "cert", r.certFile, "err", err)
+			continue
+		}
+		if ok {
+			slog.Info("reloaded certificate", "cert", r.certFile)
+		}
+	}
+}
+
+// modTime returns the latest modification time of the given files.
+func modTime(files ...string) (t time.Time, err error) {
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t, nil
+}
@@ -7,9 +7,19 @@ package config
 import (
 	"bytes"
 	_ "embed"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"changkun.de/x/redir/internal/passwd"
 	"github.com/yuin/goldmark"
 	"github.com/yuin/goldmark/extension"
 	"github.com/yuin/goldmark/parser"
@@ -23,40 +33,183 @@ var (
 	None  authType = "none"
 	Basic authType = "basic"
 	SSO   authType = "sso"
+	OIDC  authType = "oidc"
 )
 
+// Role is the role of a user, which decides what the user can do.
+type Role string
+
+var (
+	// RoleViewer can view links and their statistics.
+	RoleViewer Role = "viewer"
+	// RoleEditor can additionally create and modify links.
+	RoleEditor Role = "editor"
+	// RoleAdmin can additionally administrate redir.
+	RoleAdmin Role = "admin"
+)
+
+// roleRanks orders the roles, a role includes the permissions of all
+// roles of a lower rank.
+var roleRanks = map[Role]int{RoleViewer: 1, RoleEditor: 2, RoleAdmin: 3}
+
+// Valid reports whether the role is known.
+func (r Role) Valid() bool {
+	_, ok := roleRanks[r]
+	return ok
+}
+
+// Allows reports whether the role includes the permissions of the given
+// role. Unknown roles allow nothing.
+func (r Role) Allows(o Role) bool {
+	return r.Valid() && roleRanks[r] >= roleRanks[o]
+}
+
+type ipMode string
+
+var (
+	// IPHMAC pseudonymizes IP addresses using a keyed hash whose key
+	// rotates daily.
+	IPHMAC ipMode = "hmac"
+	// IPTruncate pseudonymizes IP addresses by zeroing the host part.
+	IPTruncate ipMode = "truncate"
+)
+
+type uvMode string
+
+var (
+	// UVVisitor identifies unique visitors by the visitor cookie, or by
+	// IP address if the cookie is not set.
+	UVVisitor uvMode = "vid"
+	// UVIP identifies unique visitors by IP address.
+	UVIP uvMode = "ip"
+	// UVFingerprint identifies unique visitors by IP address and UA.
+	UVFingerprint uvMode = "fingerprint"
+)
+
+type dntMode string
+
+var (
+	// DNTRecord ignores Do Not Track and Global Privacy Control signals.
+	DNTRecord dntMode = "record"
+	// DNTAnonymous only counts a visit without any visitor information.
+	DNTAnonymous dntMode = "anonymous"
+	// DNTSkip records nothing.
+	DNTSkip dntMode = "skip"
+)
+
+// Account is a basic auth account. Its password is either a bcrypt hash,
+// or a deprecated plaintext password. Accounts without a role are
+// admins, and the groups share links among their members.
+type Account struct {
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password,omitempty" conf:"secret"`
+	PasswordHash string   `yaml:"password_hash,omitempty" conf:"secret"`
+	Role         Role     `yaml:"role,omitempty"`
+	Groups       []string `yaml:"groups,omitempty"`
+}
+
+// RoleMapping maps a value of the OIDC role claim to a role.
+type RoleMapping struct {
+	Value string `yaml:"value"`
+	Role  Role   `yaml:"role"`
+}
+
+// config is the configuration of redir. Fields tagged with
+// conf:"restart" cannot be changed by reloading the configuration, and
+// fields tagged with conf:"secret" are never printed.
 type config struct {
 	Title       string `yaml:"title"`
 	Host        string `yaml:"host"`
-	Addr        string `yaml:"addr"`
-	Development bool   `yaml:"development"`
-	Store       string `yaml:"store"`
+	Addr        string `yaml:"addr" conf:"restart"`
+	Development bool   `yaml:"development" conf:"restart"`
+	Store       string `yaml:"store" conf:"restart,secret"`
 	CORS        bool   `yaml:"cors"`
-	S           struct {
-		Prefix string `yaml:"prefix"`
+	Server      struct {
+		ReadTimeout       time.Duration `yaml:"read_timeout"`
+		ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+		WriteTimeout      time.Duration `yaml:"write_timeout"`
+		IdleTimeout       time.Duration `yaml:"idle_timeout"`
+		DrainDelay        time.Duration `yaml:"drain_delay"`
+		ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	} `yaml:"server" conf:"restart"`
+	TLS struct {
+		Enable       bool          `yaml:"enable"`
+		Addr         string        `yaml:"addr"`
+		CertFile     string        `yaml:"cert_file"`
+		KeyFile      string        `yaml:"key_file"`
+		RedirectHTTP bool          `yaml:"redirect_http"`
+		HSTSMaxAge   time.Duration `yaml:"hsts_max_age"`
+		ACME         struct {
+			Enable       bool     `yaml:"enable"`
+			DirectoryURL string   `yaml:"directory_url"`
+			Email        string   `yaml:"email"`
+			Hosts        []string `yaml:"hosts"`
+			CacheDir     string   `yaml:"cache_dir"`
+		} `yaml:"acme"`
+	} `yaml:"tls" conf:"restart"`
+	S struct {
+		Prefix string `yaml:"prefix" conf:"restart"`
 	} `yaml:"s"`
 	X struct {
-		Enable     bool   `yaml:"enable"`
-		Prefix     string `yaml:"prefix"`
+		Enable     bool   `yaml:"enable" conf:"restart"`
+		Prefix     string `yaml:"prefix" conf:"restart"`
 		VCS        string `yaml:"vcs"`
 		ImportPath string `yaml:"import_path"`
 		RepoPath   string `yaml:"repo_path"`
 		GoDocHost  string `yaml:"godoc_host"`
 	} `yaml:"x"`
 	Auth struct {
-		Enable authType `yaml:"enable"`
-		SSO    string   `yaml:"sso"`
-		Basic  []struct {
-			Username string `yaml:"username"`
-			Password string `yaml:"password"`
-		} `yaml:"basic"`
+		Enable          authType  `yaml:"enable"`
+		SSO             string    `yaml:"sso"`
+		RejectPlaintext bool      `yaml:"reject_plaintext"`
+		Basic           []Account `yaml:"basic"`
+		OIDC            struct {
+			Issuer        string        `yaml:"issuer"`
+			ClientID      string        `yaml:"client_id"`
+			ClientSecret  string        `yaml:"client_secret" conf:"secret"`
+			RedirectURL   string        `yaml:"redirect_url"`
+			Scopes        []string      `yaml:"scopes"`
+			UserClaim     string        `yaml:"user_claim"`
+			RoleClaim     string        `yaml:"role_claim"`
+			GroupClaim    string        `yaml:"group_claim"`
+			Roles         []RoleMapping `yaml:"roles"`
+			DefaultRole   Role          `yaml:"default_role"`
+			SessionSecret string        `yaml:"session_secret" conf:"secret"`
+			SessionTTL    time.Duration `yaml:"session_ttl"`
+		} `yaml:"oidc"`
 	} `yaml:"auth"`
 	Stats struct {
-		Enable bool `yaml:"enable"`
+		Enable    bool   `yaml:"enable" conf:"restart"`
+		UV        uvMode `yaml:"uv"`
+		UVApprox  int    `yaml:"uv_approx"`
+		GeoIPDB   string `yaml:"geoip_db" conf:"restart"`
+		Retention struct {
+			Days   int  `yaml:"days"`
+			Rollup bool `yaml:"rollup"`
+		} `yaml:"retention" conf:"restart"`
 	} `yaml:"stats"`
+	Log struct {
+		Level  string `yaml:"level"`
+		Format string `yaml:"format"`
+	} `yaml:"log"`
+	Tracing struct {
+		Enable      bool    `yaml:"enable"`
+		Endpoint    string  `yaml:"endpoint"`
+		ServiceName string  `yaml:"service_name"`
+		SampleRatio float64 `yaml:"sample_ratio"`
+	} `yaml:"tracing" conf:"restart"`
+	Metrics struct {
+		Enable bool   `yaml:"enable" conf:"restart"`
+		Path   string `yaml:"path" conf:"restart"`
+		Auth   bool   `yaml:"auth"`
+	} `yaml:"metrics"`
 	GDPR struct {
-		HideIP bool `yaml:"hide_ip"`
-		Owner  struct {
+		HideIP   bool    `yaml:"hide_ip"`
+		IPMode   ipMode  `yaml:"ip_mode"`
+		IPSecret string  `yaml:"ip_secret" conf:"secret"`
+		DNT      dntMode `yaml:"dnt"`
+		Consent  bool    `yaml:"consent"`
+		Owner    struct {
 			Name   string `yaml:"name"`
 			Domain string `yaml:"domain"`
 		} `yaml:"owner"`
@@ -78,38 +231,251 @@ type config struct {
 //go:embed config.yml
 var defaultConf []byte
 
-func (c *config) parse() {
-	f := os.Getenv("REDIR_CONF")
-	d, err := os.ReadFile(f)
-	if err != nil {
-		// Just try again with default setting.
-		d = defaultConf
-		if d == nil {
-			log.Fatalf("cannot read configuration: %v\n", err)
+// load loads the configuration file of REDIR_CONF, or the default
+// configuration if REDIR_CONF is not set.
+func load() (*config, error) {
+	d := defaultConf
+	if f := os.Getenv("REDIR_CONF"); f != "" {
+		var err error
+		d, err = os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read configuration: %w", err)
 		}
 	}
-	err = yaml.Unmarshal(d, c)
-	if err != nil {
-		log.Fatalf("cannot parse configuration: %v\n", err)
+	return parse(d)
+}
+
+// DefaultAccounts reports whether the basic auth accounts of the embedded
+// default configuration are in use, whose passwords are public. This is
+// the case if basic auth is enabled, and neither REDIR_CONF nor
+// REDIR_AUTH_BASIC configures the accounts.
+func DefaultAccounts() bool {
+	if os.Getenv("REDIR_CONF") != "" {
+		return false
+	}
+	for _, k := range []string{envPrefix + "AUTH_BASIC", envPrefix + "AUTH_BASIC" + fileSuffix} {
+		if _, ok := os.LookupEnv(k); ok {
+			return false
+		}
+	}
+	c := Get()
+	return c.Auth.Enable == Basic && len(c.Auth.Basic) > 0
+}
+
+// parse parses the given configuration, which must not contain unknown
+// settings, overrides it by environment variables and validates it.
+// The markdown contents are converted to HTML.
+func parse(d []byte) (*config, error) {
+	c := &config{}
+	dec := yaml.NewDecoder(bytes.NewReader(d))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot parse configuration: %w", err)
+	}
+	if err := overrideEnv(reflect.ValueOf(c).Elem(), envPrefix); err != nil {
+		return nil, fmt.Errorf("cannot override configuration: %w", err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
 	var buf bytes.Buffer
-	if err := md.Convert([]byte(Conf.GDPR.Impressum.Content), &buf); err != nil {
-		log.Fatalf("cannot parse impressum markdown content: %v\n", err)
+	if err := md.Convert([]byte(c.GDPR.Impressum.Content), &buf); err != nil {
+		return nil, fmt.Errorf("cannot parse impressum markdown content: %w", err)
 	}
-	Conf.GDPR.Impressum.Content = buf.String()
+	c.GDPR.Impressum.Content = buf.String()
 	buf.Reset()
 
-	if err := md.Convert([]byte(Conf.GDPR.Privacy.Content), &buf); err != nil {
-		log.Fatalf("cannot parse privacy markdown content: %v\n", err)
+	if err := md.Convert([]byte(c.GDPR.Privacy.Content), &buf); err != nil {
+		return nil, fmt.Errorf("cannot parse privacy markdown content: %w", err)
+	}
+	c.GDPR.Privacy.Content = buf.String()
+	return c, nil
+}
+
+// validate reports the first invalid setting of the configuration.
+func (c *config) validate() error {
+	if c.Addr == "" {
+		return errors.New("addr is empty")
+	}
+	if c.Store == "" {
+		return errors.New("store is empty")
+	}
+	if !validPrefix(c.S.Prefix) {
+		return fmt.Errorf("s.prefix %q must start and end with /", c.S.Prefix)
+	}
+	if c.X.Enable && !validPrefix(c.X.Prefix) {
+		return fmt.Errorf("x.prefix %q must start and end with /", c.X.Prefix)
+	}
+
+	switch c.Auth.Enable {
+	case "", None, Basic:
+	case SSO:
+		if _, err := url.Parse(c.Auth.SSO); err != nil || c.Auth.SSO == "" {
+			return fmt.Errorf("auth.sso %q is not a valid URL", c.Auth.SSO)
+		}
+	case OIDC:
+		if err := c.validateOIDC(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown auth.enable %q", c.Auth.Enable)
+	}
+	for i, a := range c.Auth.Basic {
+		if a.Username == "" {
+			return fmt.Errorf("auth.basic[%d] has no username", i)
+		}
+		switch {
+		case (a.Password == "") == (a.PasswordHash == ""):
+			return fmt.Errorf("auth.basic[%d] needs either password or password_hash", i)
+		case a.PasswordHash != "":
+			if err := passwd.Validate(a.PasswordHash); err != nil {
+				return fmt.Errorf("auth.basic[%d]: %w", i, err)
+			}
+		case c.Auth.RejectPlaintext:
+			return fmt.Errorf("auth.basic[%d] has a plaintext password", i)
+		}
+		if a.Role != "" && !a.Role.Valid() {
+			return fmt.Errorf("auth.basic[%d] has unknown role %q", i, a.Role)
+		}
+	}
+
+	switch c.Stats.UV {
+	case "", UVVisitor, UVIP, UVFingerprint:
+	default:
+		return fmt.Errorf("unknown stats.uv %q", c.Stats.UV)
+	}
+	switch c.GDPR.IPMode {
+	case "", IPHMAC, IPTruncate:
+	default:
+		return fmt.Errorf("unknown gdpr.ip_mode %q", c.GDPR.IPMode)
+	}
+	switch c.GDPR.DNT {
+	case "", DNTRecord, DNTAnonymous, DNTSkip:
+	default:
+		return fmt.Errorf("unknown gdpr.dnt %q", c.GDPR.DNT)
+	}
+
+	if c.Log.Level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(c.Log.Level)); err != nil {
+			return fmt.Errorf("invalid log.level %q", c.Log.Level)
+		}
 	}
-	Conf.GDPR.Privacy.Content = buf.String()
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("unknown log.format %q", c.Log.Format)
+	}
+	if r := c.Tracing.SampleRatio; r < 0 || r > 1 {
+		return fmt.Errorf("tracing.sample_ratio %v is not within [0, 1]", r)
+	}
+	if c.Metrics.Enable && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("metrics.path %q must start with /", c.Metrics.Path)
+	}
+
+	for _, d := range []time.Duration{
+		c.Server.ReadTimeout, c.Server.ReadHeaderTimeout, c.Server.WriteTimeout,
+		c.Server.IdleTimeout, c.Server.DrainDelay, c.Server.ShutdownTimeout,
+		c.TLS.HSTSMaxAge,
+	} {
+		if d < 0 {
+			return fmt.Errorf("negative duration %v", d)
+		}
+	}
+	if c.TLS.Enable {
+		if c.TLS.Addr == "" {
+			return errors.New("tls.addr is empty")
+		}
+		if c.TLS.ACME.Enable {
+			if len(c.TLS.ACME.Hosts) == 0 {
+				return errors.New("tls.acme.hosts is empty")
+			}
+		} else if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return errors.New("tls.cert_file and tls.key_file are required without ACME")
+		}
+	}
+	return nil
 }
 
-var Conf config
+// validateOIDC reports the first invalid setting of auth.oidc.
+func (c *config) validateOIDC() error {
+	o := &c.Auth.OIDC
+	for name, v := range map[string]string{
+		"issuer":       o.Issuer,
+		"redirect_url": o.RedirectURL,
+	} {
+		if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("auth.oidc.%s %q is not a valid URL", name, v)
+		}
+	}
+	if o.ClientID == "" {
+		return errors.New("auth.oidc.client_id is empty")
+	}
+	for i, m := range o.Roles {
+		if !m.Role.Valid() {
+			return fmt.Errorf("auth.oidc.roles[%d] has unknown role %q", i, m.Role)
+		}
+	}
+	if o.DefaultRole != "" && !o.DefaultRole.Valid() {
+		return fmt.Errorf("unknown auth.oidc.default_role %q", o.DefaultRole)
+	}
+	if len(o.Roles) > 0 && o.RoleClaim == "" {
+		return errors.New("auth.oidc.role_claim is empty")
+	}
+	if o.SessionTTL < 0 {
+		return fmt.Errorf("negative auth.oidc.session_ttl %v", o.SessionTTL)
+	}
+	return nil
+}
+
+func validPrefix(p string) bool {
+	return strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/")
+}
+
+// current is the current configuration snapshot.
+var current atomic.Pointer[config]
+
+// Get returns the current configuration. The configuration is replaced
+// as a whole when it is reloaded, hence the returned snapshot is never
+// modified, and must not be modified by the caller. Callers that read
+// related fields should read them from the same snapshot.
+func Get() *config {
+	return current.Load()
+}
+
+// WriteRedacted writes the current configuration as YAML to w, secrets
+// are redacted.
+func WriteRedacted(w io.Writer) error {
+	// Copy the configuration by a round trip, so that the current one
+	// is not modified.
+	b, err := yaml.Marshal(Get())
+	if err != nil {
+		return err
+	}
+	c := &config{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return err
+	}
+	redact(reflect.ValueOf(c).Elem(), false)
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
 
 func init() {
-	Conf.parse()
+	if fi, err := os.Stat(os.Getenv("REDIR_CONF")); err == nil {
+		modTime = fi.ModTime()
+	}
+	c, err := load()
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	current.Store(c)
 }
 
 var md = goldmark.New(
@@ -5,15 +5,23 @@
 package config
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseConfig(t *testing.T) {
-	Conf.parse()
+	c, err := load()
+	if err != nil {
+		t.Fatalf("cannot load configuration: %v", err)
+	}
 
 	// Test if all fields are filled.
-	v := reflect.ValueOf(Conf)
+	v := reflect.ValueOf(*c)
 	for i := 0; i < v.NumField(); i++ {
 		if v.Field(i).Kind() == reflect.Struct {
 			continue
@@ -24,3 +32,171 @@ func TestParseConfig(t *testing.T) {
 		t.Fatalf("read empty from config, field: %v", v.Type().Field(i).Name)
 	}
 }
+
+func TestParseDeployConfig(t *testing.T) {
+	t.Setenv("REDIR_CONF", "../../data/redirconf.yml")
+	if _, err := load(); err != nil {
+		t.Fatalf("cannot load deploy configuration: %v", err)
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	t.Setenv("REDIR_CONF", filepath.Join(t.TempDir(), "missing.yml"))
+	if _, err := load(); err == nil {
+		t.Fatalf("missing configuration falls back to the default")
+	}
+}
+
+func TestParseUnknownField(t *testing.T) {
+	d := strings.Replace(string(defaultConf), "cors: false", "cros: false", 1)
+	if _, err := parse([]byte(d)); err == nil {
+		t.Fatalf("unknown field is accepted")
+	}
+}
+
+func TestOverrideEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("s3cret\n"), 0600)
+
+	t.Setenv("REDIR_ADDR", ":8080")
+	t.Setenv("REDIR_CORS", "true")
+	t.Setenv("REDIR_SERVER_READ_TIMEOUT", "3s")
+	t.Setenv("REDIR_TLS_ACME_HOSTS", "a.example.org, b.example.org")
+	t.Setenv("REDIR_AUTH_BASIC", "[{username: admin, password: admin}]")
+	t.Setenv("REDIR_GDPR_IP_SECRET_FILE", secret)
+	c, err := parse(defaultConf)
+	if err != nil {
+		t.Fatalf("cannot parse configuration: %v", err)
+	}
+	if c.Addr != ":8080" || !c.CORS || c.Server.ReadTimeout != 3*time.Second {
+		t.Fatalf("settings are not overridden: %v, %v, %v", c.Addr, c.CORS, c.Server.ReadTimeout)
+	}
+	if !reflect.DeepEqual(c.TLS.ACME.Hosts, []string{"a.example.org", "b.example.org"}) {
+		t.Fatalf("list is not overridden: %v", c.TLS.ACME.Hosts)
+	}
+	if len(c.Auth.Basic) != 1 || c.Auth.Basic[0].Username != "admin" {
+		t.Fatalf("accounts are not overridden: %v", c.Auth.Basic)
+	}
+	if c.GDPR.IPSecret != "s3cret" {
+		t.Fatalf("secret is not read from file: %q", c.GDPR.IPSecret)
+	}
+
+	t.Setenv("REDIR_CORS", "maybe")
+	if _, err := parse(defaultConf); err == nil {
+		t.Fatalf("invalid override is accepted")
+	}
+	t.Setenv("REDIR_CORS", "false")
+	t.Setenv("REDIR_STORE_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := parse(defaultConf); err == nil {
+		t.Fatalf("missing secret file is accepted")
+	}
+}
+
+func TestWriteRedacted(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRedacted(&buf); err != nil {
+		t.Fatalf("cannot write configuration: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, "$2a$") || !strings.Contains(out, "password_hash: REDACTED") {
+		t.Fatalf("password is not redacted:\n%s", out)
+	}
+	if !strings.Contains(out, "read_timeout: 10s") {
+		t.Fatalf("durations are not readable:\n%s", out)
+	}
+	if Get().Auth.Basic[0].PasswordHash == redacted {
+		t.Fatalf("current configuration is redacted")
+	}
+}
+
+func TestParseAccounts(t *testing.T) {
+	const hash = "password_hash: $2a$10$qrctsmd9o2XYRipgsJYgjOLwtKbiuKPCN9idRmY1agpNwSsJwmK7y # redir"
+	for _, tt := range []struct {
+		name  string
+		old   []string
+		valid bool
+	}{
+		{"hash", nil, true},
+		{"plaintext", []string{hash, "password: redir"}, true},
+		{"rejected plaintext", []string{hash, "password: redir", "reject_plaintext: false", "reject_plaintext: true"}, false},
+		{"invalid hash", []string{hash, "password_hash: redir"}, false},
+		{"no password", []string{hash, ""}, false},
+		{"both", []string{hash, hash + "\n      password: redir"}, false},
+		{"default role", []string{"role: admin\n      groups", "groups"}, true},
+		{"unknown role", []string{"role: admin\n      groups", "role: root\n      groups"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := strings.NewReplacer(tt.old...).Replace(string(defaultConf))
+			if _, err := parse([]byte(d)); (err == nil) != tt.valid {
+				t.Fatalf("want valid %v, got err %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestParseOIDC(t *testing.T) {
+	const enable = "enable: basic # or sso, oidc, none"
+	for _, tt := range []struct {
+		name  string
+		old   []string
+		valid bool
+	}{
+		{"oidc", []string{enable, "enable: oidc"}, true},
+		{"no issuer", []string{enable, "enable: oidc", "issuer: https://accounts.example.com", "issuer: \"\""}, false},
+		{"no client", []string{enable, "enable: oidc", "client_id: redir", "client_id: \"\""}, false},
+		{"unknown role", []string{enable, "enable: oidc", "role: editor", "role: owner"}, false},
+		{"unknown default role", []string{enable, "enable: oidc", "default_role: viewer", "default_role: guest"}, false},
+		{"ignored unless enabled", []string{"role: editor", "role: owner"}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := strings.NewReplacer(tt.old...).Replace(string(defaultConf))
+			if _, err := parse([]byte(d)); (err == nil) != tt.valid {
+				t.Fatalf("want valid %v, got err %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	for _, tt := range []struct {
+		r, o Role
+		want bool
+	}{
+		{RoleAdmin, RoleEditor, true},
+		{RoleEditor, RoleEditor, true},
+		{RoleEditor, RoleAdmin, false},
+		{RoleViewer, RoleEditor, false},
+		{"root", RoleViewer, false},
+		{"", RoleViewer, false},
+	} {
+		if got := tt.r.Allows(tt.o); got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.r, tt.o, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultAccounts(t *testing.T) {
+	t.Cleanup(func() { Reload() })
+
+	t.Setenv("REDIR_CONF", "")
+	if _, err := Reload(); err != nil {
+		t.Fatalf("cannot reload configuration: %v", err)
+	}
+	if !DefaultAccounts() {
+		t.Fatalf("default accounts are not detected")
+	}
+
+	t.Setenv("REDIR_AUTH_BASIC", "[{username: admin, password_hash: x}]")
+	if DefaultAccounts() {
+		t.Fatalf("overridden accounts are detected as default")
+	}
+	os.Unsetenv("REDIR_AUTH_BASIC")
+
+	t.Setenv("REDIR_AUTH_ENABLE", "none")
+	if _, err := Reload(); err != nil {
+		t.Fatalf("cannot reload configuration: %v", err)
+	}
+	if DefaultAccounts() {
+		t.Fatalf("default accounts are detected without basic auth")
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is the prefix of the environment variables that override
+// settings. The variable of a setting is its upper-cased YAML path
+// joined by underscores, e.g. REDIR_AUTH_ENABLE for auth.enable.
+const envPrefix = "REDIR_"
+
+// fileSuffix is the suffix of the environment variables that name a
+// file to read the setting from, e.g. REDIR_GDPR_IP_SECRET_FILE, which
+// keeps secrets out of the environment.
+const fileSuffix = "_FILE"
+
+// overrideEnv overrides the settings of v by environment variables.
+// Strings are taken as is, lists of strings are either comma separated
+// or YAML flow sequences, and other settings are parsed as YAML, e.g.
+// REDIR_AUTH_BASIC='[{username: a, password: b}]'.
+func overrideEnv(v reflect.Value, prefix string) error {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		key := prefix + strings.ToUpper(yamlName(f))
+		fv := v.Field(i)
+		if f.Type.Kind() == reflect.Struct {
+			if err := overrideEnv(fv, key+"_"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		s, ok, err := lookupEnv(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		switch {
+		case fv.Kind() == reflect.String:
+			fv.SetString(s)
+		case fv.Kind() == reflect.Slice && f.Type.Elem().Kind() == reflect.String &&
+			!strings.HasPrefix(strings.TrimSpace(s), "["):
+			ss := []string{}
+			for _, e := range strings.Split(s, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					ss = append(ss, e)
+				}
+			}
+			fv.Set(reflect.ValueOf(ss))
+		default:
+			if err := yaml.Unmarshal([]byte(s), fv.Addr().Interface()); err != nil {
+				return fmt.Errorf("invalid %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// lookupEnv returns the value of the given variable, or the content of
+// the file that the variable with the file suffix names.
+func lookupEnv(key string) (string, bool, error) {
+	if s, ok := os.LookupEnv(key); ok {
+		return s, true, nil
+	}
+	f, ok := os.LookupEnv(key + fileSuffix)
+	if !ok {
+		return "", false, nil
+	}
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return "", false, fmt.Errorf("cannot read %s: %w", key+fileSuffix, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), true, nil
+}
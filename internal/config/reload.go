@@ -0,0 +1,192 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Change is a changed setting of a reloaded configuration.
+type Change struct {
+	// Field is the YAML path of the setting, e.g. auth.basic.
+	Field string
+	// Old and New are the values of the setting, secrets are redacted.
+	Old, New string
+	// Restart reports whether the setting requires a restart. Such
+	// changes are not applied and the setting keeps the old value.
+	Restart bool
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+var (
+	reloadMu sync.Mutex // serializes reloads
+	modTime  time.Time  // modification time of the loaded file
+)
+
+// Reload reloads the configuration file of REDIR_CONF and swaps the
+// current configuration if the file is valid. Otherwise, the current
+// configuration is kept and an error is returned. It returns the
+// changed settings.
+func Reload() ([]Change, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if fi, err := os.Stat(os.Getenv("REDIR_CONF")); err == nil {
+		modTime = fi.ModTime()
+	}
+	c, err := load()
+	if err != nil {
+		return nil, err
+	}
+	changes := diff("", reflect.ValueOf(Get()).Elem(), reflect.ValueOf(c).Elem(), false, false)
+	current.Store(c)
+	return changes, nil
+}
+
+// Watch reloads the configuration file of REDIR_CONF whenever it is
+// modified, and calls fn with the result of every reload. The file is
+// checked in the given interval until ctx is done.
+func Watch(ctx context.Context, interval time.Duration, fn func([]Change, error)) {
+	f := os.Getenv("REDIR_CONF")
+	if f == "" {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		reloadMu.Lock()
+		same := fi.ModTime().Equal(modTime)
+		reloadMu.Unlock()
+		if !same {
+			fn(Reload())
+		}
+	}
+}
+
+// diff returns the changes from old to new. The settings that require
+// a restart are reset to the old values in new, so that the running
+// server keeps seeing the settings it was started with.
+func diff(prefix string, old, new reflect.Value, restart, secret bool) []Change {
+	var changes []Change
+	for i := 0; i < old.NumField(); i++ {
+		f := old.Type().Field(i)
+		name := prefix + yamlName(f)
+		r := restart || hasTag(f, "restart")
+		s := secret || hasTag(f, "secret")
+
+		o, n := old.Field(i), new.Field(i)
+		if f.Type.Kind() == reflect.Struct {
+			changes = append(changes, diff(name+".", o, n, r, s)...)
+			continue
+		}
+		if reflect.DeepEqual(o.Interface(), n.Interface()) {
+			continue
+		}
+		changes = append(changes, Change{
+			Field:   name,
+			Old:     format(o, s),
+			New:     format(n, s),
+			Restart: r,
+		})
+		if r {
+			n.Set(o)
+		}
+	}
+	return changes
+}
+
+// redacted replaces secrets in logs and outputs.
+const redacted = "REDACTED"
+
+// maxValueLen is the maximum length of a formatted value, longer values
+// such as the GDPR texts are truncated.
+const maxValueLen = 64
+
+// format formats a setting for logging, secrets are redacted.
+func format(v reflect.Value, secret bool) string {
+	if secret {
+		if v.IsZero() {
+			return `""`
+		}
+		return redacted
+	}
+
+	var s string
+	switch v.Kind() {
+	case reflect.Slice:
+		elems := make([]string, v.Len())
+		for i := range elems {
+			elems[i] = format(v.Index(i), false)
+		}
+		s = "[" + strings.Join(elems, " ") + "]"
+	case reflect.Struct:
+		fields := make([]string, v.NumField())
+		for i := range fields {
+			f := v.Type().Field(i)
+			fields[i] = yamlName(f) + ":" + format(v.Field(i), hasTag(f, "secret"))
+		}
+		s = "{" + strings.Join(fields, " ") + "}"
+	case reflect.String:
+		s = fmt.Sprintf("%q", v.String())
+	default:
+		s = fmt.Sprint(v.Interface())
+	}
+	if r := []rune(s); len(r) > maxValueLen {
+		s = string(r[:maxValueLen]) + "..."
+	}
+	return s
+}
+
+// redact replaces the non-empty secrets of v.
+func redact(v reflect.Value, secret bool) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			redact(v.Field(i), secret || hasTag(v.Type().Field(i), "secret"))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redact(v.Index(i), secret)
+		}
+	case reflect.String:
+		if secret && v.Len() > 0 {
+			v.SetString(redacted)
+		}
+	}
+}
+
+// yamlName returns the YAML key of the given field.
+func yamlName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("yaml"), ",")[0]
+}
+
+// hasTag reports whether the conf tag of the given field contains tag.
+func hasTag(f reflect.StructField, tag string) bool {
+	for _, t := range strings.Split(f.Tag.Get("conf"), ",") {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConf writes the default configuration with the given
+// replacements to f.
+func writeConf(t *testing.T, f string, oldnew ...string) {
+	t.Helper()
+	d := strings.NewReplacer(oldnew...).Replace(string(defaultConf))
+	if err := os.WriteFile(f, []byte(d), 0600); err != nil {
+		t.Fatalf("cannot write configuration: %v", err)
+	}
+}
+
+func setupReload(t *testing.T) string {
+	f := filepath.Join(t.TempDir(), "redir.yml")
+	writeConf(t, f)
+	t.Setenv("REDIR_CONF", f)
+	old := Get()
+	t.Cleanup(func() { current.Store(old) })
+	if _, err := Reload(); err != nil {
+		t.Fatalf("cannot load configuration: %v", err)
+	}
+	return f
+}
+
+func TestReload(t *testing.T) {
+	f := setupReload(t)
+	old := Get()
+
+	writeConf(t, f,
+		"cors: false", "cors: true",
+		"addr: :9123", "addr: :9124",
+		"password_hash: $2a$10$qrctsmd9o2XYRipgsJYgjOLwtKbiuKPCN9idRmY1agpNwSsJwmK7y", "password: secret")
+	changes, err := Reload()
+	if err != nil {
+		t.Fatalf("cannot reload configuration: %v", err)
+	}
+
+	got := map[string]Change{}
+	for _, c := range changes {
+		got[c.Field] = c
+	}
+	if len(got) != 3 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+	if c := got["cors"]; c.Old != "false" || c.New != "true" || c.Restart {
+		t.Fatalf("unexpected cors change: %+v", c)
+	}
+	if c := got["addr"]; !c.Restart {
+		t.Fatalf("addr change does not require restart: %+v", c)
+	}
+	c := got["auth.basic"]
+	if strings.Contains(c.Old+c.New, "$2a$") || strings.Contains(c.Old+c.New, "secret") {
+		t.Fatalf("password is not redacted: %+v", c)
+	}
+	if !strings.Contains(c.New, `"changkun"`) {
+		t.Fatalf("username is missing: %+v", c)
+	}
+
+	conf := Get()
+	if conf == old {
+		t.Fatalf("configuration is not swapped")
+	}
+	if !conf.CORS || conf.Auth.Basic[0].Password != "secret" {
+		t.Fatalf("changes are not applied: %+v", conf)
+	}
+	if conf.Addr != old.Addr {
+		t.Fatalf("addr is changed without restart: %v", conf.Addr)
+	}
+	if old.CORS || old.Auth.Basic[0].Password != "" {
+		t.Fatalf("old configuration is modified: %+v", old)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	f := setupReload(t)
+	old := Get()
+
+	for _, oldnew := range [][]string{
+		{"cors: false", "cors: [false"},
+		{"enable: basic # or sso, oidc, none", "enable: ldap"},
+		{`prefix: /s/`, `prefix: /s`},
+	} {
+		writeConf(t, f, oldnew...)
+		if _, err := Reload(); err == nil {
+			t.Fatalf("invalid configuration %v is reloaded", oldnew)
+		}
+		if Get() != old {
+			t.Fatalf("invalid configuration %v is swapped", oldnew)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f := setupReload(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := make(chan []Change, 1)
+	go Watch(ctx, 10*time.Millisecond, func(changes []Change, err error) {
+		if err != nil {
+			t.Errorf("cannot reload configuration: %v", err)
+		}
+		reloaded <- changes
+	})
+
+	writeConf(t, f, "title: ", "title: new ")
+	mod := time.Now().Add(time.Minute)
+	os.Chtimes(f, mod, mod)
+	select {
+	case changes := <-reloaded:
+		if len(changes) != 1 || changes[0].Field != "title" {
+			t.Fatalf("unexpected changes: %v", changes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("modified configuration is not reloaded")
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 	"time"
 
+	"changkun.de/x/redir/internal/config"
 	"changkun.de/x/redir/internal/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -32,6 +34,8 @@ func (db *Store) StoreAlias(ctx context.Context, r *models.Redir) (err error) {
 		"private":    r.Private,
 		"trust":      r.Trust,
 		"valid_from": r.ValidFrom,
+		"owner":      r.Owner,
+		"group":      r.Group,
 		"created_by": r.CreatedBy,
 		"updated_by": r.UpdatedBy,
 		"created_at": now,
@@ -68,6 +72,8 @@ func (db *Store) UpdateAlias(ctx context.Context, r *models.Redir) error {
 			"private":    r.Private,
 			"trust":      r.Trust,
 			"valid_from": r.ValidFrom,
+			"owner":      r.Owner,
+			"group":      r.Group,
 			"updated_by": r.UpdatedBy,
 			"updated_at": time.Now(),
 		}},
@@ -104,21 +110,29 @@ func (db *Store) FetchAlias(ctx context.Context, a string) (*models.Redir, error
 }
 
 // FetchAliasAll reads all aliases by given page size and page number.
+// If the owner is not empty, only the aliases of the owner are read,
+// which is ignored for the public index. The PVs and UVs of the aliases
+// only count the visits of the given traffic. The UVs of the aliases are
+// counted exactly unless the visits may span more than stats.uv_approx
+// days, i.e. the retention is disabled or longer, where they are
+// estimated, see uvSketch.
 func (db *Store) FetchAliasAll(
 	ctx context.Context,
 	public bool,
+	owner string,
+	traffic Traffic,
 	pageSize, pageNum int64,
 ) ([]models.RedirIndex, int64, error) {
 	col := db.cli.Database(dbname).Collection(collink)
 
 	// public UI does not offer any statistic informations:
-	// no PV/UV, no actual URLs.
+	// no PV/UV, no actual URLs, no owners.
 	if public {
 		filter := bson.M{"private": false}
 		cur, err := col.Find(ctx, filter, []*options.FindOptions{
 			options.Find().SetLimit(pageSize),
 			options.Find().SetSkip((pageNum - 1) * pageSize),
-			options.Find().SetProjection(bson.M{"url": 0})}...)
+			options.Find().SetProjection(bson.M{"url": 0, "owner": 0, "group": 0})}...)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -137,7 +151,11 @@ func (db *Store) FetchAliasAll(
 
 	// Non-public mode queries PV/UV as additional information,
 	// and paginates on this. Let's first find the aliases.
-	n, err := col.CountDocuments(ctx, bson.M{})
+	filter := bson.M{}
+	if owner != "" {
+		filter = ownerFilter(owner)
+	}
+	n, err := col.CountDocuments(ctx, filter)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -146,38 +164,15 @@ func (db *Store) FetchAliasAll(
 	// 	{$skip:  20},
 	// 	{$limit: 10},
 	// 	{'$lookup': {from: 'visit', localField: 'alias', foreignField: 'alias', as: 'visit'}},
+	// 	{$addFields: {visit: {$filter: {input: '$visit', as: 'visit', cond: {$ne: ['$$visit.bot', true]}}}}},
 	// 	{'$unwind': {path: '$visit', preserveNullAndEmptyArrays: true}},
-	// 	{
-	// 		$group: {
-	// 			_id: {alias: '$alias', ip: '$visit.ip'},
-	// 			url: {$first: '$url'},
-	// 			private: {$first: '$private'},
-	// 			trust: {$first: '$trust'},
-	// 			valid_from: {$first: '$valid_from'},
-	// 			created_by: {$first: '$created_by'},
-	// 			updated_by: {$first: '$updated_by'},
-	// 			updated_at: {$first: '$updated_at'},
-	// 			count: {$sum: 1},
-	// 		},
-	// 	},
-	// 	{$group: {
-	// 		_id: '$_id.alias',
-	// 		alias: {$first: '$_id.alias'},
-	// 		url: {$first: '$url'},
-	// 		private: {$first: '$private'},
-	// 		trust: {$first: '$trust'},
-	// 		valid_from: {$first: '$valid_from'},
-	// 		created_by: {$first: '$created_by'},
-	// 		updated_by: {$first: '$updated_by'},
-	// 		updated_at: {$first: '$updated_at'},
-	// 		uv: {$sum: 1},
-	// 		pv: {$sum: '$count'},
-	// 	}},
+	// 	... the PV and the UV of each alias, see uvUsers and uvSketch.
 	// 	{$sort : {updated_at: -1}},
-	// 	{$sort : {pv: -1}},
-	// 	{$sort : {uv: -1}},
 	// ])
-	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+	pipeline := mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: filter},
+		},
 		bson.D{
 			primitive.E{Key: "$skip", Value: (pageNum - 1) * pageSize},
 		},
@@ -192,40 +187,39 @@ func (db *Store) FetchAliasAll(
 				"as":           "visit",
 			}},
 		},
+	}
+	if cond := traffic.cond("$$visit."); cond != nil {
+		pipeline = append(pipeline, bson.D{
+			primitive.E{Key: "$addFields", Value: bson.M{
+				"visit": bson.M{"$filter": bson.M{
+					"input": "$visit",
+					"as":    "visit",
+					"cond":  cond,
+				}},
+			}},
+		})
+	}
+	pipeline = append(pipeline,
 		bson.D{
 			primitive.E{Key: "$unwind", Value: bson.M{
 				"path":                       "$visit",
 				"preserveNullAndEmptyArrays": true,
 			}},
 		},
-		bson.D{
-			primitive.E{Key: "$group", Value: bson.M{
-				"_id":        bson.M{"alias": "$alias", "ip": "$visit.ip"},
-				"url":        bson.M{"$first": "$url"},
-				"private":    bson.M{"$first": "$private"},
-				"trust":      bson.M{"$first": "$trust"},
-				"valid_from": bson.M{"$first": "$valid_from"},
-				"created_by": bson.M{"$first": "$created_by"},
-				"updated_by": bson.M{"$first": "$updated_by"},
-				"updated_at": bson.M{"$first": "$updated_at"},
-				"count":      bson.M{"$sum": 1},
-			}},
-		},
-		bson.D{
-			primitive.E{Key: "$group", Value: bson.M{
-				"_id":        "$_id.alias",
-				"alias":      bson.M{"$first": "$_id.alias"},
-				"url":        bson.M{"$first": "$url"},
-				"private":    bson.M{"$first": "$private"},
-				"trust":      bson.M{"$first": "$trust"},
-				"valid_from": bson.M{"$first": "$valid_from"},
-				"created_by": bson.M{"$first": "$created_by"},
-				"updated_by": bson.M{"$first": "$updated_by"},
-				"updated_at": bson.M{"$first": "$updated_at"},
-				"uv":         bson.M{"$sum": 1},
-				"pv":         bson.M{"$sum": "$count"},
-			}},
-		},
+	)
+	window := time.Duration(math.MaxInt64)
+	if days := config.Get().Stats.Retention.Days; days > 0 {
+		window = time.Duration(days) * 24 * time.Hour
+	}
+	exact := uvExact(window)
+	fields := []string{"alias", "url", "private", "trust", "valid_from",
+		"owner", "group", "created_by", "updated_by", "updated_at"}
+	if exact {
+		pipeline = append(pipeline, uvUsers("$alias", "$visit.", fields...)...)
+	} else {
+		pipeline = append(pipeline, uvSketch("$alias", "$visit.", fields...)...)
+	}
+	pipeline = append(pipeline,
 		// After the aggregation, the result is not stable.
 		// We still need sort the result a little bit to get more
 		// stable result. We can either sort by the PV/UV or the date.
@@ -238,7 +232,8 @@ func (db *Store) FetchAliasAll(
 		bson.D{
 			primitive.E{Key: "$sort", Value: bson.M{"updated_at": -1}},
 		},
-	}, &options.AggregateOptions{
+	)
+	cur, err := col.Aggregate(ctx, pipeline, &options.AggregateOptions{
 		// Sort by natural order.
 		Hint: bson.D{
 			primitive.E{Key: "$natural", Value: -1},
@@ -249,10 +244,30 @@ func (db *Store) FetchAliasAll(
 	}
 	defer cur.Close(ctx)
 
-	var rs []models.RedirIndex
-	if err := cur.All(ctx, &rs); err != nil {
+	var records []struct {
+		models.RedirIndex `bson:",inline"`
+		Regs              int     `bson:"regs"`
+		Sum               float64 `bson:"sum"`
+	}
+	if err := cur.All(ctx, &records); err != nil {
 		return nil, 0, err
 	}
 
+	rs := make([]models.RedirIndex, 0, len(records))
+	for _, r := range records {
+		if !exact {
+			r.UV = uvEstimate(r.Regs, r.Sum)
+		}
+		rs = append(rs, r.RedirIndex)
+	}
 	return rs, n, nil
 }
+
+// ownerFilter matches the aliases of the given owner, including the
+// aliases that the owner created before owners existed.
+func ownerFilter(owner string) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"owner": owner},
+		bson.M{"owner": bson.M{"$in": bson.A{nil, ""}}, "created_by": owner},
+	}}
+}
@@ -81,7 +81,7 @@ func TestFetchAliasAll(t *testing.T) {
 	if err != nil {
 		t.Skip("cannot connect to data store")
 	}
-	rs, total, err := s.FetchAliasAll(ctx, true, 20, 1)
+	rs, total, err := s.FetchAliasAll(ctx, true, "", db.TrafficAll, 20, 1)
 	if err != nil || len(rs) == 0 || total == 0 {
 		t.Fatalf("fetch failed: %v, %v, %v", err, rs, total)
 	}
@@ -96,6 +96,32 @@ func TestFetchAliasAll(t *testing.T) {
 	t.Log(string(b))
 }
 
+func TestFetchAliasAllOwner(t *testing.T) {
+	ctx := context.Background()
+	s := prepare(ctx, t)
+
+	// A legacy alias without owner belongs to its creator.
+	for _, r := range []*models.Redir{
+		{Alias: "alias-owned", URL: "link", Owner: "alice", CreatedBy: "bob"},
+		{Alias: "alias-legacy", URL: "link", CreatedBy: "alice"},
+	} {
+		if err := s.StoreAlias(ctx, r); err != nil {
+			t.Fatalf("cannot store alias to data store: %v", err)
+		}
+		a := r.Alias
+		t.Cleanup(func() { s.DeleteAlias(ctx, a) })
+	}
+
+	rs, total, err := s.FetchAliasAll(ctx, false, "alice", db.TrafficAll, 20, 1)
+	if err != nil || total != 2 || len(rs) != 2 {
+		t.Fatalf("fetch failed: %v, %v, %v", err, rs, total)
+	}
+	rs, total, err = s.FetchAliasAll(ctx, false, "bob", db.TrafficAll, 20, 1)
+	if err != nil || total != 0 || len(rs) != 0 {
+		t.Fatalf("fetch failed: %v, %v, %v", err, rs, total)
+	}
+}
+
 func BenchmarkFetchAliasAll(b *testing.B) {
 	ctx := context.Background()
 	s, err := db.NewStore(ctx, "mongodb://0.0.0.0:27018")
@@ -106,7 +132,7 @@ func BenchmarkFetchAliasAll(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		rs, total, err := s.FetchAliasAll(ctx, false, 100, 1)
+		rs, total, err := s.FetchAliasAll(ctx, false, "", db.TrafficHuman, 100, 1)
 		if err != nil || len(rs) == 0 || total == 0 {
 			b.Fatalf("fetch failed: %v, %v, %v", err, rs, total)
 		}
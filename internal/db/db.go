@@ -17,8 +17,21 @@ const (
 	dbname   = "redir"
 	collink  = "links"
 	colvisit = "visit"
+	coldaily = "visit_daily"
+	coltoken = "tokens"
 )
 
+// SchemaVersion is the version of the layout of the collections and
+// documents in the store. It is increased whenever stored documents
+// need to be migrated, e.g. by redir stats backfill.
+//
+//   - 1: links and visits.
+//   - 2: links with owners and groups, visits with browser, OS, device,
+//     referer class, bot flag and unique visitor hashes, daily rollups
+//     of visits, and API tokens. Visits of version 1 are completed by
+//     redir stats backfill.
+const SchemaVersion = 2
+
 type Store struct {
 	cli *mongo.Client
 }
@@ -26,7 +39,7 @@ type Store struct {
 // NewStore parses the given URI and returns the database instantiation.
 func NewStore(ctx context.Context, uri string) (*Store, error) {
 	// initialize database connection
-	db, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	db, err := mongo.Connect(ctx, options.Client().ApplyURI(uri).SetMonitor(monitor))
 	if err != nil {
 		return nil, fmt.Errorf("cannot connect to database: %w", err)
 	}
@@ -38,6 +51,11 @@ func NewStore(ctx context.Context, uri string) (*Store, error) {
 	return &Store{db}, nil
 }
 
+// Ping checks whether the database is reachable.
+func (db *Store) Ping(ctx context.Context) error {
+	return db.cli.Ping(ctx, nil)
+}
+
 func (db *Store) Close() (err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
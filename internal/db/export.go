@@ -0,0 +1,159 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ScanVisits calls fn for each visit of a given alias, or of all aliases
+// if a is empty, in a range of time ordered by time. The visits are
+// streamed from the database so that any number of visits can be
+// scanned. Scanning stops at the first error returned by fn.
+func (db *Store) ScanVisits(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+	fn func(v *models.Visit) error,
+) error {
+	filter := visitRange(a, start, end)
+	for k, v := range traffic.filter("") {
+		filter[k] = v
+	}
+
+	col := db.cli.Database(dbname).Collection(colvisit)
+	cur, err := col.Find(ctx, filter, options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return fmt.Errorf("failed to find visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		var v models.Visit
+		if err := cur.Decode(&v); err != nil {
+			return fmt.Errorf("failed to fetch visits: %w", err)
+		}
+		if err := fn(&v); err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return fmt.Errorf("failed to fetch visits: %w", err)
+	}
+	return nil
+}
+
+// StatDaily counts the daily (UTC) PV/UV of a given alias, or of all
+// aliases if a is empty, in a range of time ordered by date and alias.
+//
+// Days whose raw visit records were purged are filled from the daily
+// rollups, which always include all traffic.
+func (db *Store) StatDaily(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.VisitDaily, error) {
+	filter := visitRange(a, start, end)
+	for k, v := range traffic.filter("") {
+		filter[k] = v
+	}
+
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetMaxTime(time.Minute).SetAllowDiskUse(true)
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: filter},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"alias": "$alias",
+					"date": bson.M{"$dateToString": bson.M{
+						"format": "%Y-%m-%d",
+						"date":   "$time",
+					}},
+					"uv": uvKey("$"),
+				},
+				"count": bson.M{"$sum": 1},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id": bson.M{"alias": "$_id.alias", "date": "$_id.date"},
+				"pv":  bson.M{"$sum": "$count"},
+				"uv":  uvCount("$_id.uv"),
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$project", Value: bson.M{
+				"alias": "$_id.alias",
+				"date": bson.M{"$dateFromString": bson.M{
+					"dateString": "$_id.date",
+				}},
+				"pv": 1,
+				"uv": 1,
+			}},
+		},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count daily visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var results []models.VisitDaily
+	if err := cur.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to fetch daily visits: %w", err)
+	}
+
+	// Fill the days that only exist as rollups.
+	rfilter := bson.M{"date": bson.M{"$gte": start, "$lt": end}}
+	if a != "" {
+		rfilter["alias"] = a
+	} else {
+		rfilter["alias"] = bson.M{"$ne": ""}
+	}
+	rcur, err := db.cli.Database(dbname).Collection(coldaily).Find(ctx, rfilter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find daily rollups: %w", err)
+	}
+	defer rcur.Close(ctx)
+
+	var rollups []models.VisitDaily
+	if err := rcur.All(ctx, &rollups); err != nil {
+		return nil, fmt.Errorf("failed to fetch daily rollups: %w", err)
+	}
+	type key struct {
+		alias string
+		date  int64
+	}
+	seen := make(map[key]bool, len(results))
+	for _, r := range results {
+		seen[key{r.Alias, r.Date.Unix()}] = true
+	}
+	for _, r := range rollups {
+		if !seen[key{r.Alias, r.Date.Unix()}] {
+			results = append(results, r)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if !results[i].Date.Equal(results[j].Date) {
+			return results[i].Date.Before(results[j].Date)
+		}
+		return results[i].Alias < results[j].Alias
+	})
+	return results, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+)
+
+// Granularity is the bucket size of a time histogram.
+type Granularity string
+
+// All supported granularities of time histograms.
+const (
+	GranularityMinute Granularity = "minute"
+	GranularityHour   Granularity = "hour"
+	GranularityDay    Granularity = "day"
+	GranularityWeek   Granularity = "week"
+	GranularityMonth  Granularity = "month"
+)
+
+// MaxHistBuckets is the maximum number of buckets of a time histogram.
+const MaxHistBuckets = 10000
+
+// ErrTooManyBuckets reports that a time histogram would have more than
+// MaxHistBuckets buckets.
+var ErrTooManyBuckets = errors.New("too many buckets, use a coarser granularity or a shorter time range")
+
+// Valid reports whether the granularity is supported.
+func (g Granularity) Valid() bool {
+	switch g {
+	case GranularityMinute, GranularityHour, GranularityDay,
+		GranularityWeek, GranularityMonth:
+		return true
+	}
+	return false
+}
+
+// format returns the $dateToString format that identifies the bucket
+// of a time. Weeks are ISO 8601 weeks that start on Monday.
+func (g Granularity) format() string {
+	switch g {
+	case GranularityMinute:
+		return "%Y-%m-%dT%H:%M"
+	case GranularityDay:
+		return "%Y-%m-%d"
+	case GranularityWeek:
+		return "%G-%V"
+	case GranularityMonth:
+		return "%Y-%m"
+	default:
+		return "%Y-%m-%dT%H"
+	}
+}
+
+// parse parses a bucket key that was formatted by format in the given
+// location, and returns the start time of the bucket.
+func (g Granularity) parse(key string, loc *time.Location) (time.Time, error) {
+	switch g {
+	case GranularityMinute:
+		return time.ParseInLocation("2006-01-02T15:04", key, loc)
+	case GranularityDay:
+		return time.ParseInLocation("2006-01-02", key, loc)
+	case GranularityWeek:
+		yw := strings.SplitN(key, "-", 2)
+		if len(yw) != 2 {
+			return time.Time{}, fmt.Errorf("invalid week: %s", key)
+		}
+		y, err := strconv.Atoi(yw[0])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid week: %s", key)
+		}
+		w, err := strconv.Atoi(yw[1])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid week: %s", key)
+		}
+		// January 4th is always in the first ISO week of a year.
+		t := g.truncate(time.Date(y, time.January, 4, 0, 0, 0, 0, loc), loc)
+		return t.AddDate(0, 0, 7*(w-1)), nil
+	case GranularityMonth:
+		return time.ParseInLocation("2006-01", key, loc)
+	default:
+		return time.ParseInLocation("2006-01-02T15", key, loc)
+	}
+}
+
+// truncate returns the start time of the bucket of t in the given
+// location.
+func (g Granularity) truncate(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch g {
+	case GranularityMinute:
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, loc)
+	case GranularityDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, loc)
+	case GranularityWeek:
+		offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, loc)
+	case GranularityMonth:
+		return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	}
+}
+
+// next returns the start time of the bucket after the bucket that
+// starts at t.
+func (g Granularity) next(t time.Time) time.Time {
+	switch g {
+	case GranularityMinute:
+		return t.Add(time.Minute)
+	case GranularityHour:
+		return t.Add(time.Hour)
+	case GranularityDay:
+		return t.AddDate(0, 0, 1)
+	case GranularityWeek:
+		return t.AddDate(0, 0, 7)
+	case GranularityMonth:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.Add(time.Hour)
+	}
+}
+
+// buckets returns the start times of all buckets between start and end.
+func (g Granularity) buckets(start, end time.Time, loc *time.Location) ([]time.Time, error) {
+	var ts []time.Time
+	for t := g.truncate(start, loc); t.Before(end); t = g.next(t) {
+		if len(ts) >= MaxHistBuckets {
+			return nil, ErrTooManyBuckets
+		}
+		ts = append(ts, t)
+	}
+	return ts, nil
+}
+
+// fill returns the histogram of all buckets between start and end, where
+// hist is indexed by the Unix time of the buckets, and buckets that are
+// missing in hist are filled with zeros.
+func (g Granularity) fill(
+	hist map[int64]models.TimeHist,
+	start, end time.Time,
+	loc *time.Location,
+) ([]models.TimeHist, error) {
+	ts, err := g.buckets(start, end, loc)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]models.TimeHist, len(ts))
+	for i, t := range ts {
+		results[i] = hist[t.Unix()]
+		results[i].Time = t
+	}
+	return results, nil
+}
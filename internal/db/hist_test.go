@@ -0,0 +1,96 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+)
+
+func TestGranularity(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("cannot load timezone: %v", err)
+	}
+
+	// 2021-11-03T23:30:45Z is a Thursday, and already the next day in
+	// Berlin.
+	ts := time.Date(2021, time.November, 3, 23, 30, 45, 0, time.UTC)
+	tests := []struct {
+		g    Granularity
+		loc  *time.Location
+		key  string
+		want time.Time
+	}{
+		{GranularityMinute, time.UTC, "2021-11-03T23:30", time.Date(2021, 11, 3, 23, 30, 0, 0, time.UTC)},
+		{GranularityHour, time.UTC, "2021-11-03T23", time.Date(2021, 11, 3, 23, 0, 0, 0, time.UTC)},
+		{GranularityHour, berlin, "2021-11-04T00", time.Date(2021, 11, 4, 0, 0, 0, 0, berlin)},
+		{GranularityDay, time.UTC, "2021-11-03", time.Date(2021, 11, 3, 0, 0, 0, 0, time.UTC)},
+		{GranularityDay, berlin, "2021-11-04", time.Date(2021, 11, 4, 0, 0, 0, 0, berlin)},
+		{GranularityWeek, time.UTC, "2021-44", time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{GranularityMonth, berlin, "2021-11", time.Date(2021, 11, 1, 0, 0, 0, 0, berlin)},
+	}
+	for _, tt := range tests {
+		if got := tt.g.truncate(ts, tt.loc); !got.Equal(tt.want) {
+			t.Errorf("%s: truncate(%v) = %v, want %v", tt.g, ts, got, tt.want)
+		}
+		got, err := tt.g.parse(tt.key, tt.loc)
+		if err != nil {
+			t.Fatalf("%s: parse(%s) failed: %v", tt.g, tt.key, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: parse(%s) = %v, want %v", tt.g, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGranularityWeekOfYear(t *testing.T) {
+	// 2021-01-01 is a Friday and belongs to the last ISO week of 2020.
+	got, err := GranularityWeek.parse("2020-53", time.UTC)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	want := time.Date(2020, 12, 28, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Fatalf("parse(2020-53) = %v, want %v", got, want)
+	}
+	ts := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	if got := GranularityWeek.truncate(ts, time.UTC); !got.Equal(want) {
+		t.Fatalf("truncate(%v) = %v, want %v", ts, got, want)
+	}
+}
+
+func TestGranularityFill(t *testing.T) {
+	start := time.Date(2021, 11, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2021, 11, 4, 0, 0, 0, 0, time.UTC)
+	hist := map[int64]models.TimeHist{
+		time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC).Unix(): {PV: 3, UV: 2},
+	}
+	got, err := GranularityDay.fill(hist, start, end, time.UTC)
+	if err != nil {
+		t.Fatalf("fill failed: %v", err)
+	}
+	want := []models.TimeHist{
+		{Time: start, PV: 0, UV: 0},
+		{Time: start.AddDate(0, 0, 1), PV: 3, UV: 2},
+		{Time: start.AddDate(0, 0, 2), PV: 0, UV: 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("fill returns %d buckets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Time.Equal(want[i].Time) || got[i].PV != want[i].PV || got[i].UV != want[i].UV {
+			t.Fatalf("fill[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// A whole year of minutes is too much.
+	_, err = GranularityMinute.fill(nil, start, start.AddDate(1, 0, 0), time.UTC)
+	if err != ErrTooManyBuckets {
+		t.Fatalf("fill should fail with too many buckets, got %v", err)
+	}
+}
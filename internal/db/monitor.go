@@ -0,0 +1,79 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/metrics"
+	"changkun.de/x/redir/internal/tracing"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	opDuration = metrics.NewHistogramVec("redir_db_operation_duration_seconds",
+		"Latency of database commands.", metrics.DefBuckets, "command")
+	opErrors = metrics.NewCounterVec("redir_db_operation_errors_total",
+		"Number of failed database commands.", "command")
+)
+
+// commandKey identifies a command while it is in flight.
+type commandKey struct {
+	conn string
+	id   int64
+}
+
+// spans holds the spans of in flight commands.
+var spans sync.Map // commandKey -> *tracing.Span
+
+// endSpan ends the span of a finished command.
+func endSpan(e *event.CommandFinishedEvent, err error) {
+	s, ok := spans.LoadAndDelete(commandKey{e.ConnectionID, e.RequestID})
+	if !ok {
+		return
+	}
+	span := s.(*tracing.Span)
+	span.SetError(err)
+	span.End()
+}
+
+// monitor measures the latency and errors of all database commands,
+// traces them, and logs them with the logger of the request that issued
+// the command.
+var monitor = &event.CommandMonitor{
+	Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		// Commands of background jobs, e.g. recording visits, are only
+		// traced as part of a traced operation.
+		if tracing.SpanFromContext(ctx) == nil {
+			return
+		}
+		_, span := tracing.Start(ctx, "mongodb."+e.CommandName, tracing.KindClient,
+			tracing.String("db.system", "mongodb"),
+			tracing.String("db.name", e.DatabaseName),
+			tracing.String("db.operation", e.CommandName))
+		if span != nil {
+			spans.Store(commandKey{e.ConnectionID, e.RequestID}, span)
+		}
+	},
+	Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+		endSpan(&e.CommandFinishedEvent, nil)
+		d := time.Duration(e.DurationNanos)
+		opDuration.Observe(d.Seconds(), e.CommandName)
+		logging.FromContext(ctx).Debug("database command succeeded",
+			"command", e.CommandName, "duration", d)
+	},
+	Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+		endSpan(&e.CommandFinishedEvent, errors.New(e.Failure))
+		d := time.Duration(e.DurationNanos)
+		opDuration.Observe(d.Seconds(), e.CommandName)
+		opErrors.Inc(e.CommandName)
+		logging.FromContext(ctx).Warn("database command failed",
+			"command", e.CommandName, "duration", d, "err", e.Failure)
+	},
+}
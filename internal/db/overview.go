@@ -0,0 +1,145 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// StatAliases counts the PV/UV of all aliases in a range of time, and
+// returns the top n aliases sorted by PV and UV. Visits of the index page
+// are not counted.
+//
+// Unique visitors are identified as configured by stats.uv.
+func (db *Store) StatAliases(
+	ctx context.Context,
+	start, end time.Time,
+	traffic Traffic,
+	n int64,
+) ([]models.VisitRecord, error) {
+	filter := visitRange("", start, end)
+	for k, v := range traffic.filter("") {
+		filter[k] = v
+	}
+
+	// Raw query
+	// db.visit.aggregate([
+	// 	{$match: {alias: {$ne: ''}, time: {$gte: start, $lt: end}}},
+	// 	{$group: {_id: {alias: '$alias', uv: '$visitor_id'}, count: {$sum: 1}}},
+	// 	{$group: {_id: '$_id.alias', alias: {$first: '$_id.alias'}, uv: {$sum: 1}, pv: {$sum: '$count'}}},
+	// 	{$sort: {pv: -1, uv: -1}},
+	// 	{$limit: 10},
+	// ])
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetMaxTime(10 * time.Second).SetAllowDiskUse(true)
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: filter},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id":   bson.M{"alias": "$alias", "uv": uvKey("$")},
+				"count": bson.M{"$sum": 1},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id":   "$_id.alias",
+				"alias": bson.M{"$first": "$_id.alias"},
+				"uv":    uvCount("$_id.uv"),
+				"pv":    bson.M{"$sum": "$count"},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$sort", Value: bson.D{
+				primitive.E{Key: "pv", Value: -1},
+				primitive.E{Key: "uv", Value: -1},
+				primitive.E{Key: "alias", Value: 1},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$limit", Value: n},
+		},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count aliases: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var results []models.VisitRecord
+	if err := cur.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to fetch alias results: %w", err)
+	}
+	return results, nil
+}
+
+// StatLinks counts the links that are created in a range of time, in
+// buckets of the given granularity in the given location. Buckets without
+// new links are filled with zeros.
+func (db *Store) StatLinks(
+	ctx context.Context,
+	start, end time.Time,
+	g Granularity,
+	loc *time.Location,
+) ([]models.LinkHist, error) {
+	ts, err := g.buckets(start, end, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	col := db.cli.Database(dbname).Collection(collink)
+	opts := options.Aggregate().SetMaxTime(10 * time.Second)
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.M{
+				"created_at": bson.M{"$gte": start, "$lt": end},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id": bson.M{"$dateToString": bson.M{
+					"date":     "$created_at",
+					"format":   g.format(),
+					"timezone": loc.String(),
+				}},
+				"count": bson.M{"$sum": 1},
+			}},
+		},
+	}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count links: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var buckets []struct {
+		Key   string `bson:"_id"`
+		Count int    `bson:"count"`
+	}
+	if err := cur.All(ctx, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to fetch link results: %w", err)
+	}
+
+	counts := make(map[int64]int, len(buckets))
+	for _, b := range buckets {
+		t, err := g.parse(b.Key, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch link results: %w", err)
+		}
+		counts[t.Unix()] = b.Count
+	}
+	results := make([]models.LinkHist, len(ts))
+	for i, t := range ts {
+		results[i] = models.LinkHist{Time: t, Count: counts[t.Unix()]}
+	}
+	return results, nil
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexVisitTime ensures the visit records are indexed by time, so that
+// expired records can be found without scanning the whole collection.
+func (db *Store) IndexVisitTime(ctx context.Context) error {
+	col := db.cli.Database(dbname).Collection(colvisit)
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{primitive.E{Key: "time", Value: 1}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index visit time: %w", err)
+	}
+	return nil
+}
+
+// CountVisitsBefore counts the visit records that happened before the
+// given time.
+func (db *Store) CountVisitsBefore(ctx context.Context, t time.Time) (int64, error) {
+	col := db.cli.Database(dbname).Collection(colvisit)
+	n, err := col.CountDocuments(ctx, bson.M{"time": bson.M{"$lt": t}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to count visits: %w", err)
+	}
+	return n, nil
+}
+
+// RollupVisits aggregates the daily PV/UV of each alias from the visit
+// records that happened before the given time, and merges the results
+// into the daily rollups. A day that is already rolled up is replaced,
+// hence the given time should be aligned to the beginning of a day.
+func (db *Store) RollupVisits(ctx context.Context, before time.Time) error {
+	// db.visit.aggregate([
+	// 	{$match: {time: {$lt: before}}},
+	// 	{$group: {
+	// 		_id: {alias: '$alias', date: {$dateToString: {format: '%Y-%m-%d', date: '$time'}}, uv: '$visitor_id'},
+	// 		count: {$sum: 1},
+	// 	}},
+	// 	{$group: {
+	// 		_id: {alias: '$_id.alias', date: '$_id.date'},
+	// 		pv: {$sum: '$count'},
+	// 		uv: {$sum: 1},
+	// 	}},
+	// 	{$project: {
+	// 		alias: '$_id.alias',
+	// 		date: {$dateFromString: {dateString: '$_id.date'}},
+	// 		pv: 1,
+	// 		uv: 1,
+	// 	}},
+	// 	{$merge: {into: 'visit_daily', whenMatched: 'replace'}},
+	// ])
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		bson.D{
+			primitive.E{Key: "$match", Value: bson.M{
+				"time": bson.M{"$lt": before},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id": bson.M{
+					"alias": "$alias",
+					"date": bson.M{"$dateToString": bson.M{
+						"format": "%Y-%m-%d",
+						"date":   "$time",
+					}},
+					"uv": uvKey("$"),
+				},
+				"count": bson.M{"$sum": 1},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id": bson.M{"alias": "$_id.alias", "date": "$_id.date"},
+				"pv":  bson.M{"$sum": "$count"},
+				"uv":  uvCount("$_id.uv"),
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$project", Value: bson.M{
+				"alias": "$_id.alias",
+				"date": bson.M{"$dateFromString": bson.M{
+					"dateString": "$_id.date",
+				}},
+				"pv": 1,
+				"uv": 1,
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$merge", Value: bson.M{
+				"into":           coldaily,
+				"on":             "_id",
+				"whenMatched":    "replace",
+				"whenNotMatched": "insert",
+			}},
+		},
+	}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to rollup visits: %w", err)
+	}
+	return cur.Close(ctx)
+}
+
+// PurgeVisits deletes all visit records that happened before the given
+// time, and returns the number of deleted records.
+func (db *Store) PurgeVisits(ctx context.Context, before time.Time) (int64, error) {
+	col := db.cli.Database(dbname).Collection(colvisit)
+	ret, err := col.DeleteMany(ctx, bson.M{"time": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge visits: %w", err)
+	}
+	return ret.DeletedCount, nil
+}
@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"time"
 
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/hll"
 	"changkun.de/x/redir/internal/models"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -16,11 +18,75 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// Traffic selects the visits that are taken into account by statistics.
+type Traffic string
+
+const (
+	// TrafficAll includes all visits.
+	TrafficAll Traffic = "all"
+	// TrafficHuman excludes the visits of bots.
+	TrafficHuman Traffic = "human"
+	// TrafficBot only includes the visits of bots.
+	TrafficBot Traffic = "bot"
+)
+
+// Valid checks if the given Traffic is valid.
+func (t Traffic) Valid() bool {
+	switch t {
+	case TrafficAll, TrafficHuman, TrafficBot:
+		return true
+	default:
+		return false
+	}
+}
+
+// filter returns the query that matches the visits of the traffic, where
+// path is the prefix of the fields of a visit record, e.g. "" or "visit.".
+// Visits that were recorded before bot classification count as human.
+func (t Traffic) filter(path string) bson.M {
+	switch t {
+	case TrafficHuman:
+		return bson.M{path + "bot": bson.M{"$ne": true}}
+	case TrafficBot:
+		return bson.M{path + "bot": true}
+	default:
+		return bson.M{}
+	}
+}
+
+// cond returns the expression that is true for the visits of the
+// traffic, where v is the prefix of the fields of a visit record, e.g.
+// "$$visit.". It is nil for all traffic.
+func (t Traffic) cond(v string) interface{} {
+	switch t {
+	case TrafficHuman:
+		return bson.M{"$ne": bson.A{v + "bot", true}}
+	case TrafficBot:
+		return bson.M{"$eq": bson.A{v + "bot", true}}
+	default:
+		return nil
+	}
+}
+
+// visitRange returns the query that matches the visits of a given alias
+// in a range of time, or the visits of all aliases if a is empty. Visits
+// of the index page are not matched.
+func visitRange(a string, start, end time.Time) bson.M {
+	filter := bson.M{"time": bson.M{"$gte": start, "$lt": end}}
+	if a != "" {
+		filter["alias"] = a
+	} else {
+		filter["alias"] = bson.M{"$ne": ""}
+	}
+	return filter
+}
+
 // StatReferer fetches and counts all referers of a given alias
 func (db *Store) StatReferer(
 	ctx context.Context,
 	a string,
 	start, end time.Time,
+	traffic Traffic,
 ) ([]models.RefStat, error) {
 
 	col := db.cli.Database(dbname).Collection(collink)
@@ -33,8 +99,8 @@ func (db *Store) StatReferer(
 			primitive.E{Key: "$lookup", Value: bson.M{
 				"from": colvisit,
 				"as":   "visit",
-				"pipeline": mongo.Pipeline{bson.D{
-					primitive.E{Key: "$match", Value: bson.M{
+				"pipeline": mongo.Pipeline{
+					bson.D{primitive.E{Key: "$match", Value: bson.M{
 						"$expr": bson.M{
 							"$and": []bson.M{
 								{"$eq": []string{a, "$alias"}},
@@ -42,8 +108,9 @@ func (db *Store) StatReferer(
 								{"$lt": []interface{}{"$time", end}},
 							},
 						},
-					}},
-				}},
+					}}},
+					bson.D{primitive.E{Key: "$match", Value: traffic.filter("")}},
+				},
 			}},
 		},
 		bson.D{
@@ -96,6 +163,7 @@ func (db *Store) StatUA(
 	ctx context.Context,
 	a string,
 	start, end time.Time,
+	traffic Traffic,
 ) ([]models.UAStat, error) {
 
 	col := db.cli.Database(dbname).Collection(collink)
@@ -108,8 +176,8 @@ func (db *Store) StatUA(
 			primitive.E{Key: "$lookup", Value: bson.M{
 				"from": colvisit,
 				"as":   "visit",
-				"pipeline": mongo.Pipeline{bson.D{
-					primitive.E{Key: "$match", Value: bson.M{
+				"pipeline": mongo.Pipeline{
+					bson.D{primitive.E{Key: "$match", Value: bson.M{
 						"$expr": bson.M{
 							"$and": []bson.M{
 								{"$eq": []string{a, "$alias"}},
@@ -117,8 +185,9 @@ func (db *Store) StatUA(
 								{"$lt": []interface{}{"$time", end}},
 							},
 						},
-					}},
-				}},
+					}}},
+					bson.D{primitive.E{Key: "$match", Value: traffic.filter("")}},
+				},
 			}},
 		},
 		bson.D{
@@ -167,224 +236,453 @@ func (db *Store) StatUA(
 	return results, nil
 }
 
-// StatVisitHist is a enhanced version of StatVisit.
-// It offers the ability to query PV/UV for a range of time.
-//
-// The current approach is to count IP address.
-func (db *Store) StatVisitHist(
+// StatRefererDomain counts the visits of a given alias, or of all aliases
+// if a is empty, by the normalized referer host. Visits without referer host are counted by their referer
+// class instead, such as direct, or unknown if not yet classified.
+func (db *Store) StatRefererDomain(
 	ctx context.Context,
 	a string,
 	start, end time.Time,
-) ([]models.TimeHist, error) {
+	traffic Traffic,
+) ([]models.RefererDomainStat, error) {
+	host := bson.M{"$cond": bson.M{
+		"if": bson.M{
+			"$in": []interface{}{
+				bson.M{"$ifNull": []string{"$referer_host", ""}},
+				[]string{""},
+			},
+		},
+		"then": bson.M{"$ifNull": []string{"$referer_class", "unknown"}},
+		"else": "$referer_host",
+	}}
 
-	// Raw query
-	// db.links.aggregate([
-	// 	{$match: {alias: 'changkun'}},
-	// 	{'$lookup': {
-	// 		from: 'visit', localField: 'alias',
-	// 		foreignField: 'alias', as: 'visit'},
-	// 	},
-	// 	{
-	// 		$group: {
-	// 			_id: "$alias",
-	// 			time: {'$first': '$visit.time'},
-	// 			ip: {'$first': '$visit.ip'},
-	// 		},
-	// 	},
-	// 	{'$unwind': {path: "$time", includeArrayIndex: "idx1"}},
-	// 	{'$unwind': {path: "$ip",   includeArrayIndex: "idx2"}},
-	// 	{
-	// 		$project: {
-	// 			_id: 1,
-	// 			time: 1,
-	// 			ip:   1,
-	// 			valid: {$eq: ["$idx1", "$idx2"]},
-	// 		},
-	// 	},
-	// 	{$match: {valid: true}},
-	// 	{
-	// 		$project: {
-	// 			_id: {
-	// 				"year": {$year: "$time"},
-	// 				"month": {$month: "$time"},
-	// 				"day": {$dayOfMonth: "$time"},
-	// 				"hour": {$hour: "$time"},
-	// 			},
-	// 			"time": "$time",
-	// 			"ip": "$ip",
-	// 		},
-	// 	},
-	// 	{
-	// 		$group: {
-	// 			_id: "$_id",
-	// 			time: {$first: '$time'},
-	// 			visits: {$push: '$ip'},
-	// 			users: {$addToSet: '$ip'},
-	// 		},
-	// 	},
-	// 	{
-	// 		$project: {
-	// 			time: 1,
-	// 			pv: {$size: '$visits'},
-	// 			uv: {$size: '$users'},
-	// 		}
-	// 	}
-	// ])
-	col := db.cli.Database(dbname).Collection(collink)
+	col := db.cli.Database(dbname).Collection(colvisit)
 	opts := options.Aggregate().SetMaxTime(10 * time.Second)
 	cur, err := col.Aggregate(ctx, mongo.Pipeline{
-		bson.D{primitive.E{
-			Key: "$match", Value: bson.M{"alias": a},
-		}},
-		bson.D{primitive.E{
-			Key: "$lookup", Value: bson.M{
-				"from": colvisit,
-				"as":   "visit",
-				"pipeline": mongo.Pipeline{bson.D{
-					primitive.E{Key: "$match", Value: bson.M{
-						"$expr": bson.M{
-							"$and": []bson.M{
-								{"$eq": []string{a, "$alias"}},
-								{"$gte": []interface{}{"$time", start}},
-								{"$lt": []interface{}{"$time", end}},
-							},
-						},
-					}},
+		bson.D{
+			primitive.E{Key: "$match", Value: visitRange(a, start, end)},
+		},
+		bson.D{
+			primitive.E{Key: "$match", Value: traffic.filter("")},
+		},
+		bson.D{
+			primitive.E{Key: "$group", Value: bson.M{
+				"_id":  host,
+				"host": bson.M{"$first": host},
+				"class": bson.M{"$first": bson.M{
+					"$ifNull": []string{"$referer_class", "unknown"},
 				}},
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$group", Value: bson.M{
-				"_id":  "$alias",
-				"time": bson.M{"$first": "$visit.time"},
-				"ip":   bson.M{"$first": "$visit.ip"},
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$unwind", Value: bson.M{
-				"path":              "$time",
-				"includeArrayIndex": "idx1",
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$unwind", Value: bson.M{
-				"path":              "$ip",
-				"includeArrayIndex": "idx2",
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$project", Value: bson.M{
-				"_id":   1,
-				"time":  1,
-				"ip":    1,
-				"valid": bson.M{"$eq": []string{"$idx1", "$idx2"}},
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$match", Value: bson.M{"valid": true},
-		}},
-		bson.D{primitive.E{
-			Key: "$project", Value: bson.M{
-				"_id": bson.M{
-					"year":  bson.M{"$year": "$time"},
-					"month": bson.M{"$month": "$time"},
-					"day":   bson.M{"$dayOfMonth": "$time"},
-					"hour":  bson.M{"$hour": "$time"},
-				},
-				"time": "$time",
-				"ip":   "$ip",
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$group",
-			Value: bson.M{
-				"_id":    "$_id",
-				"time":   bson.M{"$first": "$time"},
-				"visits": bson.M{"$push": "$ip"},
-				"users":  bson.M{"$addToSet": "$ip"},
-			},
-		}},
-		bson.D{primitive.E{
-			Key: "$project",
-			Value: bson.M{
-				"time": 1,
-				"pv":   bson.M{"$size": "$visits"},
-				"uv":   bson.M{"$size": "$users"},
-			},
-		}},
+				"count": bson.M{"$sum": 1},
+			}},
+		},
+		bson.D{
+			primitive.E{Key: "$sort", Value: bson.M{"count": -1}},
+		},
 	}, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to count time hist: %w", err)
+		return nil, fmt.Errorf("failed to count referer domains: %w", err)
 	}
 	defer cur.Close(ctx)
 
-	var results []models.TimeHist
+	var results []models.RefererDomainStat
 	if err := cur.All(ctx, &results); err != nil {
-		return nil, fmt.Errorf("failed to fetch time hist results: %w", err)
+		return nil, fmt.Errorf("failed to fetch referer domain results: %w", err)
 	}
 	return results, nil
 }
 
-// StatVisit counts the PV/UV of given aliases.
-//
-// The current approach is to use visitor's IP address.
-func (db *Store) StatVisit(ctx context.Context, as []string) (rs []models.VisitRecord, err error) {
-	if len(as) == 0 {
-		return nil, nil
-	}
+// StatBrowser counts the visits of a given alias, or of all aliases if
+// a is empty, by browser family.
+func (db *Store) StatBrowser(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.NameStat, error) {
+	return db.statName(ctx, "browser", a, start, end, traffic)
+}
 
-	col := db.cli.Database(dbname).Collection(collink)
-	opts := options.Aggregate().SetMaxTime(10 * time.Second)
-	matches := []bson.M{}
-	for _, a := range as {
-		matches = append(matches, bson.M{"alias": a})
-	}
+// StatOS counts the visits of a given alias, or of all aliases if
+// a is empty, by operating system family.
+func (db *Store) StatOS(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.NameStat, error) {
+	return db.statName(ctx, "os", a, start, end, traffic)
+}
 
-	cur, err := col.Aggregate(ctx, mongo.Pipeline{
-		bson.D{
-			primitive.E{Key: "$match", Value: bson.M{"$or": matches}},
+// StatDevice counts the visits of a given alias, or of all aliases if
+// a is empty, by device class.
+func (db *Store) StatDevice(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.NameStat, error) {
+	return db.statName(ctx, "device", a, start, end, traffic)
+}
+
+// StatCountry counts the visits of a given alias, or of all aliases if
+// a is empty, by country.
+func (db *Store) StatCountry(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.NameStat, error) {
+	return db.statName(ctx, "country", a, start, end, traffic)
+}
+
+// statName counts the visits of a given alias, or of all aliases if a is
+// empty, grouped by the given field of the visit records. Missing or
+// empty values are counted as unknown.
+func (db *Store) statName(
+	ctx context.Context,
+	field string,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+) ([]models.NameStat, error) {
+	name := bson.M{"$cond": bson.M{
+		"if": bson.M{
+			"$in": []interface{}{
+				bson.M{"$ifNull": []string{"$" + field, ""}},
+				[]string{""},
+			},
 		},
+		"then": "unknown",
+		"else": "$" + field,
+	}}
+
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetMaxTime(10 * time.Second)
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
 		bson.D{
-			primitive.E{Key: "$lookup", Value: bson.M{
-				"from":         colvisit,
-				"localField":   "alias",
-				"foreignField": "alias",
-				"as":           "visit",
-			}},
+			primitive.E{Key: "$match", Value: visitRange(a, start, end)},
 		},
 		bson.D{
-			primitive.E{Key: "$unwind", Value: bson.M{
-				"path":                       "$visit",
-				"preserveNullAndEmptyArrays": true,
-			}},
+			primitive.E{Key: "$match", Value: traffic.filter("")},
 		},
 		bson.D{
 			primitive.E{Key: "$group", Value: bson.M{
-				"_id":   bson.M{"alias": "$alias", "ip": "$visit.ip"},
+				"_id":   name,
+				"name":  bson.M{"$first": name},
 				"count": bson.M{"$sum": 1},
 			}},
 		},
 		bson.D{
-			primitive.E{Key: "$group", Value: bson.M{
-				"_id":   "$_id.alias",
-				"alias": bson.M{"$first": "$_id.alias"},
-				"uv":    bson.M{"$sum": 1},
-				"pv":    bson.M{"$sum": "$count"},
-			}},
-		},
-		bson.D{
-			primitive.E{Key: "$sort", Value: bson.M{"pv": -1, "uv": -1}},
+			primitive.E{Key: "$sort", Value: bson.M{"count": -1}},
 		},
 	}, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to count visit: %w", err)
+		return nil, fmt.Errorf("failed to count %s: %w", field, err)
 	}
 	defer cur.Close(ctx)
 
-	var results []models.VisitRecord
+	var results []models.NameStat
 	if err := cur.All(ctx, &results); err != nil {
-		return nil, fmt.Errorf("failed to fetch visit results: %w", err)
+		return nil, fmt.Errorf("failed to fetch %s results: %w", field, err)
 	}
-
 	return results, nil
 }
+
+// StatVisitHist queries the PV/UV of a given alias, or of all
+// aliases if a is empty, for a range of time, where the
+// visits are counted in buckets of the given granularity in the given
+// location. Buckets without visits are filled with zeros.
+//
+// Unique visitors are identified as configured by stats.uv. For time
+// ranges that are longer than stats.uv_approx days, UVs are estimated
+// using HyperLogLog, see statVisitHistApprox.
+func (db *Store) StatVisitHist(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+	g Granularity,
+	loc *time.Location,
+) ([]models.TimeHist, error) {
+	// Check the number of buckets before querying the database.
+	if _, err := g.buckets(start, end, loc); err != nil {
+		return nil, err
+	}
+
+	if !uvExact(end.Sub(start)) {
+		return db.statVisitHistApprox(ctx, a, start, end, traffic, g, loc)
+	}
+
+	// Raw query
+	// db.visit.aggregate([
+	// 	{$match: {alias: 'changkun', time: {$gte: start, $lt: end}}},
+	// 	{
+	// 		$group: {
+	// 			_id: {$dateToString: {
+	// 				date: '$time', format: '%Y-%m-%dT%H',
+	// 				timezone: 'Europe/Berlin',
+	// 			}},
+	// 			pv: {$sum: 1},
+	// 			users: {$addToSet: '$visitor_id'},
+	// 		},
+	// 	},
+	// 	{$project: {pv: 1, uv: {$size: '$users'}}},
+	// ])
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetMaxTime(10 * time.Second).SetAllowDiskUse(true)
+	cur, err := col.Aggregate(ctx, append(mongo.Pipeline{
+		bson.D{primitive.E{
+			Key: "$match", Value: visitRange(a, start, end),
+		}},
+		bson.D{primitive.E{
+			Key: "$match", Value: traffic.filter(""),
+		}},
+	}, uvUsers(bson.M{"$dateToString": bson.M{
+		"date":     "$time",
+		"format":   g.format(),
+		"timezone": loc.String(),
+	}}, "$")...), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count time hist: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var buckets []struct {
+		Key string `bson:"_id"`
+		PV  int    `bson:"pv"`
+		UV  int    `bson:"uv"`
+	}
+	if err := cur.All(ctx, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to fetch time hist results: %w", err)
+	}
+
+	hist := make(map[int64]models.TimeHist, len(buckets))
+	for _, b := range buckets {
+		t, err := g.parse(b.Key, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch time hist results: %w", err)
+		}
+		hist[t.Unix()] = models.TimeHist{PV: b.PV, UV: b.UV}
+	}
+	return g.fill(hist, start, end, loc)
+}
+
+// statVisitHistApprox is like StatVisitHist, but it estimates the UVs of
+// each bucket using HyperLogLog instead of collecting all unique visitors
+// of a bucket in the database, see uvSketch.
+func (db *Store) statVisitHistApprox(
+	ctx context.Context,
+	a string,
+	start, end time.Time,
+	traffic Traffic,
+	g Granularity,
+	loc *time.Location,
+) ([]models.TimeHist, error) {
+	filter := visitRange(a, start, end)
+	for k, v := range traffic.filter("") {
+		filter[k] = v
+	}
+
+	col := db.cli.Database(dbname).Collection(colvisit)
+	opts := options.Aggregate().SetMaxTime(time.Minute).SetAllowDiskUse(true)
+	cur, err := col.Aggregate(ctx, append(mongo.Pipeline{
+		bson.D{primitive.E{
+			Key: "$match", Value: filter,
+		}},
+	}, uvSketch(bson.M{"$dateToString": bson.M{
+		"date":     "$time",
+		"format":   g.format(),
+		"timezone": loc.String(),
+	}}, "$")...), opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count time hist: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var buckets []struct {
+		Key  string  `bson:"_id"`
+		PV   int     `bson:"pv"`
+		Regs int     `bson:"regs"`
+		Sum  float64 `bson:"sum"`
+	}
+	if err := cur.All(ctx, &buckets); err != nil {
+		return nil, fmt.Errorf("failed to fetch time hist results: %w", err)
+	}
+
+	hist := make(map[int64]models.TimeHist, len(buckets))
+	for _, b := range buckets {
+		t, err := g.parse(b.Key, loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch time hist results: %w", err)
+		}
+		hist[t.Unix()] = models.TimeHist{PV: b.PV, UV: int(uvEstimate(b.Regs, b.Sum))}
+	}
+	return g.fill(hist, start, end, loc)
+}
+
+// uvKey returns the aggregation expression that identifies the unique
+// visitor of a visit record, where path is the prefix of the fields of
+// the record, e.g. "$" or "$visit.". Visits without a visitor ID, such as
+// the visits without consent to the visitor cookie, are identified by
+// their IP address. The expression is null for visits that cannot be
+// identified, e.g. anonymous visits, which are not counted as unique
+// visitors, see uvCount.
+func uvKey(path string) interface{} {
+	ip := bson.M{"$ifNull": bson.A{path + "ip", ""}}
+	var key interface{}
+	switch config.Get().Stats.UV {
+	case config.UVIP:
+		key = ip
+	case config.UVFingerprint:
+		key = bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{ip, ""}},
+			"",
+			bson.M{"$concat": bson.A{
+				ip, "|", bson.M{"$ifNull": bson.A{path + "ua", ""}},
+			}},
+		}}
+	default:
+		vid := bson.M{"$ifNull": bson.A{path + "visitor_id", ""}}
+		key = bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{vid, ""}}, ip, vid}}
+	}
+	return bson.M{"$let": bson.M{
+		"vars": bson.M{"key": key},
+		"in": bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$$key", ""}}, nil, "$$key",
+		}},
+	}}
+}
+
+// uvCount returns the accumulator that counts the unique visitors that
+// are grouped by uvKey, where key is the path of the grouped uvKey, e.g.
+// "$_id.uv".
+func uvCount(key string) bson.M {
+	return bson.M{"$sum": bson.M{"$cond": bson.A{
+		bson.M{"$eq": bson.A{key, nil}}, 0, 1,
+	}}}
+}
+
+// uvExact reports whether the UVs of a time range of the given duration
+// are counted exactly rather than estimated, see stats.uv_approx.
+func uvExact(d time.Duration) bool {
+	approx := config.Get().Stats.UVApprox
+	return approx <= 0 || d <= time.Duration(approx)*24*time.Hour
+}
+
+// uvUsers returns the aggregation stages that group the visit records by
+// the given key, and count the PV and the exact UV of each group, where
+// path is the prefix of the fields of the records, e.g. "$" or
+// "$visit.". The given fields are taken from the first record of each
+// group. It is the exact counterpart of uvSketch.
+func uvUsers(key interface{}, path string, fields ...string) []bson.D {
+	group := bson.M{
+		"_id":   key,
+		"pv":    bson.M{"$sum": 1},
+		"users": bson.M{"$addToSet": uvKey(path)},
+	}
+	project := bson.M{
+		"pv": 1,
+		"uv": bson.M{"$size": bson.M{
+			"$setDifference": bson.A{"$users", bson.A{nil}},
+		}},
+	}
+	for _, f := range fields {
+		group[f] = bson.M{"$first": "$" + f}
+		project[f] = 1
+	}
+	return []bson.D{
+		{primitive.E{Key: "$group", Value: group}},
+		{primitive.E{Key: "$project", Value: project}},
+	}
+}
+
+// uvPrecision is the precision of the HyperLogLog sketches of UVs.
+const uvPrecision = 12
+
+// visitorKeys returns the keys that identify the unique visitor of a
+// visit record by the visitor ID, by the IP address and by the
+// fingerprint. They are the counterparts of uvKey, and are empty if the
+// visitor cannot be identified.
+func visitorKeys(v *models.Visit) (vid, ip, fingerprint string) {
+	vid, ip = v.VisitorID, v.IP
+	if vid == "" {
+		vid = v.IP
+	}
+	if ip != "" {
+		fingerprint = v.IP + "|" + v.UA
+	}
+	return vid, ip, fingerprint
+}
+
+// HashVisitor computes the HyperLogLog registers of the unique visitor
+// of the given visit record, see models.UVHash.
+func HashVisitor(v *models.Visit) {
+	register := func(key string) int32 {
+		if key == "" {
+			return 0
+		}
+		idx, rho := hll.Register(uvPrecision, []byte(key))
+		return int32(idx)<<6 | int32(rho)
+	}
+	vid, ip, fingerprint := visitorKeys(v)
+	v.UVHash = &models.UVHash{
+		VID:         register(vid),
+		IP:          register(ip),
+		Fingerprint: register(fingerprint),
+	}
+}
+
+// uvSketch returns the aggregation stages that group the visit records
+// by the given key, count the PV, and build the HyperLogLog sketch of
+// the UV of each group in the database, where path is the prefix of the
+// fields of the records, e.g. "$" or "$visit.". The first stage keeps
+// the maximum rank of each register, from the registers that are stored
+// with the records as configured by stats.uv, and the second one sums up
+// the non-zero registers of each group as regs and sum, which are
+// estimated by uvEstimate. The given fields are taken from the first
+// record of each group.
+//
+// Unlike collecting the unique visitors of a group, the stages use
+// constant memory for each group regardless of the number of visitors.
+func uvSketch(key interface{}, path string, fields ...string) []bson.D {
+	mode := config.Get().Stats.UV
+	if mode == "" {
+		mode = config.UVVisitor
+	}
+	h := path + "uv_hash." + string(mode)
+
+	regs := bson.M{
+		"_id": bson.M{
+			"key": key,
+			"reg": bson.M{"$floor": bson.M{"$divide": bson.A{h, 64}}},
+		},
+		"pv":   bson.M{"$sum": 1},
+		"rank": bson.M{"$max": bson.M{"$mod": bson.A{h, 64}}},
+	}
+	groups := bson.M{
+		"_id": "$_id.key",
+		"pv":  bson.M{"$sum": "$pv"},
+		"regs": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$rank", 0}}, 1, 0,
+		}}},
+		"sum": bson.M{"$sum": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$rank", 0}},
+			bson.M{"$pow": bson.A{2, bson.M{"$subtract": bson.A{0, "$rank"}}}},
+			0,
+		}}},
+	}
+	for _, f := range fields {
+		regs[f] = bson.M{"$first": "$" + f}
+		groups[f] = bson.M{"$first": "$" + f}
+	}
+	return []bson.D{
+		{primitive.E{Key: "$group", Value: regs}},
+		{primitive.E{Key: "$group", Value: groups}},
+	}
+}
+
+// uvEstimate estimates the UV of a group from the sum of its registers,
+// see uvSketch.
+func uvEstimate(regs int, sum float64) int64 {
+	return int64(hll.Estimate(uvPrecision, sum, regs))
+}
@@ -0,0 +1,141 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrTokenNotFound indicates that a token does not exist.
+var ErrTokenNotFound = errors.New("token not found")
+
+// StoreToken stores a new API token, and sets the ID of the token.
+func (db *Store) StoreToken(ctx context.Context, t *models.Token) error {
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	// Tokens are looked up by their hashes on every request.
+	_, err := col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "hash", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index token hash: %w", err)
+	}
+
+	ret, err := col.InsertOne(ctx, bson.M{
+		"name":       t.Name,
+		"user":       t.User,
+		"hash":       t.Hash,
+		"scope":      t.Scope,
+		"prefix":     t.Prefix,
+		"expires_at": t.ExpiresAt,
+		"created_at": t.CreatedAt,
+		"last_used":  t.LastUsed,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert token: %w", err)
+	}
+	t.ID = ret.InsertedID.(primitive.ObjectID).Hex()
+	return nil
+}
+
+// FetchToken returns the token of the given hash.
+func (db *Store) FetchToken(ctx context.Context, hash string) (*models.Token, error) {
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	var t models.Token
+	err := col.FindOne(ctx, bson.M{"hash": hash}).Decode(&t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch token: %w", err)
+	}
+	return &t, nil
+}
+
+// FetchTokens returns the tokens of the given user, or the tokens of all
+// users if the user is empty.
+func (db *Store) FetchTokens(ctx context.Context, user string) ([]models.Token, error) {
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	filter := bson.M{}
+	if user != "" {
+		filter["user"] = user
+	}
+	cur, err := col.Find(ctx, filter, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch tokens: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	ts := []models.Token{}
+	if err := cur.All(ctx, &ts); err != nil {
+		return nil, fmt.Errorf("failed to fetch tokens: %w", err)
+	}
+	return ts, nil
+}
+
+// DeleteToken deletes the token of the given ID. If the user is not
+// empty, only a token of the user is deleted.
+func (db *Store) DeleteToken(ctx context.Context, id, user string) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return ErrTokenNotFound
+	}
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	filter := bson.M{"_id": oid}
+	if user != "" {
+		filter["user"] = user
+	}
+	ret, err := col.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to delete token: %w", err)
+	}
+	if ret.DeletedCount == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// TouchToken sets the last used time of the token of the given ID.
+func (db *Store) TouchToken(ctx context.Context, id string, t time.Time) error {
+	oid, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return err
+	}
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	_, err = col.UpdateOne(ctx, bson.M{"_id": oid}, bson.M{"$set": bson.M{"last_used": t}})
+	if err != nil {
+		return fmt.Errorf("failed to update token: %w", err)
+	}
+	return nil
+}
+
+// UpdateTokenUser sets the current role and groups of the given user to
+// all tokens of the user.
+func (db *Store) UpdateTokenUser(ctx context.Context, user, role string, groups []string) error {
+	col := db.cli.Database(dbname).Collection(coltoken)
+
+	_, err := col.UpdateMany(ctx, bson.M{"user": user}, bson.M{"$set": bson.M{
+		"user_role":   role,
+		"user_groups": groups,
+	}})
+	if err != nil {
+		return fmt.Errorf("failed to update tokens: %w", err)
+	}
+	return nil
+}
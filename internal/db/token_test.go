@@ -0,0 +1,52 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package db_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/models"
+)
+
+func TestTokens(t *testing.T) {
+	ctx := context.Background()
+	s := prepare(ctx, t)
+
+	tk := &models.Token{User: "test", Name: "ci", Hash: "hash", Scope: "read"}
+	if err := s.StoreToken(ctx, tk); err != nil {
+		t.Fatalf("StoreToken failed with err: %v", err)
+	}
+	t.Cleanup(func() { s.DeleteToken(ctx, tk.ID, "") })
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if err := s.TouchToken(ctx, tk.ID, now); err != nil {
+		t.Fatalf("TouchToken failed with err: %v", err)
+	}
+	got, err := s.FetchToken(ctx, "hash")
+	if err != nil {
+		t.Fatalf("FetchToken failed with err: %v", err)
+	}
+	if got.ID != tk.ID || !got.LastUsed.Equal(now) {
+		t.Fatalf("unexpected token: %+v", got)
+	}
+
+	ts, err := s.FetchTokens(ctx, "test")
+	if err != nil || len(ts) != 1 {
+		t.Fatalf("FetchTokens returns %v, %v", ts, err)
+	}
+	if err := s.DeleteToken(ctx, tk.ID, "other"); !errors.Is(err, db.ErrTokenNotFound) {
+		t.Fatalf("token of another user is deleted: %v", err)
+	}
+	if err := s.DeleteToken(ctx, tk.ID, "test"); err != nil {
+		t.Fatalf("DeleteToken failed with err: %v", err)
+	}
+	if _, err := s.FetchToken(ctx, "hash"); !errors.Is(err, db.ErrTokenNotFound) {
+		t.Fatalf("deleted token is found: %v", err)
+	}
+}
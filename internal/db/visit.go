@@ -6,29 +6,128 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"changkun.de/x/redir/internal/models"
-	"changkun.de/x/redir/internal/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// RecordVisit records a visit event. If the visit is a new user, it returns
-// and ID to set a cookie to the user.
-func (db *Store) RecordVisit(ctx context.Context, v *models.Visit) (string, error) {
+// RecordVisit records a visit event. Anonymous visits and the visits of
+// visitors who did not accept the visitor cookie are recorded without a
+// visitor ID.
+func (db *Store) RecordVisit(ctx context.Context, v *models.Visit) error {
 	col := db.cli.Database(dbname).Collection(colvisit)
 
-	// if visitor ID does not present, then generate a new visitor ID.
-	if v.VisitorID == "" {
-		id, err := utils.NewUUID()
+	HashVisitor(v)
+	_, err := col.InsertOne(ctx, v)
+	if err != nil {
+		return fmt.Errorf("failed to insert record: %w", err)
+	}
+	return nil
+}
+
+// FetchVisits returns all visit records of the given visitor ID.
+func (db *Store) FetchVisits(ctx context.Context, vid string) ([]models.Visit, error) {
+	col := db.cli.Database(dbname).Collection(colvisit)
+
+	cur, err := col.Find(ctx, bson.M{"visitor_id": vid},
+		options.Find().SetSort(bson.M{"time": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	vs := []models.Visit{}
+	if err := cur.All(ctx, &vs); err != nil {
+		return nil, fmt.Errorf("failed to fetch visits: %w", err)
+	}
+	return vs, nil
+}
+
+// EraseVisits deletes all visit records of the given visitor ID or the
+// given (pseudonymized) IP address, and returns the number of deleted
+// records. Empty arguments are ignored.
+func (db *Store) EraseVisits(ctx context.Context, vid, ip string) (int64, error) {
+	matches := []bson.M{}
+	if vid != "" {
+		matches = append(matches, bson.M{"visitor_id": vid})
+	}
+	if ip != "" {
+		matches = append(matches, bson.M{"ip": ip})
+	}
+	if len(matches) == 0 {
+		return 0, errors.New("missing visitor ID or IP address")
+	}
+
+	col := db.cli.Database(dbname).Collection(colvisit)
+	ret, err := col.DeleteMany(ctx, bson.M{"$or": matches})
+	if err != nil {
+		return 0, fmt.Errorf("failed to erase visits: %w", err)
+	}
+	return ret.DeletedCount, nil
+}
+
+// BackfillVisits iterates over all non-anonymous visit records that miss
+// the given field, calls fill to complete each of them, and stores the
+// completed records. It returns the number of updated records.
+func (db *Store) BackfillVisits(
+	ctx context.Context,
+	field string,
+	fill func(v *models.Visit),
+) (int64, error) {
+	col := db.cli.Database(dbname).Collection(colvisit)
+
+	cur, err := col.Find(ctx, bson.M{
+		field:       bson.M{"$exists": false},
+		"anonymous": bson.M{"$ne": true},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to find visits: %w", err)
+	}
+	defer cur.Close(ctx)
+
+	var n int64
+	updates := []mongo.WriteModel{}
+	flush := func() error {
+		if len(updates) == 0 {
+			return nil
+		}
+		ret, err := col.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
 		if err != nil {
-			panic(err) // impossible unless system error.
+			return fmt.Errorf("failed to update visits: %w", err)
 		}
-		v.VisitorID = id.String()
+		n += ret.ModifiedCount
+		updates = updates[:0]
+		return nil
 	}
 
-	_, err := col.InsertOne(ctx, v)
-	if err != nil {
-		return "", fmt.Errorf("failed to insert record: %w", err)
+	for cur.Next(ctx) {
+		var v models.Visit
+		if err := cur.Decode(&v); err != nil {
+			return n, fmt.Errorf("failed to decode visit: %w", err)
+		}
+		id, err := primitive.ObjectIDFromHex(v.ID)
+		if err != nil {
+			return n, err
+		}
+		fill(&v)
+		v.ID = ""
+		updates = append(updates, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": id}).
+			SetUpdate(bson.M{"$set": v}))
+
+		if len(updates) >= 1000 {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return n, fmt.Errorf("failed to iterate visits: %w", err)
 	}
-	return v.VisitorID, nil
+	return n, flush()
 }
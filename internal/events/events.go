@@ -0,0 +1,119 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package events implements an in-memory broker that fans out visit
+// events to multiple subscribers.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Visit is the event of a recorded visit.
+type Visit struct {
+	Alias   string    `json:"alias"`
+	Time    time.Time `json:"time"`
+	Referer string    `json:"referer,omitempty"` // normalized referer host
+	Country string    `json:"country,omitempty"`
+	Bot     bool      `json:"bot"`
+}
+
+// bufferSize is the number of events that can be buffered for a
+// subscriber before events are dropped.
+const bufferSize = 64
+
+// Broker fans out the published events to all subscribers.
+// A zero Broker is ready to use.
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[*Subscription]struct{}
+	closed bool
+}
+
+// Subscription receives the events of a broker.
+type Subscription struct {
+	// C delivers the events. It is closed when the subscription is
+	// canceled.
+	C <-chan Visit
+
+	c       chan Visit
+	alias   string
+	dropped uint64
+}
+
+// Dropped returns the number of events that were dropped because the
+// subscriber was not fast enough.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Subscribe subscribes the events of the given alias, or all events
+// if alias is empty. The subscription is already canceled if the broker
+// is closed.
+func (b *Broker) Subscribe(alias string) *Subscription {
+	c := make(chan Visit, bufferSize)
+	s := &Subscription{C: c, c: c, alias: alias}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(c)
+		return s
+	}
+	if b.subs == nil {
+		b.subs = map[*Subscription]struct{}{}
+	}
+	b.subs[s] = struct{}{}
+	return s
+}
+
+// Unsubscribe cancels the given subscription and closes its channel.
+// It is safe to unsubscribe a subscription more than once.
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[s]; ok {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Publish sends the event to all interested subscribers. It never blocks:
+// if the buffer of a subscriber is full, the event is dropped for the
+// subscriber.
+func (b *Broker) Publish(e Visit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subs {
+		if s.alias != "" && s.alias != e.Alias {
+			continue
+		}
+		select {
+		case s.c <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Close cancels all subscriptions and rejects new subscriptions, so that
+// subscribers stop on shutdown.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subs {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
+
+// Len returns the number of subscribers.
+func (b *Broker) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
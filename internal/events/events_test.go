@@ -0,0 +1,85 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package events_test
+
+import (
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/events"
+)
+
+func TestBroker(t *testing.T) {
+	var b events.Broker
+	all := b.Subscribe("")
+	one := b.Subscribe("a")
+	if b.Len() != 2 {
+		t.Fatalf("broker has %d subscribers, want 2", b.Len())
+	}
+
+	b.Publish(events.Visit{Alias: "a", Time: time.Now()})
+	b.Publish(events.Visit{Alias: "b", Time: time.Now()})
+
+	for _, want := range []string{"a", "b"} {
+		if e := <-all.C; e.Alias != want {
+			t.Fatalf("all subscription receives %s, want %s", e.Alias, want)
+		}
+	}
+	if e := <-one.C; e.Alias != "a" {
+		t.Fatalf("alias subscription receives %s, want a", e.Alias)
+	}
+	select {
+	case e := <-one.C:
+		t.Fatalf("alias subscription receives unexpected event %+v", e)
+	default:
+	}
+
+	b.Unsubscribe(one)
+	b.Unsubscribe(one)
+	if _, ok := <-one.C; ok {
+		t.Fatalf("subscription channel is not closed")
+	}
+	if b.Len() != 1 {
+		t.Fatalf("broker has %d subscribers, want 1", b.Len())
+	}
+}
+
+func TestBrokerNonBlocking(t *testing.T) {
+	var b events.Broker
+	s := b.Subscribe("")
+	defer b.Unsubscribe(s)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			b.Publish(events.Visit{Alias: "a"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("publish blocks on a slow subscriber")
+	}
+	if s.Dropped() == 0 {
+		t.Fatalf("slow subscriber should drop events")
+	}
+}
+
+func TestBrokerClose(t *testing.T) {
+	var b events.Broker
+	s := b.Subscribe("")
+	b.Close()
+	if _, ok := <-s.C; ok {
+		t.Fatalf("subscription is not canceled by close")
+	}
+	if _, ok := <-b.Subscribe("").C; ok {
+		t.Fatalf("subscription after close is not canceled")
+	}
+	if b.Len() != 0 {
+		t.Fatalf("closed broker has %d subscribers, want 0", b.Len())
+	}
+	b.Publish(events.Visit{Alias: "a"}) // must not panic
+}
@@ -0,0 +1,383 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package geoip implements a reader of local MaxMind DB (.mmdb) files,
+// such as the GeoLite2 and DB-IP databases, for offline IP geolocation.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the file format.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+var (
+	metaMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+	errInvalidDB = errors.New("invalid MaxMind DB")
+)
+
+// Location is the geolocation of an IP address.
+type Location struct {
+	Country string // ISO 3166-1 alpha-2 code, e.g. DE
+	City    string // English city name, e.g. Munich
+}
+
+// Reader looks up IP addresses from a MaxMind DB.
+type Reader struct {
+	buf        []byte
+	data       []byte // data section
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // the node of ::/96 in an IPv6 tree
+}
+
+// Open reads the MaxMind DB of the given path into memory.
+func Open(path string) (*Reader, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read MaxMind DB: %w", err)
+	}
+	return New(b)
+}
+
+// New creates a reader from the content of a MaxMind DB.
+func New(b []byte) (*Reader, error) {
+	i := bytes.LastIndex(b, metaMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: missing metadata", errInvalidDB)
+	}
+	d := decoder{buf: b[i+len(metaMarker):]}
+	v, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDB, err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", errInvalidDB)
+	}
+
+	r := &Reader{buf: b}
+	for k, dst := range map[string]*uint{
+		"node_count":  &r.nodeCount,
+		"record_size": &r.recordSize,
+		"ip_version":  &r.ipVersion,
+	} {
+		n, ok := meta[k].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%w: missing %s in metadata", errInvalidDB, k)
+		}
+		*dst = uint(n)
+	}
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d", errInvalidDB, r.recordSize)
+	}
+
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%w: truncated search tree", errInvalidDB)
+	}
+	r.data = b[treeSize+16 : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for j := 0; j < 96 && node < r.nodeCount; j++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// Locate returns the country and city of the given IP address. An empty
+// location is returned if the IP address is not found, including if it
+// is invalid or cannot be looked up in the database, such as an IPv6
+// address in an IPv4 database. An error is only returned if the database
+// is corrupted.
+func (r *Reader) Locate(ip string) (Location, error) {
+	v, err := r.Lookup(net.ParseIP(ip))
+	if err != nil || v == nil {
+		return Location{}, err
+	}
+
+	var loc Location
+	for _, k := range []string{"country", "registered_country"} {
+		if c, ok := lookupPath(v, k, "iso_code").(string); ok {
+			loc.Country = c
+			break
+		}
+	}
+	if c, ok := lookupPath(v, "city", "names", "en").(string); ok {
+		loc.City = c
+	}
+	return loc, nil
+}
+
+// Lookup returns the data record of the given IP address, or nil if the
+// IP address is not found, see Locate.
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	if ip == nil {
+		return nil, nil // invalid IP address
+	}
+
+	node, bits := uint(0), 128
+	if v4 := ip.To4(); v4 != nil {
+		ip, bits = v4, 32
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil // IPv6 address in an IPv4 database
+	}
+
+	for i := 0; i < bits && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node = r.record(node, bit)
+	}
+	if node <= r.nodeCount {
+		return nil, nil // not found
+	}
+
+	off := node - r.nodeCount - 16
+	d := decoder{buf: r.data}
+	v, _, err := d.decode(off)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidDB, err)
+	}
+	m, _ := v.(map[string]interface{})
+	return m, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node, bit uint) uint {
+	size := r.recordSize * 2 / 8
+	b := r.buf[node*size : (node+1)*size]
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		b = b[bit*4:]
+		return uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+}
+
+func lookupPath(v interface{}, path ...string) interface{} {
+	for _, k := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// Data types of the data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth is the maximum nesting depth of maps, arrays and pointers of
+// a value, which protects the decoder from corrupt or self-referencing
+// data.
+const maxDepth = 32
+
+// decoder decodes the values of a data section.
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at the given offset, and returns the value
+// and the offset of the next value. Integers are decoded as uint64
+// except int32, and uint128 is decoded as bytes.
+func (d *decoder) decode(off uint) (interface{}, uint, error) {
+	return d.value(off, 0)
+}
+
+// value is like decode, where depth is the nesting depth of the value.
+func (d *decoder) value(off, depth uint) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data is nested too deeply")
+	}
+	typ, size, off, err := d.control(off)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typ == typePointer {
+		p, next, err := d.pointer(size, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A pointer must not point to another pointer.
+		if t, _, _, err := d.control(p); err == nil && t == typePointer {
+			return nil, 0, errors.New("pointer points to a pointer")
+		}
+		v, _, err := d.value(p, depth+1)
+		return v, next, err
+	}
+
+	// Every key and value takes at least one byte, check the size before
+	// allocating for it.
+	remaining := uint(len(d.buf)) - off
+	switch typ {
+	case typeMap:
+		if size > remaining/2 {
+			return nil, 0, errors.New("map size exceeds the data")
+		}
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.value(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			m[key], off, err = d.value(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case typeArray:
+		if size > remaining {
+			return nil, 0, errors.New("array size exceeds the data")
+		}
+		a := make([]interface{}, size)
+		for i := range a {
+			a[i], off, err = d.value(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b := d.buf[off : off+size]
+	next := off + size
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes, typeUint128:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(uint64(uintN(b))), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(uint32(uintN(b)))), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		return uintN(b), next, nil
+	case typeInt32:
+		return int(int32(uint32(uintN(b)))), next, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
+
+// control decodes the control byte(s) at the given offset, and returns
+// the type, the size, and the offset of the payload.
+func (d *decoder) control(off uint) (typ, size, next uint, err error) {
+	if off >= uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	ctrl := d.buf[off]
+	off++
+
+	typ = uint(ctrl >> 5)
+	if typ == typeExtended {
+		if off >= uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("unexpected end of data")
+		}
+		typ = 7 + uint(d.buf[off])
+		off++
+	}
+	size = uint(ctrl & 0x1f)
+	if typ == typePointer || size < 29 {
+		return typ, size, off, nil
+	}
+
+	n := size - 28 // bytes that follow
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("unexpected end of data")
+	}
+	ext := uint(uintN(d.buf[off : off+n]))
+	switch size {
+	case 29:
+		size = 29 + ext
+	case 30:
+		size = 285 + ext
+	default:
+		size = 65821 + ext
+	}
+	return typ, size, off + n, nil
+}
+
+// pointer decodes a pointer, where size is the lower five bits of the
+// control byte, and returns the pointed offset and the offset of the
+// next value.
+func (d *decoder) pointer(size, off uint) (uint, uint, error) {
+	n := (size>>3)&0x3 + 1
+	if off+n > uint(len(d.buf)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	p := uint(uintN(d.buf[off : off+n]))
+	switch n {
+	case 1:
+		p |= (size & 0x7) << 8
+	case 2:
+		p = p | (size&0x7)<<16 + 2048
+	case 3:
+		p = p | (size&0x7)<<24 + 526336
+	}
+	return p, off + n, nil
+}
+
+func uintN(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package geoip_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"changkun.de/x/redir/internal/geoip"
+)
+
+// The following helpers encode values of the MaxMind DB data section.
+
+func str(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func uint16v(n uint16) []byte {
+	return []byte{5<<5 | 2, byte(n >> 8), byte(n)}
+}
+
+func uint32v(n uint32) []byte {
+	return []byte{6<<5 | 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+
+func pointer(p int) []byte {
+	return []byte{1<<5 | byte(p>>8)&0x7, byte(p)}
+}
+
+func kvs(pairs ...[]byte) []byte {
+	b := []byte{7<<5 | byte(len(pairs)/2)}
+	for _, p := range pairs {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// node encodes a node of the search tree.
+func node(size int, left, right uint32) []byte {
+	switch size {
+	case 24:
+		return []byte{
+			byte(left >> 16), byte(left >> 8), byte(left),
+			byte(right >> 16), byte(right >> 8), byte(right),
+		}
+	case 28:
+		return []byte{
+			byte(left >> 16), byte(left >> 8), byte(left),
+			byte(left>>20)&0xf0 | byte(right>>24)&0x0f,
+			byte(right >> 16), byte(right >> 8), byte(right),
+		}
+	default:
+		return []byte{
+			byte(left >> 24), byte(left >> 16), byte(left >> 8), byte(left),
+			byte(right >> 24), byte(right >> 16), byte(right >> 8), byte(right),
+		}
+	}
+}
+
+// newDB builds an IPv4 database where only 81.0.0.0/8 is located.
+func newDB(size int) []byte {
+	// The country code is stored once and referenced by a pointer.
+	data := str("DE")
+	rec := len(data)
+	data = append(data, kvs(
+		str("country"), kvs(str("iso_code"), pointer(0)),
+		str("city"), kvs(str("names"), kvs(str("en"), str("Munich"))),
+	)...)
+	return newDBWith(size, data, rec)
+}
+
+// newDBWith builds an IPv4 database where 81.0.0.0/8 is located at the
+// record at offset rec of the given data section.
+func newDBWith(size int, data []byte, rec int) []byte {
+	const prefix = 81
+	const nodeCount = 8
+	var tree []byte
+	for i := 0; i < nodeCount; i++ {
+		next := uint32(i + 1)
+		if i == nodeCount-1 {
+			next = uint32(nodeCount + 16 + rec)
+		}
+		left, right := next, uint32(nodeCount)
+		if prefix>>(7-i)&1 == 1 {
+			left, right = right, left
+		}
+		tree = append(tree, node(size, left, right)...)
+	}
+
+	var b bytes.Buffer
+	b.Write(tree)
+	b.Write(make([]byte, 16))
+	b.Write(data)
+	b.WriteString("\xab\xcd\xefMaxMind.com")
+	b.Write(kvs(
+		str("node_count"), uint32v(nodeCount),
+		str("record_size"), uint16v(uint16(size)),
+		str("ip_version"), uint16v(4),
+		str("database_type"), str("Test"),
+		str("binary_format_major_version"), uint16v(2),
+	))
+	return b.Bytes()
+}
+
+func TestLocate(t *testing.T) {
+	for _, size := range []int{24, 28, 32} {
+		t.Run(fmt.Sprintf("record-%d", size), func(t *testing.T) {
+			r, err := geoip.New(newDB(size))
+			if err != nil {
+				t.Fatalf("cannot open database: %v", err)
+			}
+
+			tests := []struct {
+				ip   string
+				want geoip.Location
+			}{
+				{"81.2.69.142", geoip.Location{Country: "DE", City: "Munich"}},
+				{"81.255.255.255", geoip.Location{Country: "DE", City: "Munich"}},
+				{"80.2.69.142", geoip.Location{}},
+				{"127.0.0.1", geoip.Location{}},
+			}
+			for _, tt := range tests {
+				got, err := r.Locate(tt.ip)
+				if err != nil {
+					t.Fatalf("Locate(%s) failed: %v", tt.ip, err)
+				}
+				if got != tt.want {
+					t.Fatalf("Locate(%s) = %+v, want %+v", tt.ip, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocateInvalid(t *testing.T) {
+	r, err := geoip.New(newDB(24))
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	for _, ip := range []string{"", "not an ip", "2001:db8::1"} {
+		loc, err := r.Locate(ip)
+		if err != nil || loc != (geoip.Location{}) {
+			t.Fatalf("Locate(%q) = %+v, %v, want not found", ip, loc, err)
+		}
+	}
+}
+
+func TestLocateCorrupt(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"pointer to itself", pointer(0)},
+		{"map containing itself", kvs(str("a"), pointer(0))},
+		{"huge map", []byte{7<<5 | 31, 0xff, 0xff, 0xff}},
+		{"huge array", []byte{31, 4, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := geoip.New(newDBWith(24, tt.data, 0))
+			if err != nil {
+				t.Fatalf("cannot open database: %v", err)
+			}
+			if _, err := r.Locate("81.2.69.142"); err == nil {
+				t.Fatalf("Locate succeeded on corrupt data")
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(f, newDB(24), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r, err := geoip.Open(f)
+	if err != nil {
+		t.Fatalf("cannot open database: %v", err)
+	}
+	m, err := r.Lookup(net.ParseIP("81.0.0.1"))
+	if err != nil || m == nil {
+		t.Fatalf("Lookup failed: %v, %v", m, err)
+	}
+
+	if _, err := geoip.Open(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatalf("Open should fail on missing file")
+	}
+	if _, err := geoip.New([]byte("not a database")); err == nil {
+		t.Fatalf("New should fail on invalid database")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package hll implements the HyperLogLog algorithm for approximately
+// counting distinct elements in constant memory.
+package hll
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Sketch is a HyperLogLog sketch. The standard error of the estimated
+// cardinality is about 1.04/sqrt(2^p) for precision p, and the sketch
+// uses 2^p bytes of memory.
+type Sketch struct {
+	p   uint8
+	reg []uint8
+}
+
+// New creates a new sketch of the given precision, which is clamped to
+// the range of [4, 16].
+func New(p uint8) *Sketch {
+	p = clamp(p)
+	return &Sketch{p: p, reg: make([]uint8, 1<<p)}
+}
+
+func clamp(p uint8) uint8 {
+	if p < 4 {
+		return 4
+	}
+	if p > 16 {
+		return 16
+	}
+	return p
+}
+
+// Add adds an element to the sketch.
+func (s *Sketch) Add(b []byte) {
+	idx, rho := Register(s.p, b)
+	if rho > s.reg[idx] {
+		s.reg[idx] = rho
+	}
+}
+
+// Register returns the index of the register that an element updates
+// in a sketch of precision p, and the value that it is updated to.
+// Registers allow to build a sketch elsewhere, e.g. in a database, which
+// is then estimated by Estimate.
+func Register(p uint8, b []byte) (idx uint32, rho uint8) {
+	p = clamp(p)
+	h := fnv.New64a()
+	h.Write(b)
+	x := mix(h.Sum64())
+
+	w := x<<p | 1<<(p-1) // guard bit so that rho is bounded
+	return uint32(x >> (64 - p)), uint8(bits.LeadingZeros64(w)) + 1
+}
+
+// AddString adds a string element to the sketch.
+func (s *Sketch) AddString(v string) {
+	s.Add([]byte(v))
+}
+
+// Merge merges the other sketch into s, such that s estimates the
+// cardinality of the union of both. Both sketches must have the same
+// precision, otherwise Merge panics.
+func (s *Sketch) Merge(o *Sketch) {
+	if s.p != o.p {
+		panic("hll: merge sketches of different precision")
+	}
+	for i, r := range o.reg {
+		if r > s.reg[i] {
+			s.reg[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct elements.
+func (s *Sketch) Count() uint64 {
+	sum, n := 0.0, 0
+	for _, r := range s.reg {
+		if r > 0 {
+			sum += 1 / float64(uint64(1)<<r)
+			n++
+		}
+	}
+	return Estimate(s.p, sum, n)
+}
+
+// Estimate returns the estimated number of distinct elements of a sketch
+// of precision p, whose n non-zero registers r sum up to sum of 2^-r.
+func Estimate(p uint8, sum float64, n int) uint64 {
+	m := float64(uint64(1) << clamp(p))
+	zeros := int(m) - n
+	sum += float64(zeros) // 2^-0 of each zero register
+	est := alpha(m) * m * m / sum
+
+	// Use linear counting for small cardinalities.
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return uint64(est + 0.5)
+}
+
+func alpha(m float64) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	default:
+		return 0.7213 / (1 + 1.079/m)
+	}
+}
+
+// mix is the finalizer of MurmurHash3, which improves the distribution
+// of the low quality bits of FNV.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
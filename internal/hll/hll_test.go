@@ -0,0 +1,61 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package hll_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"changkun.de/x/redir/internal/hll"
+)
+
+func TestCount(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		s := hll.New(12)
+		for i := 0; i < n; i++ {
+			s.AddString(fmt.Sprintf("visitor-%d", i))
+			s.AddString(fmt.Sprintf("visitor-%d", i)) // duplicates
+		}
+		got := float64(s.Count())
+		if math.Abs(got-float64(n)) > 0.05*float64(n)+0.5 {
+			t.Fatalf("Count() of %d distinct elements, got %v", n, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	s1, s2 := hll.New(12), hll.New(12)
+	for i := 0; i < 20000; i++ {
+		s1.AddString(fmt.Sprintf("visitor-%d", i))
+		s2.AddString(fmt.Sprintf("visitor-%d", i+10000))
+	}
+	s1.Merge(s2)
+	got := float64(s1.Count())
+	if math.Abs(got-30000) > 0.05*30000 {
+		t.Fatalf("Count() of merged sketch want about 30000, got %v", got)
+	}
+}
+
+func TestEstimate(t *testing.T) {
+	s := hll.New(12)
+	reg := map[uint32]uint8{}
+	for i := 0; i < 50000; i++ {
+		b := []byte(fmt.Sprintf("visitor-%d", i))
+		s.Add(b)
+		idx, rho := hll.Register(12, b)
+		if rho > reg[idx] {
+			reg[idx] = rho
+		}
+	}
+
+	sum := 0.0
+	for _, rho := range reg {
+		sum += math.Pow(2, -float64(rho))
+	}
+	if got, want := hll.Estimate(12, sum, len(reg)), s.Count(); got != want {
+		t.Fatalf("Estimate() of registers want %v, got %v", want, got)
+	}
+}
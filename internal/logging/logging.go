@@ -0,0 +1,230 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package logging implements structured request logging on top of
+// log/slog. Every request gets a request ID, and a logger that carries
+// the request ID is attached to the request context, so that logs of
+// handlers, short link operations and the database layer can be
+// correlated with the request.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"changkun.de/x/redir/internal/utils"
+)
+
+// RequestIDHeader is the header that propagates request IDs.
+const RequestIDHeader = "X-Request-ID"
+
+// Setup configures the default logger, which is also used by the
+// standard log package. The level is one of debug, info, warn and error,
+// and the format is either text or json.
+func Setup(level, format string) error {
+	h, err := NewHandler(os.Stderr, level, format)
+	if err != nil {
+		return err
+	}
+	// The standard logger is redirected to the default logger, which
+	// prints its own time and level.
+	log.SetPrefix("")
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// NewHandler returns a slog handler that writes to w with the given
+// level and format, see Setup.
+func NewHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
+
+type loggerKey struct{}
+
+// FromContext returns the logger of the context, or the default logger
+// if the context does not carry a logger.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// NewContext returns a copy of ctx that carries the given logger.
+func NewContext(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+type requestKey struct{}
+
+// request holds the information of a request for the request log.
+type request struct {
+	id string
+
+	mu    sync.Mutex
+	attrs []slog.Attr
+	level *slog.Level // overrides the level of the request log if set
+}
+
+// RequestID returns the request ID of the context, or an empty string if
+// the context does not belong to a request.
+func RequestID(ctx context.Context) string {
+	if r, ok := ctx.Value(requestKey{}).(*request); ok {
+		return r.id
+	}
+	return ""
+}
+
+// AddAttrs adds attributes to the request log of the request of the
+// context, e.g. the resolved alias of a short link.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	r, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.attrs = append(r.attrs, attrs...)
+	r.mu.Unlock()
+}
+
+// SetLevel sets the level of the request log of the request of the
+// context, e.g. to log frequent health checks only at debug level.
+// Server errors are always logged at error level.
+func SetLevel(ctx context.Context, level slog.Level) {
+	r, ok := ctx.Value(requestKey{}).(*request)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	r.level = &level
+	r.mu.Unlock()
+}
+
+// Middleware wraps an http handler and returns a new handler that
+// assigns a request ID to each request and logs the request after it
+// is served.
+//
+// The request ID is propagated from the X-Request-ID header if present,
+// otherwise generated, and returned in the X-Request-ID response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		req := &request{id: requestID(r)}
+		w.Header().Set(RequestIDHeader, req.id)
+
+		l := slog.Default().With(slog.String("request_id", req.id))
+		ctx := context.WithValue(r.Context(), requestKey{}, req)
+		ctx = NewContext(ctx, l)
+
+		rw := &responseWriter{ResponseWriter: w}
+		defer func() {
+			status := rw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			req.mu.Lock()
+			level := slog.LevelInfo
+			if req.level != nil {
+				level = *req.level
+			}
+			req.mu.Unlock()
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("query", r.URL.RawQuery),
+				// The IP address is pseudonymized by the same GDPR
+				// policy as the visit records.
+				slog.String("ip", utils.ReadIP(r)),
+				slog.Int("status", status),
+				slog.Int64("bytes", rw.bytes),
+				slog.Duration("latency", time.Since(start)),
+			}
+			req.mu.Lock()
+			attrs = append(attrs, req.attrs...)
+			req.mu.Unlock()
+			l.LogAttrs(ctx, level, "request", attrs...)
+		}()
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// requestID returns the request ID of the X-Request-ID header if it is
+// reasonable, otherwise a new request ID.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id != "" && len(id) <= 128 && strings.IndexFunc(id, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c))
+	}) < 0 {
+		return id
+	}
+	u, err := utils.NewUUID()
+	if err != nil {
+		panic(err) // impossible unless system error.
+	}
+	return u.String()
+}
+
+// responseWriter captures the status code and the number of written
+// bytes of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, which is required by streaming
+// responses such as Server-Sent Events.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to access the underlying
+// response writer.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
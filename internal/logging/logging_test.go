@@ -0,0 +1,153 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package logging_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"changkun.de/x/redir/internal/logging"
+)
+
+func TestNewHandler(t *testing.T) {
+	tests := []struct {
+		level, format string
+		ok            bool
+	}{
+		{"info", "text", true},
+		{"debug", "json", true},
+		{"warn", "", true},
+		{"ERROR", "json", true},
+		{"verbose", "text", false},
+		{"info", "xml", false},
+	}
+	for _, tt := range tests {
+		_, err := logging.NewHandler(os.Stderr, tt.level, tt.format)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewHandler(%q, %q) returns err %v, want ok: %v",
+				tt.level, tt.format, err, tt.ok)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := logging.NewHandler(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("cannot create handler: %v", err)
+	}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	handler := logging.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("response writer is not a flusher")
+		}
+		logging.AddAttrs(r.Context(), slog.String("alias", "changkun"))
+		logging.FromContext(r.Context()).Info("handler")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("hello"))
+	}))
+
+	tests := []struct {
+		header string
+		want   string // empty if a new request id is expected
+	}{
+		{"abc-123", "abc-123"},
+		{"", ""},
+		{"bad id\n", ""},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		r := httptest.NewRequest(http.MethodGet, "/s/changkun?x=1", nil)
+		if tt.header != "" {
+			r.Header.Set(logging.RequestIDHeader, tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(logging.RequestIDHeader)
+		if tt.want != "" && id != tt.want {
+			t.Fatalf("request id is %q, want %q", id, tt.want)
+		}
+		if id == "" || id == tt.header && tt.want == "" {
+			t.Fatalf("request id %q is not generated", id)
+		}
+
+		var entries []map[string]interface{}
+		s := bufio.NewScanner(&buf)
+		for s.Scan() {
+			var e map[string]interface{}
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				t.Fatalf("cannot parse log entry %s: %v", s.Text(), err)
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) != 2 {
+			t.Fatalf("got %d log entries, want 2", len(entries))
+		}
+		for _, e := range entries {
+			if e["request_id"] != id {
+				t.Fatalf("log entry has request id %v, want %v", e["request_id"], id)
+			}
+		}
+
+		e := entries[1]
+		if e["msg"] != "request" || e["method"] != "GET" ||
+			e["path"] != "/s/changkun" || e["query"] != "x=1" ||
+			e["status"] != float64(http.StatusTeapot) || e["bytes"] != float64(5) ||
+			e["alias"] != "changkun" {
+			t.Fatalf("unexpected request log: %v", e)
+		}
+		if _, ok := e["latency"]; !ok {
+			t.Fatalf("request log has no latency: %v", e)
+		}
+	}
+}
+
+func TestSetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	h, err := logging.NewHandler(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("cannot create handler: %v", err)
+	}
+	old := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	})
+
+	status := http.StatusOK
+	handler := logging.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.SetLevel(r.Context(), slog.LevelDebug)
+		w.WriteHeader(status)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/s/.healthz", nil))
+	if buf.Len() != 0 {
+		t.Fatalf("debug request log is written at info level: %s", buf.String())
+	}
+
+	// Server errors are always logged.
+	status = http.StatusServiceUnavailable
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/s/.readyz", nil))
+	if !bytes.Contains(buf.Bytes(), []byte(`"level":"ERROR"`)) {
+		t.Fatalf("server error is not logged: %s", buf.String())
+	}
+}
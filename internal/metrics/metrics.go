@@ -0,0 +1,365 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package metrics implements counters, gauges and histograms that are
+// exposed in the Prometheus text exposition format.
+//
+// See https://prometheus.io/docs/instrumenting/exposition_formats/.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds, which are
+// tailored to measure the latency of network requests.
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family that writes itself in the text format.
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]collector{}}
+}
+
+// Default is the registry of the package level constructors.
+var Default = NewRegistry()
+
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", name))
+	}
+	r.metrics[name] = c
+}
+
+// WriteTo writes all metrics of the registry sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	cs := make([]collector, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		cs[i] = r.metrics[name]
+	}
+	r.mu.Unlock()
+
+	cw := &countWriter{w: bufio.NewWriter(w)}
+	for _, c := range cs {
+		c.write(cw)
+	}
+	if err := cw.w.Flush(); err != nil && cw.err == nil {
+		cw.err = err
+	}
+	return cw.n, cw.err
+}
+
+// Handler returns an HTTP handler that serves the metrics of the
+// registry.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+// Handler returns an HTTP handler that serves the default registry.
+func Handler() http.Handler { return Default.Handler() }
+
+type countWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+// vec holds the values of a metric family by label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	lvs    []string
+	value  float64   // counters and gauges
+	counts []uint64  // histograms, cumulative counts are computed on write
+	sum    float64   // histograms
+	count  uint64    // histograms
+	bounds []float64 // histograms
+}
+
+func (v *vec) get(lvs []string) *series {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d",
+			v.name, len(v.labels), len(lvs)))
+	}
+	k := strings.Join(lvs, "\xff")
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{lvs: append([]string(nil), lvs...)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+// sorted returns the series sorted by label values.
+func (v *vec) sorted() []series {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	ss := make([]series, 0, len(v.series))
+	for _, s := range v.series {
+		c := *s
+		c.counts = append([]uint64(nil), s.counts...)
+		ss = append(ss, c)
+	}
+	sort.Slice(ss, func(i, j int) bool {
+		return strings.Join(ss[i].lvs, "\xff") < strings.Join(ss[j].lvs, "\xff")
+	})
+	return ss
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct{ v *vec }
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{&vec{name: name, help: help, typ: "counter",
+		labels: labels, series: map[string]*series{}}}
+	r.register(name, c)
+	return c
+}
+
+// NewCounterVec registers a counter in the default registry.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+// Inc increases the counter of the given label values by one.
+func (c *CounterVec) Inc(lvs ...string) { c.Add(1, lvs...) }
+
+// Add increases the counter of the given label values by d, which must
+// not be negative.
+func (c *CounterVec) Add(d float64, lvs ...string) {
+	if d < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.v.mu.Lock()
+	c.v.get(lvs).value += d
+	c.v.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.v.header(w)
+	for _, s := range c.v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", c.v.name, labelPairs(c.v.labels, s.lvs), formatFloat(s.value))
+	}
+}
+
+// GaugeVec is a gauge partitioned by labels.
+type GaugeVec struct{ v *vec }
+
+// NewGaugeVec registers a gauge with the given label names.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{&vec{name: name, help: help, typ: "gauge",
+		labels: labels, series: map[string]*series{}}}
+	r.register(name, g)
+	return g
+}
+
+// NewGaugeVec registers a gauge in the default registry.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+// Set sets the gauge of the given label values.
+func (g *GaugeVec) Set(x float64, lvs ...string) {
+	g.v.mu.Lock()
+	g.v.get(lvs).value = x
+	g.v.mu.Unlock()
+}
+
+// Add adds d to the gauge of the given label values.
+func (g *GaugeVec) Add(d float64, lvs ...string) {
+	g.v.mu.Lock()
+	g.v.get(lvs).value += d
+	g.v.mu.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.v.header(w)
+	for _, s := range g.v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", g.v.name, labelPairs(g.v.labels, s.lvs), formatFloat(s.value))
+	}
+}
+
+// funcMetric is a metric without labels whose value is computed when the
+// metrics are collected.
+type funcMetric struct {
+	name, help, typ string
+	fn              func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is computed by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name, help, "gauge", fn})
+}
+
+// NewGaugeFunc registers a gauge in the default registry.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.NewGaugeFunc(name, help, fn)
+}
+
+// NewCounterFunc registers a counter whose value is computed by fn. The
+// value must never decrease.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(name, &funcMetric{name, help, "counter", fn})
+}
+
+// NewCounterFunc registers a counter in the default registry.
+func NewCounterFunc(name, help string, fn func() float64) {
+	Default.NewCounterFunc(name, help, fn)
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	fmt.Fprintf(w, "%s %s\n", f.name, formatFloat(f.fn()))
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	v       *vec
+	buckets []float64
+}
+
+// NewHistogramVec registers a histogram with the given upper bounds of
+// buckets and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &HistogramVec{&vec{name: name, help: help, typ: "histogram",
+		labels: labels, series: map[string]*series{}}, b}
+	r.register(name, h)
+	return h
+}
+
+// NewHistogramVec registers a histogram in the default registry.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+// Observe adds an observation to the histogram of the given label
+// values.
+func (h *HistogramVec) Observe(x float64, lvs ...string) {
+	h.v.mu.Lock()
+	defer h.v.mu.Unlock()
+
+	s := h.v.get(lvs)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+		s.bounds = h.buckets
+	}
+	if i := sort.SearchFloat64s(h.buckets, x); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += x
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.v.header(w)
+	labels := append(append([]string(nil), h.v.labels...), "le")
+	for _, s := range h.v.sorted() {
+		var cum uint64
+		lvs := append(append([]string(nil), s.lvs...), "")
+		for i, b := range s.bounds {
+			cum += s.counts[i]
+			lvs[len(lvs)-1] = formatFloat(b)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, labelPairs(labels, lvs), cum)
+		}
+		lvs[len(lvs)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, labelPairs(labels, lvs), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.v.name, labelPairs(h.v.labels, s.lvs), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.v.name, labelPairs(h.v.labels, s.lvs), s.count)
+	}
+}
+
+func labelPairs(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, +1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package metrics_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"changkun.de/x/redir/internal/metrics"
+)
+
+func TestRegistry(t *testing.T) {
+	r := metrics.NewRegistry()
+	c := r.NewCounterVec("test_requests_total", "Total requests.", "code")
+	g := r.NewGaugeVec("test_temperature", "Current\ntemperature.")
+	h := r.NewHistogramVec("test_duration_seconds", "Request duration.", []float64{0.5, 0.1, 1}, "path")
+	r.NewGaugeFunc("test_queue_depth", "Queue depth.", func() float64 { return 3 })
+	r.NewCounterFunc("test_hits_total", "Cache hits.", func() float64 { return 42 })
+
+	c.Inc("200")
+	c.Inc("200")
+	c.Add(1.5, `5"0\0`)
+	g.Set(-2.5)
+	g.Add(1)
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(0.7, "/a")
+	h.Observe(3, "/a")
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	want := `# HELP test_duration_seconds Request duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{path="/a",le="0.1"} 2
+test_duration_seconds_bucket{path="/a",le="0.5"} 2
+test_duration_seconds_bucket{path="/a",le="1"} 3
+test_duration_seconds_bucket{path="/a",le="+Inf"} 4
+test_duration_seconds_sum{path="/a"} 3.85
+test_duration_seconds_count{path="/a"} 4
+# HELP test_hits_total Cache hits.
+# TYPE test_hits_total counter
+test_hits_total 42
+# HELP test_queue_depth Queue depth.
+# TYPE test_queue_depth gauge
+test_queue_depth 3
+# HELP test_requests_total Total requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="5\"0\\0"} 1.5
+# HELP test_temperature Current\ntemperature.
+# TYPE test_temperature gauge
+test_temperature -1.5
+`
+	if got := b.String(); got != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistryDuplicate(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounterVec("test_total", "")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("registering a duplicate metric should panic")
+		}
+	}()
+	r.NewGaugeVec("test_total", "")
+}
+
+func TestHandler(t *testing.T) {
+	r := metrics.NewRegistry()
+	r.NewCounterVec("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	if !strings.Contains(w.Body.String(), "test_total 1\n") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
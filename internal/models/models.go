@@ -10,6 +10,10 @@ import (
 
 // Redir is the core redir model, it records a kind of alias
 // and its correlated link.
+//
+// The owner of a link can modify it, and so can the members of its
+// group if it is shared with a group. Links that were created before
+// owners existed are owned by their creator.
 type Redir struct {
 	ID        string    `json:"-"          yaml:"-"          bson:"_id"`
 	Alias     string    `json:"alias"      yaml:"alias"      bson:"alias"`
@@ -17,12 +21,39 @@ type Redir struct {
 	Private   bool      `json:"private"    yaml:"private"    bson:"private"`
 	Trust     bool      `json:"trust"      yaml:"trust"      bson:"trust"`
 	ValidFrom time.Time `json:"valid_from" yaml:"valid_from" bson:"valid_from"`
+	Owner     string    `json:"owner"      yaml:"owner"      bson:"owner"`
+	Group     string    `json:"group"      yaml:"group"      bson:"group"`
 	CreatedBy string    `json:"created_by" yaml:"created_by" bson:"created_by"`
 	UpdatedBy string    `json:"updated_by" yaml:"updated_by" bson:"updated_by"`
 	CreatedAt time.Time `json:"-"          yaml:"created_at" bson:"created_at"`
 	UpdatedAt time.Time `json:"-" yaml:"updated_at" bson:"updated_at"`
 }
 
+// Token is an API token of a user. Only the hash of the token is
+// stored, the token itself is shown once when it is created.
+//
+// The scope limits the operations of the token, and a non-empty prefix
+// limits the aliases that the token can access. A zero ExpiresAt never
+// expires. The token acts with the given role and groups of its user.
+type Token struct {
+	ID        string    `json:"id"         bson:"_id,omitempty"`
+	Name      string    `json:"name"       bson:"name"`
+	User      string    `json:"user"       bson:"user"`
+	Hash      string    `json:"-"          bson:"hash"`
+	Scope     string    `json:"scope"      bson:"scope"`
+	Prefix    string    `json:"prefix"     bson:"prefix"`
+	Role      string    `json:"role"       bson:"role"`
+	Groups    []string  `json:"groups"     bson:"groups"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+	LastUsed  time.Time `json:"last_used"  bson:"last_used"`
+
+	// UserRole and UserGroups are the role and groups of the user at
+	// the latest OIDC login, which limit those of the token.
+	UserRole   string   `json:"-" bson:"user_role,omitempty"`
+	UserGroups []string `json:"-" bson:"user_groups,omitempty"`
+}
+
 // RedirIndex is an extension to Redir, which offers more statistic
 // information such as PV/UV.
 type RedirIndex struct {
@@ -32,6 +63,8 @@ type RedirIndex struct {
 	Private   bool      `json:"private"    yaml:"private"    bson:"private"`
 	Trust     bool      `json:"trust"      yaml:"trust"      bson:"trust"`
 	ValidFrom time.Time `json:"valid_from" yaml:"valid_from" bson:"valid_from"`
+	Owner     string    `json:"owner"      yaml:"owner"      bson:"owner"`
+	Group     string    `json:"group"      yaml:"group"      bson:"group"`
 	CreatedBy string    `json:"created_by" yaml:"created_by" bson:"created_by"`
 	UpdatedBy string    `json:"updated_by" yaml:"updated_by" bson:"updated_by"`
 	CreatedAt time.Time `json:"-"          yaml:"created_at" bson:"created_at"`
@@ -41,13 +74,44 @@ type RedirIndex struct {
 }
 
 // Visit indicates an record of visit pattern.
+//
+// An anonymous visit only counts a visit, it does not contain any
+// information about the visitor. A bot visit is a visit that is likely
+// sent by a bot, such as link previewers or crawlers.
+//
+// The browser, OS and device fields are parsed from the UA when the
+// visit is recorded, and the referer host and class are normalized from
+// the referer. The country and city are looked up from the IP
+// address before it is pseudonymized, if a GeoIP database is configured.
 type Visit struct {
-	VisitorID string    `json:"visitor_id" bson:"visitor_id"`
-	Alias     string    `json:"alias"      bson:"alias"`
-	IP        string    `json:"ip"         bson:"ip"`
-	UA        string    `json:"ua"         bson:"ua"`
-	Referer   string    `json:"referer"    bson:"referer"`
-	Time      time.Time `json:"time"       bson:"time"`
+	ID             string    `json:"-"               bson:"_id,omitempty"`
+	VisitorID      string    `json:"visitor_id"      bson:"visitor_id"`
+	Alias          string    `json:"alias"           bson:"alias"`
+	IP             string    `json:"ip"              bson:"ip"`
+	UA             string    `json:"ua"              bson:"ua"`
+	Referer        string    `json:"referer"         bson:"referer"`
+	Time           time.Time `json:"time"            bson:"time"`
+	Anonymous      bool      `json:"anonymous"       bson:"anonymous,omitempty"`
+	Bot            bool      `json:"bot"             bson:"bot,omitempty"`
+	Browser        string    `json:"browser"         bson:"browser,omitempty"`
+	BrowserVersion string    `json:"browser_version" bson:"browser_version,omitempty"`
+	OS             string    `json:"os"              bson:"os,omitempty"`
+	Device         string    `json:"device"          bson:"device,omitempty"`
+	RefererHost    string    `json:"referer_host"    bson:"referer_host,omitempty"`
+	RefererClass   string    `json:"referer_class"   bson:"referer_class,omitempty"`
+	Country        string    `json:"country"         bson:"country,omitempty"`
+	City           string    `json:"city"            bson:"city,omitempty"`
+	UVHash         *UVHash   `json:"-"               bson:"uv_hash,omitempty"`
+}
+
+// UVHash holds the HyperLogLog registers of the unique visitor of a
+// visit for each way of identifying unique visitors, so that UVs can be
+// estimated in the database. A register is encoded as index<<6 | rank,
+// and is zero if the visitor cannot be identified.
+type UVHash struct {
+	VID         int32 `bson:"vid,omitempty"`
+	IP          int32 `bson:"ip,omitempty"`
+	Fingerprint int32 `bson:"fingerprint,omitempty"`
 }
 
 // VisitRecord represents the visit record of an alias.
@@ -65,15 +129,44 @@ type RefStat struct {
 	Count   int64  `json:"count"   bson:"count"`
 }
 
+// RefererDomainStat counts visits by the normalized referer host.
+type RefererDomainStat struct {
+	Host  string `json:"host"  bson:"host"`
+	Class string `json:"class" bson:"class"`
+	Count int64  `json:"count" bson:"count"`
+}
+
 // UAStat statistics
 type UAStat struct {
 	UA    string `json:"ua"    bson:"ua"`
 	Count int64  `json:"count" bson:"count"`
 }
 
+// NameStat counts visits by a name, such as browser, OS, device or
+// country.
+type NameStat struct {
+	Name  string `json:"name"  bson:"name"`
+	Count int64  `json:"count" bson:"count"`
+}
+
 // TimeHist statistics
 type TimeHist struct {
 	Time time.Time `bson:"time" json:"time"`
 	PV   int       `bson:"pv"   json:"pv"`
 	UV   int       `bson:"uv"   json:"uv"`
 }
+
+// LinkHist counts the links that are created in a period of time.
+type LinkHist struct {
+	Time  time.Time `bson:"time"  json:"time"`
+	Count int       `bson:"count" json:"count"`
+}
+
+// VisitDaily is a daily rollup of the visits of an alias. The rollups
+// are kept after the raw visit records are purged.
+type VisitDaily struct {
+	Alias string    `json:"alias" bson:"alias"`
+	Date  time.Time `json:"date"  bson:"date"`
+	PV    int64     `json:"pv"    bson:"pv"`
+	UV    int64     `json:"uv"    bson:"uv"`
+}
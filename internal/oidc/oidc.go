@@ -0,0 +1,366 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package oidc implements an OpenID Connect relying party, which logs
+// users in via the authorization code flow with PKCE at any compliant
+// identity provider, and keeps them logged in by a signed session
+// cookie.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie names of the session and of the login flow in progress.
+const (
+	SessionCookie = "redir_session"
+	flowCookie    = "redir_oidc"
+)
+
+// flowTTL is the maximum duration of a login at the provider.
+const flowTTL = 10 * time.Minute
+
+// ErrNoSession indicates that a request has no valid session.
+var ErrNoSession = errors.New("no valid session")
+
+// RoleMapping maps a value of the role claim to a role.
+type RoleMapping struct {
+	Value string
+	Role  string
+}
+
+// Config configures a provider.
+type Config struct {
+	// Issuer is the issuer URL of the provider, the provider is
+	// discovered at Issuer/.well-known/openid-configuration.
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the callback URL that is registered at the provider.
+	RedirectURL string
+	// Scopes are requested in addition to openid.
+	Scopes []string
+	// UserClaim names the user, it falls back to email and sub.
+	UserClaim string
+	// RoleClaim is a string or a list of strings that is mapped to a
+	// role by Roles, the first matching mapping wins. DefaultRole is
+	// used if no mapping matches, and users without a role are rejected.
+	RoleClaim   string
+	Roles       []RoleMapping
+	DefaultRole string
+	// GroupClaim is a string or a list of strings of the groups of the
+	// user.
+	GroupClaim string
+	// SessionKey signs the cookies, sessions are valid for SessionTTL.
+	SessionKey []byte
+	SessionTTL time.Duration
+}
+
+// Provider is a discovered OpenID provider.
+type Provider struct {
+	conf   Config
+	client *http.Client
+
+	issuer   string
+	authURL  string
+	tokenURL string
+	jwksURL  string
+
+	mu     sync.Mutex // protects keys
+	keys   map[string]crypto.PublicKey
+	keysAt time.Time
+}
+
+// Session is the session of a logged in user.
+type Session struct {
+	User   string    `json:"user"`
+	Role   string    `json:"role"`
+	Groups []string  `json:"groups,omitempty"`
+	Expiry time.Time `json:"exp"`
+}
+
+// New discovers the provider of the given configuration.
+func New(ctx context.Context, conf Config) (*Provider, error) {
+	if conf.Issuer == "" || conf.ClientID == "" || conf.RedirectURL == "" {
+		return nil, errors.New("missing issuer, client ID or redirect URL")
+	}
+	if len(conf.SessionKey) == 0 {
+		return nil, errors.New("missing session key")
+	}
+	p := &Provider{
+		conf:   conf,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	var d struct {
+		Issuer   string `json:"issuer"`
+		AuthURL  string `json:"authorization_endpoint"`
+		TokenURL string `json:"token_endpoint"`
+		JWKSURL  string `json:"jwks_uri"`
+	}
+	u := strings.TrimSuffix(conf.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, u, &d); err != nil {
+		return nil, fmt.Errorf("cannot discover provider: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(conf.Issuer, "/") {
+		return nil, fmt.Errorf("provider issuer %q does not match %q", d.Issuer, conf.Issuer)
+	}
+	if d.AuthURL == "" || d.TokenURL == "" || d.JWKSURL == "" {
+		return nil, errors.New("incomplete provider configuration")
+	}
+	p.issuer, p.authURL, p.tokenURL, p.jwksURL = d.Issuer, d.AuthURL, d.TokenURL, d.JWKSURL
+	return p, nil
+}
+
+// flow is the state of a login in progress, which is kept in a cookie
+// between the redirect to the provider and the callback.
+type flow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"return_to"`
+}
+
+// Login redirects the request to the provider, which redirects back to
+// the callback and then to returnTo after the user logged in.
+func (p *Provider) Login(w http.ResponseWriter, r *http.Request, returnTo string) error {
+	f := flow{
+		State:    random(),
+		Nonce:    random(),
+		Verifier: random(),
+		ReturnTo: returnTo,
+	}
+	if err := p.setCookie(w, flowCookie, f, time.Now().Add(flowTTL)); err != nil {
+		return err
+	}
+
+	challenge := sha256.Sum256([]byte(f.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.conf.ClientID},
+		"redirect_uri":          {p.conf.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, p.conf.Scopes...), " ")},
+		"state":                 {f.State},
+		"nonce":                 {f.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, p.authURL+sep+q.Encode(), http.StatusFound)
+	return nil
+}
+
+// Callback completes the login of the callback request, sets the session
+// cookie and returns the session and the URL to return to.
+func (p *Provider) Callback(w http.ResponseWriter, r *http.Request) (*Session, string, error) {
+	var f flow
+	if err := p.readCookie(r, flowCookie, &f); err != nil {
+		return nil, "", fmt.Errorf("missing or expired login: %w", err)
+	}
+	p.clearCookie(w, flowCookie)
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return nil, "", fmt.Errorf("login failed: %s %s", e, q.Get("error_description"))
+	}
+	if !subtleEqual(q.Get("state"), f.State) {
+		return nil, "", errors.New("login state does not match")
+	}
+
+	idToken, err := p.exchange(r.Context(), q.Get("code"), f.Verifier)
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	c, err := p.verify(r.Context(), idToken, f.Nonce, now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s := &Session{
+		User:   p.user(c),
+		Role:   p.role(c),
+		Groups: c.strings(p.conf.GroupClaim),
+		Expiry: now.Add(p.conf.SessionTTL),
+	}
+	if s.User == "" {
+		return nil, "", errors.New("ID token does not name a user")
+	}
+	if s.Role == "" {
+		return nil, "", fmt.Errorf("user %s has no role", s.User)
+	}
+	if err := p.setCookie(w, SessionCookie, s, s.Expiry); err != nil {
+		return nil, "", err
+	}
+	return s, f.ReturnTo, nil
+}
+
+// Session returns the session of the request.
+func (p *Provider) Session(r *http.Request) (*Session, error) {
+	var s Session
+	if err := p.readCookie(r, SessionCookie, &s); err != nil {
+		return nil, ErrNoSession
+	}
+	return &s, nil
+}
+
+// Logout ends the session of the response.
+func (p *Provider) Logout(w http.ResponseWriter) {
+	p.clearCookie(w, SessionCookie)
+}
+
+// exchange exchanges the authorization code for an ID token.
+func (p *Provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.conf.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.conf.ClientID), url.QueryEscape(p.conf.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("cannot exchange authorization code: %w", err)
+	}
+	defer resp.Body.Close()
+	var t struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Desc    string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return "", fmt.Errorf("cannot exchange authorization code: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || t.Error != "" {
+		return "", fmt.Errorf("cannot exchange authorization code: %s %s", t.Error, t.Desc)
+	}
+	if t.IDToken == "" {
+		return "", errors.New("provider responds no ID token")
+	}
+	return t.IDToken, nil
+}
+
+// user returns the user name of the given claims.
+func (p *Provider) user(c claims) string {
+	for _, name := range []string{p.conf.UserClaim, "email", "sub"} {
+		if u := c.string(name); name != "" && u != "" {
+			return u
+		}
+	}
+	return ""
+}
+
+// role maps the role claim to a role.
+func (p *Provider) role(c claims) string {
+	values := c.strings(p.conf.RoleClaim)
+	for _, m := range p.conf.Roles {
+		if contains(values, m.Value) {
+			return m.Role
+		}
+	}
+	return p.conf.DefaultRole
+}
+
+// setCookie sets a cookie of the given value, which is signed so that
+// clients cannot forge it.
+func (p *Provider) setCookie(w http.ResponseWriter, name string, v interface{}, expiry time.Time) error {
+	b, err := json.Marshal(struct {
+		V   interface{} `json:"v"`
+		Exp int64       `json:"e"`
+	}{v, expiry.Unix()})
+	if err != nil {
+		return err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    payload + "." + p.sign(name, payload),
+		Path:     "/",
+		Expires:  expiry,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(p.conf.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// readCookie verifies a cookie that is set by setCookie and decodes its
+// value.
+func (p *Provider) readCookie(r *http.Request, name string, v interface{}) error {
+	c, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	i := strings.LastIndexByte(c.Value, '.')
+	if i < 0 || !subtleEqual(c.Value[i+1:], p.sign(name, c.Value[:i])) {
+		return errors.New("invalid cookie signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(c.Value[:i])
+	if err != nil {
+		return err
+	}
+	var e struct {
+		V   json.RawMessage `json:"v"`
+		Exp int64           `json:"e"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return err
+	}
+	if time.Now().Unix() >= e.Exp {
+		return errors.New("cookie is expired")
+	}
+	return json.Unmarshal(e.V, v)
+}
+
+func (p *Provider) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, HttpOnly: true})
+}
+
+// sign signs the cookie of the given name and payload, the name is
+// signed as well so that a cookie cannot be replayed as another cookie.
+func (p *Provider) sign(name, payload string) string {
+	m := hmac.New(sha256.New, p.conf.SessionKey)
+	m.Write([]byte(name + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func subtleEqual(a, b string) bool {
+	return hmac.Equal([]byte(a), []byte(b))
+}
+
+// random returns a random URL-safe string.
+func random() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("oidc: cannot read random bytes: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,287 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package oidc_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/oidc"
+)
+
+// mockProvider is a minimal OpenID provider that issues an ID token of
+// the configured claims for every authorization code.
+type mockProvider struct {
+	t      *testing.T
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu        sync.Mutex
+	alg       string                 // signing algorithm, RS256 or ES256
+	claims    map[string]interface{} // claims of the next ID token
+	challenge string                 // code challenge of the authorization
+	nonce     string                 // nonce of the authorization
+	forge     bool                   // sign by a key that is not published
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	m := &mockProvider{t: t, alg: "RS256"}
+	m.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	m.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	m.srv = httptest.NewServer(http.HandlerFunc(m.serve))
+	t.Cleanup(m.srv.Close)
+	return m
+}
+
+func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+
+func (m *mockProvider) serve(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u := m.srv.URL
+	switch r.URL.Path {
+	case "/.well-known/openid-configuration":
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 u,
+			"authorization_endpoint": u + "/authorize",
+			"token_endpoint":         u + "/token",
+			"jwks_uri":               u + "/jwks",
+		})
+	case "/jwks":
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(m.rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(m.rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(m.ecKey.X.FillBytes(make([]byte, 32))),
+				"y": b64(m.ecKey.Y.FillBytes(make([]byte, 32)))},
+		}})
+	case "/token":
+		id, secret, _ := r.BasicAuth()
+		if id != "redir" || secret != "secret" || r.FormValue("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		// PKCE: the verifier must match the challenge.
+		h := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if b64(h[:]) != m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.sign()})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// sign returns an ID token of the configured claims.
+func (m *mockProvider) sign() string {
+	c := map[string]interface{}{
+		"iss":   m.srv.URL,
+		"aud":   "redir",
+		"sub":   "1234",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": m.nonce,
+	}
+	for k, v := range m.claims {
+		if v == nil {
+			delete(c, k)
+			continue
+		}
+		c[k] = v
+	}
+	kid := map[string]string{"RS256": "rsa", "ES256": "ec"}[m.alg]
+	hb, _ := json.Marshal(map[string]string{"alg": m.alg, "kid": kid, "typ": "JWT"})
+	cb, _ := json.Marshal(c)
+	input := b64(hb) + "." + b64(cb)
+	h := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch m.alg {
+	case "RS256":
+		key := m.rsaKey
+		if m.forge {
+			key, _ = rsa.GenerateKey(rand.Reader, 2048)
+		}
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, m.ecKey, h[:])
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return input + "." + b64(sig)
+}
+
+func newProvider(t *testing.T, m *mockProvider) *oidc.Provider {
+	p, err := oidc.New(context.Background(), oidc.Config{
+		Issuer:       m.srv.URL,
+		ClientID:     "redir",
+		ClientSecret: "secret",
+		RedirectURL:  "https://example.org/s/.oidc/callback",
+		Scopes:       []string{"profile", "groups"},
+		UserClaim:    "preferred_username",
+		RoleClaim:    "groups",
+		GroupClaim:   "groups",
+		Roles: []oidc.RoleMapping{
+			{Value: "redir-admins", Role: "admin"},
+			{Value: "staff", Role: "viewer"},
+		},
+		SessionKey: []byte("session key"),
+		SessionTTL: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("cannot discover provider: %v", err)
+	}
+	return p
+}
+
+// login runs a login against the mock provider and returns the callback
+// response.
+func login(t *testing.T, m *mockProvider, p *oidc.Provider, tamper func(q url.Values)) (*oidc.Session, *httptest.ResponseRecorder, error) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := p.Login(w, httptest.NewRequest(http.MethodGet, "/s/?mode=admin", nil), "/s/?mode=admin"); err != nil {
+		t.Fatalf("cannot start login: %v", err)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), m.srv.URL+"/authorize?") {
+		t.Fatalf("unexpected redirect: %v", loc)
+	}
+	aq := loc.Query()
+	if aq.Get("code_challenge_method") != "S256" || aq.Get("scope") != "openid profile groups" {
+		t.Fatalf("unexpected authorization request: %v", aq)
+	}
+	m.mu.Lock()
+	m.challenge, m.nonce = aq.Get("code_challenge"), aq.Get("nonce")
+	m.mu.Unlock()
+
+	// The provider redirects back to the callback.
+	q := url.Values{"code": {"code"}, "state": {aq.Get("state")}}
+	if tamper != nil {
+		tamper(q)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/s/.oidc/callback?"+q.Encode(), nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	s, returnTo, err := p.Callback(rec, r)
+	if err == nil && returnTo != "/s/?mode=admin" {
+		t.Fatalf("unexpected return URL: %s", returnTo)
+	}
+	return s, rec, err
+}
+
+func TestLogin(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m)
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		m.alg = alg
+		m.claims = map[string]interface{}{
+			"preferred_username": "changkun",
+			"groups":             []string{"staff", "redir-admins"},
+		}
+		s, rec, err := login(t, m, p, nil)
+		if err != nil {
+			t.Fatalf("%s: cannot login: %v", alg, err)
+		}
+		if s.User != "changkun" || s.Role != "admin" || len(s.Groups) != 2 {
+			t.Fatalf("%s: unexpected session: %+v", alg, s)
+		}
+
+		// The session cookie authenticates following requests.
+		r := httptest.NewRequest(http.MethodGet, "/s/", nil)
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == oidc.SessionCookie {
+				r.AddCookie(c)
+			}
+		}
+		got, err := p.Session(r)
+		if err != nil || got.User != "changkun" || got.Role != "admin" {
+			t.Fatalf("%s: unexpected session: %+v, %v", alg, got, err)
+		}
+	}
+}
+
+func TestLoginRejected(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m)
+
+	for _, tt := range []struct {
+		name   string
+		claims map[string]interface{}
+		tamper func(q url.Values)
+		forge  bool
+	}{
+		{"wrong state", nil, func(q url.Values) { q.Set("state", "forged") }, false},
+		{"wrong code", nil, func(q url.Values) { q.Set("code", "forged") }, false},
+		{"provider error", nil, func(q url.Values) { q.Set("error", "access_denied") }, false},
+		{"wrong nonce", map[string]interface{}{"nonce": "forged"}, nil, false},
+		{"wrong audience", map[string]interface{}{"aud": "other"}, nil, false},
+		{"wrong issuer", map[string]interface{}{"iss": "https://evil.org"}, nil, false},
+		{"expired", map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()}, nil, false},
+		{"no role", map[string]interface{}{"groups": []string{"guests"}}, nil, false},
+		{"forged signature", nil, nil, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m.forge = tt.forge
+			m.claims = map[string]interface{}{"preferred_username": "changkun", "groups": "staff"}
+			for k, v := range tt.claims {
+				m.claims[k] = v
+			}
+			if _, _, err := login(t, m, p, tt.tamper); err == nil {
+				t.Fatalf("login is not rejected")
+			}
+		})
+	}
+}
+
+func TestSessionForged(t *testing.T) {
+	m := newMockProvider(t)
+	p := newProvider(t, m)
+	m.claims = map[string]interface{}{"preferred_username": "changkun", "groups": "staff"}
+	_, rec, err := login(t, m, p, nil)
+	if err != nil {
+		t.Fatalf("cannot login: %v", err)
+	}
+
+	var c *http.Cookie
+	for _, cc := range rec.Result().Cookies() {
+		if cc.Name == oidc.SessionCookie {
+			c = cc
+		}
+	}
+	// Replace the payload with an admin session of the same signature.
+	i := strings.LastIndexByte(c.Value, '.')
+	payload, _ := json.Marshal(map[string]interface{}{
+		"v": map[string]string{"user": "changkun", "role": "admin"},
+		"e": time.Now().Add(time.Hour).Unix(),
+	})
+	c.Value = b64(payload) + c.Value[i:]
+
+	r := httptest.NewRequest(http.MethodGet, "/s/", nil)
+	r.AddCookie(c)
+	if _, err := p.Session(r); err == nil {
+		t.Fatalf("forged session is accepted")
+	}
+}
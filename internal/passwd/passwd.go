@@ -0,0 +1,63 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package passwd hashes and verifies the passwords of basic auth
+// accounts. Passwords are hashed by bcrypt, plaintext passwords are only
+// supported for compatibility.
+package passwd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DefaultCost is the default bcrypt cost of new hashes.
+const DefaultCost = bcrypt.DefaultCost
+
+// Hash returns the bcrypt hash of the given password.
+func Hash(password string, cost int) (string, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return "", fmt.Errorf("cost %d is not within [%d, %d]",
+			cost, bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	b, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Validate reports whether the given hash is a valid bcrypt hash.
+func Validate(hash string) error {
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("invalid bcrypt hash: %w", err)
+	}
+	return nil
+}
+
+// Compare reports whether the password matches the given hash.
+func Compare(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ComparePlain reports whether the password matches the given plaintext
+// password in constant time, regardless of their lengths.
+func ComparePlain(plain, password string) bool {
+	a, b := sha256.Sum256([]byte(plain)), sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// dummyHash is compared with the password of unknown users, so that
+// they take about the same time as known users.
+const dummyHash = "$2a$10$qp8zrIMLEfCNiVgHspYrnef3thMFrqP/KRpaHjlgOV1zgiKMR9Z6y"
+
+// CompareDummy compares the password with a hash that matches no
+// password, it always returns false.
+func CompareDummy(password string) bool {
+	Compare(dummyHash, password)
+	return false
+}
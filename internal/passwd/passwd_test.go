@@ -0,0 +1,48 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package passwd_test
+
+import (
+	"testing"
+
+	"changkun.de/x/redir/internal/passwd"
+)
+
+func TestHash(t *testing.T) {
+	h, err := passwd.Hash("secret", 4)
+	if err != nil {
+		t.Fatalf("cannot hash password: %v", err)
+	}
+	if err := passwd.Validate(h); err != nil {
+		t.Fatalf("invalid hash: %v", err)
+	}
+	if !passwd.Compare(h, "secret") {
+		t.Fatalf("password does not match its hash")
+	}
+	if passwd.Compare(h, "Secret") {
+		t.Fatalf("wrong password matches the hash")
+	}
+
+	if _, err := passwd.Hash("secret", 3); err == nil {
+		t.Fatalf("hash with a too low cost is created")
+	}
+	if err := passwd.Validate("secret"); err == nil {
+		t.Fatalf("plaintext is a valid hash")
+	}
+}
+
+func TestComparePlain(t *testing.T) {
+	if !passwd.ComparePlain("secret", "secret") {
+		t.Fatalf("same passwords do not match")
+	}
+	for _, p := range []string{"", "secre", "secret!", "Secret"} {
+		if passwd.ComparePlain("secret", p) {
+			t.Fatalf("password %q matches", p)
+		}
+	}
+	if passwd.CompareDummy("") || passwd.CompareDummy("redir") {
+		t.Fatalf("dummy hash matches")
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package short
+
+import (
+	"errors"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/models"
+)
+
+// ErrForbidden indicates that the actor is not allowed to edit a link.
+var ErrForbidden = errors.New("operation is not permitted")
+
+// Actor is a user who edits links.
+//
+// Viewers cannot edit links. Editors can create links, which they own,
+// and modify the links they own or that are shared with one of their
+// groups, but only the owner can transfer a link or share it with
+// another group. Admins can edit all links.
+//
+// A nil actor is the operator of the command line, who is not
+// restricted.
+type Actor struct {
+	User   string
+	Role   config.Role
+	Groups []string
+}
+
+// Owner returns the owner of the given link. Links that were created
+// before owners existed are owned by their creator.
+func Owner(r *models.Redir) string {
+	if r.Owner != "" {
+		return r.Owner
+	}
+	return r.CreatedBy
+}
+
+func (a *Actor) admin() bool {
+	return a == nil || a.Role.Allows(config.RoleAdmin)
+}
+
+func (a *Actor) canCreate() bool {
+	return a == nil || a.Role.Allows(config.RoleEditor)
+}
+
+// canModify reports whether the actor can update or delete the link.
+func (a *Actor) canModify(r *models.Redir) bool {
+	if a.admin() {
+		return true
+	}
+	if !a.Role.Allows(config.RoleEditor) {
+		return false
+	}
+	return Owner(r) == a.User || r.Group != "" && a.member(r.Group)
+}
+
+// owns reports whether the actor can transfer the link.
+func (a *Actor) owns(r *models.Redir) bool {
+	return a.admin() || a.Role.Allows(config.RoleEditor) && Owner(r) == a.User
+}
+
+// canShare reports whether the actor can share links with the group.
+func (a *Actor) canShare(group string) bool {
+	return a.admin() || group == "" || a.member(group)
+}
+
+func (a *Actor) member(group string) bool {
+	for _, g := range a.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
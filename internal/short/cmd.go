@@ -14,6 +14,7 @@ import (
 
 	"changkun.de/x/redir/internal/config"
 	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/logging"
 	"changkun.de/x/redir/internal/models"
 	"gopkg.in/yaml.v3"
 )
@@ -25,7 +26,7 @@ var (
 
 // Cmd processes the given alias and link with a specified op.
 func Cmd(ctx context.Context, operate Op, r *models.Redir) (err error) {
-	s, err := db.NewStore(ctx, config.Conf.Store)
+	s, err := db.NewStore(ctx, config.Get().Store)
 	if err != nil {
 		err = fmt.Errorf("cannot create a new alias: %w", err)
 		return
@@ -38,30 +39,40 @@ func Cmd(ctx context.Context, operate Op, r *models.Redir) (err error) {
 		}
 	}()
 
-	err = Edit(ctx, s, operate, r.Alias, r)
+	err = Edit(ctx, s, nil, operate, r.Alias, r)
 	return
 }
 
 // Edit edits the datastore for a given alias in a given operation.
 // if the operation is create, then the alias is not necessary.
-// if the operation is update/fetch/delete, then the alias is used to
-// match the existing aliases, meaning that alias can be changed.
-func Edit(ctx context.Context, s *db.Store, operate Op, a string, r *models.Redir) (err error) {
+// if the operation is update/fetch/delete/transfer, then the alias is
+// used to match the existing aliases, meaning that alias can be changed.
+//
+// The actor must be allowed to edit the link, otherwise ErrForbidden is
+// returned. An update keeps the owner and the group of the link, which
+// are only changed by a transfer to r.Owner and r.Group.
+func Edit(ctx context.Context, s *db.Store, actor *Actor, operate Op, a string, r *models.Redir) (err error) {
 	switch operate {
 	case OpCreate:
 		if !Validity.MatchString(r.Alias) {
 			err = ErrInvalidAlias
 			return
 		}
+		if !actor.canCreate() || !actor.canShare(r.Group) {
+			err = ErrForbidden
+			return
+		}
+		// Only admins create links on behalf of others.
+		if actor != nil && (r.Owner == "" || !actor.admin()) {
+			r.Owner = actor.User
+		}
 		r.CreatedBy = r.UpdatedBy
 		err = s.StoreAlias(ctx, r)
 		if err != nil {
 			return
 		}
-		log.Printf("alias %v has been created:\n", r.Alias)
-
-		prefix := config.Conf.S.Prefix
-		log.Printf("%s%s%s\n", config.Conf.Host, prefix, r.Alias)
+		logging.FromContext(ctx).Info("alias has been created", "alias", r.Alias,
+			"link", config.Get().Host+config.Get().S.Prefix+r.Alias)
 	case OpUpdate:
 		var rr *models.Redir
 
@@ -73,6 +84,10 @@ func Edit(ctx context.Context, s *db.Store, operate Op, a string, r *models.Redi
 		// use, it is fine for now.
 		rr, err = s.FetchAlias(ctx, a)
 		if err == nil {
+			if !actor.canModify(rr) {
+				err = ErrForbidden
+				return
+			}
 			// use old values if not presents
 			if r.URL == "" {
 				r.URL = rr.URL
@@ -81,6 +96,8 @@ func Edit(ctx context.Context, s *db.Store, operate Op, a string, r *models.Redi
 			if r.ValidFrom == tt {
 				r.ValidFrom = rr.ValidFrom
 			}
+			r.Owner = Owner(rr)
+			r.Group = rr.Group
 			r.ID = rr.ID
 		}
 
@@ -94,13 +111,24 @@ func Edit(ctx context.Context, s *db.Store, operate Op, a string, r *models.Redi
 		if err != nil {
 			return
 		}
-		log.Printf("alias %v has been updated.\n", a)
+		logging.FromContext(ctx).Info("alias has been updated", "alias", a)
 	case OpDelete:
+		if actor != nil {
+			var rr *models.Redir
+			rr, err = s.FetchAlias(ctx, a)
+			if err != nil {
+				return
+			}
+			if !actor.canModify(rr) {
+				err = ErrForbidden
+				return
+			}
+		}
 		err = s.DeleteAlias(ctx, a)
 		if err != nil {
 			return
 		}
-		log.Printf("alias %v has been deleted.\n", a)
+		logging.FromContext(ctx).Info("alias has been deleted", "alias", a)
 	case OpFetch:
 		var r *models.Redir
 		r, err = s.FetchAlias(ctx, a)
@@ -109,6 +137,28 @@ func Edit(ctx context.Context, s *db.Store, operate Op, a string, r *models.Redi
 		}
 		b, _ := yaml.Marshal(r)
 		log.Printf("\n%v\n", string(b))
+	case OpTransfer:
+		var rr *models.Redir
+		rr, err = s.FetchAlias(ctx, a)
+		if err != nil {
+			return
+		}
+		if !actor.owns(rr) || r.Group != rr.Group && !actor.canShare(r.Group) {
+			err = ErrForbidden
+			return
+		}
+		// An empty owner keeps the owner and only changes the group.
+		if r.Owner == "" {
+			r.Owner = Owner(rr)
+		}
+		from := Owner(rr)
+		rr.Owner, rr.Group, rr.UpdatedBy = r.Owner, r.Group, r.UpdatedBy
+		err = s.UpdateAlias(ctx, rr)
+		if err != nil {
+			return
+		}
+		logging.FromContext(ctx).Info("alias has been transferred", "alias", a,
+			"from", from, "owner", rr.Owner, "group", rr.Group)
 	}
 	return
 }
@@ -41,6 +41,8 @@ func ImportFile(fname string) {
 			URL:       info.URL,
 			Private:   info.Private,
 			ValidFrom: info.ValidFrom,
+			Owner:     info.Owner,
+			Group:     info.Group,
 		}
 
 		err = Cmd(ctx, OpUpdate, r)
@@ -58,7 +60,7 @@ func DumpFile(fname string) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
 
-	s, err := db.NewStore(ctx, config.Conf.Store)
+	s, err := db.NewStore(ctx, config.Get().Store)
 	if err != nil {
 		log.Println("cannot create a new store: %w", err)
 		return
@@ -70,7 +72,7 @@ func DumpFile(fname string) {
 	pageNum := int64(1)
 	pageSize := int64(100)
 	for {
-		idx, _, err := s.FetchAliasAll(ctx, false, pageSize, pageNum)
+		idx, _, err := s.FetchAliasAll(ctx, false, "", db.TrafficAll, pageSize, pageNum)
 		if err != nil {
 			log.Printf("cannot fetch aliases, page num: %d, page siz: %d", pageNum, pageSize)
 			return
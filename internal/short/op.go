@@ -16,12 +16,15 @@ const (
 	OpUpdate = "update"
 	// opFetch represents a fetch operation for short link
 	OpFetch = "fetch"
+	// opTransfer represents a change of the owner or the group of a
+	// short link
+	OpTransfer = "transfer"
 )
 
 // Valid checks if the given Op is valid.
 func (o Op) Valid() bool {
 	switch o {
-	case OpCreate, OpDelete, OpUpdate, OpFetch:
+	case OpCreate, OpDelete, OpUpdate, OpFetch, OpTransfer:
 		return true
 	default:
 		return false
@@ -0,0 +1,149 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stats
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/models"
+	"changkun.de/x/redir/internal/visitor"
+)
+
+// PurgeCmd previews or applies a purge of the visit records that are
+// older than the given retention days.
+func PurgeCmd(days int, apply bool) {
+	if days <= 0 {
+		log.Fatalf("invalid retention days: %d", days)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	before := Cutoff(time.Now(), days)
+	n, err := Purge(ctx, s, days, config.Get().Stats.Retention.Rollup, apply)
+	if err != nil {
+		log.Fatalf("cannot purge visits: %v", err)
+	}
+	if !apply {
+		log.Printf("%d visit records before %v will be purged, use -apply to purge them.",
+			n, before.Format("2006-01-02"))
+		return
+	}
+	log.Printf("%d visit records before %v have been purged.",
+		n, before.Format("2006-01-02"))
+}
+
+// EraseCmd erases all visit records of the given visitor ID or the given
+// IP address as it is stored, i.e. pseudonymized if IP hiding is enabled.
+func EraseCmd(vid, ip string) {
+	if vid == "" && ip == "" {
+		log.Fatalf("missing visitor ID or IP address")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	n, err := s.EraseVisits(ctx, vid, ip)
+	if err != nil {
+		log.Fatalf("cannot erase visits: %v", err)
+	}
+	log.Printf("%d visit records have been erased.", n)
+}
+
+// BackfillCmd completes the visit records that were recorded before the
+// information was parsed from the UA and the referer, and before the
+// unique visitor was hashed at record time.
+func BackfillCmd() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	n, err := s.BackfillVisits(ctx, "browser", func(v *models.Visit) {
+		ua := visitor.ParseUA(v.UA)
+		v.Browser, v.BrowserVersion = ua.Browser, ua.BrowserVersion
+		v.OS, v.Device = ua.OS, ua.Device
+	})
+	if err != nil {
+		log.Fatalf("cannot backfill browser, OS and device: %v", err)
+	}
+	log.Printf("%d visit records have been backfilled with browser, OS and device.", n)
+
+	n, err = s.BackfillVisits(ctx, "referer_class", func(v *models.Visit) {
+		ref := visitor.ParseReferer(v.Referer)
+		v.RefererHost, v.RefererClass = ref.Host, ref.Class
+	})
+	if err != nil {
+		log.Fatalf("cannot backfill referer host and class: %v", err)
+	}
+	log.Printf("%d visit records have been backfilled with referer host and class.", n)
+
+	n, err = s.BackfillVisits(ctx, "uv_hash", db.HashVisitor)
+	if err != nil {
+		log.Fatalf("cannot backfill unique visitor hashes: %v", err)
+	}
+	log.Printf("%d visit records have been backfilled with unique visitor hashes.", n)
+}
+
+// ExportCmd exports the selected statistics to the given file, or to the
+// standard output if out is empty.
+func ExportCmd(opts ExportOptions, out string) {
+	if !opts.Format.Valid() {
+		log.Fatalf("unsupported export format: %s", opts.Format)
+	}
+	if !opts.Data.Valid() {
+		log.Fatalf("unsupported export data: %s", opts.Data)
+	}
+	if !opts.Traffic.Valid() {
+		log.Fatalf("unsupported traffic: %s", opts.Traffic)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	w := os.Stdout
+	if out != "" {
+		w, err = os.Create(out)
+		if err != nil {
+			log.Fatalf("cannot create export file: %v", err)
+		}
+	}
+	if err := Export(ctx, w, s, opts); err != nil {
+		log.Fatalf("cannot export %s: %v", opts.Data, err)
+	}
+	if out != "" {
+		if err := w.Close(); err != nil {
+			log.Fatalf("cannot write export file: %v", err)
+		}
+		log.Printf("%s have been exported to %s.", opts.Data, out)
+	}
+}
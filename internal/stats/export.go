@@ -0,0 +1,218 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stats
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/models"
+)
+
+// Format is the file format of exported statistics.
+type Format string
+
+// All supported export formats.
+const (
+	FormatCSV    Format = "csv"
+	FormatNDJSON Format = "ndjson"
+)
+
+// Valid reports whether the format is supported.
+func (f Format) Valid() bool {
+	return f == FormatCSV || f == FormatNDJSON
+}
+
+// ContentType returns the MIME type of the format.
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// Data is the kind of exported statistics.
+type Data string
+
+// All supported kinds of exported statistics.
+const (
+	// DataVisits exports the raw visit records.
+	DataVisits Data = "visits"
+	// DataDaily exports the daily PV/UV of each alias.
+	DataDaily Data = "daily"
+)
+
+// Valid reports whether the kind of statistics is supported.
+func (d Data) Valid() bool {
+	return d == DataVisits || d == DataDaily
+}
+
+// ExportOptions selects the exported statistics.
+type ExportOptions struct {
+	Alias      string // empty for all aliases
+	Start, End time.Time
+	Traffic    db.Traffic
+	Format     Format
+	Data       Data
+}
+
+var (
+	visitHeader = []string{
+		"time", "alias", "visitor_id", "ip", "ua", "referer",
+		"referer_host", "referer_class", "browser", "browser_version",
+		"os", "device", "country", "city", "bot", "anonymous",
+	}
+	dailyHeader = []string{"date", "alias", "pv", "uv"}
+)
+
+// Export writes the selected statistics to w.
+//
+// If IP hiding is enabled (gdpr.hide_ip), the visitor IDs and IP
+// addresses of the exported visits are replaced by keyed hashes whose key
+// is only used for a single export. Distinct visitors can still be
+// counted within an export, but cannot be linked to their visitor
+// cookies or across exports.
+func Export(ctx context.Context, w io.Writer, s *db.Store, opts ExportOptions) error {
+	switch opts.Data {
+	case DataDaily:
+		ds, err := s.StatDaily(ctx, opts.Alias, opts.Start, opts.End, opts.Traffic)
+		if err != nil {
+			return err
+		}
+		e := newEncoder(w, opts.Format, dailyHeader)
+		for i := range ds {
+			d := &ds[i]
+			err := e.encode(d, []string{
+				d.Date.UTC().Format("2006-01-02"),
+				d.Alias,
+				strconv.FormatInt(d.PV, 10),
+				strconv.FormatInt(d.UV, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return e.flush()
+	case DataVisits:
+		var p *pseudonymizer
+		if config.Get().GDPR.HideIP {
+			p = newPseudonymizer()
+		}
+		e := newEncoder(w, opts.Format, visitHeader)
+		err := s.ScanVisits(ctx, opts.Alias, opts.Start, opts.End, opts.Traffic,
+			func(v *models.Visit) error {
+				p.apply(v)
+				return e.encode(v, []string{
+					v.Time.UTC().Format(time.RFC3339),
+					v.Alias,
+					v.VisitorID,
+					v.IP,
+					v.UA,
+					v.Referer,
+					v.RefererHost,
+					v.RefererClass,
+					v.Browser,
+					v.BrowserVersion,
+					v.OS,
+					v.Device,
+					v.Country,
+					v.City,
+					strconv.FormatBool(v.Bot),
+					strconv.FormatBool(v.Anonymous),
+				})
+			})
+		if err != nil {
+			return err
+		}
+		return e.flush()
+	default:
+		return fmt.Errorf("unsupported export data: %s", opts.Data)
+	}
+}
+
+// encoder encodes records either as CSV rows or as JSON lines.
+type encoder struct {
+	csv    *csv.Writer
+	json   *json.Encoder
+	header []string
+}
+
+func newEncoder(w io.Writer, f Format, header []string) *encoder {
+	if f == FormatCSV {
+		return &encoder{csv: csv.NewWriter(w), header: header}
+	}
+	return &encoder{json: json.NewEncoder(w)}
+}
+
+// encode encodes a record, where v is the JSON value and row is the CSV
+// row of the record.
+func (e *encoder) encode(v interface{}, row []string) error {
+	if e.json != nil {
+		return e.json.Encode(v)
+	}
+	if e.header != nil {
+		if err := e.csv.Write(e.header); err != nil {
+			return err
+		}
+		e.header = nil
+	}
+	return e.csv.Write(row)
+}
+
+func (e *encoder) flush() error {
+	if e.csv == nil {
+		return nil
+	}
+	if e.header != nil {
+		// Always write the header even without any records.
+		if err := e.csv.Write(e.header); err != nil {
+			return err
+		}
+	}
+	e.csv.Flush()
+	return e.csv.Error()
+}
+
+// pseudonymizer replaces visitor IDs and IP addresses by keyed hashes.
+// A nil pseudonymizer keeps the visits as is.
+type pseudonymizer struct {
+	key []byte
+}
+
+func newPseudonymizer() *pseudonymizer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err) // impossible unless system error.
+	}
+	return &pseudonymizer{key: key}
+}
+
+func (p *pseudonymizer) apply(v *models.Visit) {
+	if p == nil {
+		return
+	}
+	v.VisitorID = p.hash(v.VisitorID)
+	v.IP = p.hash(v.IP)
+}
+
+func (p *pseudonymizer) hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, p.key)
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
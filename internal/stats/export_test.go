@@ -0,0 +1,86 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"changkun.de/x/redir/internal/models"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	e := newEncoder(&buf, FormatCSV, dailyHeader)
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if got, want := buf.String(), "date,alias,pv,uv\n"; got != want {
+		t.Fatalf("empty CSV export = %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	e = newEncoder(&buf, FormatCSV, dailyHeader)
+	for _, row := range [][]string{{"2021-11-01", "a", "2", "1"}, {"2021-11-02", "b,c", "3", "3"}} {
+		if err := e.encode(nil, row); err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	want := "date,alias,pv,uv\n2021-11-01,a,2,1\n2021-11-02,\"b,c\",3,3\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("CSV export = %q, want %q", got, want)
+	}
+
+	buf.Reset()
+	e = newEncoder(&buf, FormatNDJSON, dailyHeader)
+	for _, a := range []string{"a", "b"} {
+		if err := e.encode(&models.VisitDaily{Alias: a, PV: 1, UV: 1}, nil); err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"alias":"b"`) {
+		t.Fatalf("NDJSON export = %q", buf.String())
+	}
+}
+
+func TestPseudonymizer(t *testing.T) {
+	p1, p2 := newPseudonymizer(), newPseudonymizer()
+
+	v1 := &models.Visit{VisitorID: "vid", IP: "1.2.3.4"}
+	v2 := &models.Visit{VisitorID: "vid", IP: "1.2.3.4"}
+	v3 := &models.Visit{VisitorID: "vid", IP: "1.2.3.4"}
+	p1.apply(v1)
+	p1.apply(v2)
+	p2.apply(v3)
+	if v1.VisitorID == "vid" || v1.IP == "1.2.3.4" {
+		t.Fatalf("visit is not pseudonymized: %+v", v1)
+	}
+	if v1.VisitorID != v2.VisitorID || v1.IP != v2.IP {
+		t.Fatalf("visits of the same export differ: %+v, %+v", v1, v2)
+	}
+	if v1.VisitorID == v3.VisitorID || v1.IP == v3.IP {
+		t.Fatalf("visits of different exports are linkable: %+v, %+v", v1, v3)
+	}
+
+	var p *pseudonymizer
+	v := &models.Visit{VisitorID: "vid"}
+	p.apply(v)
+	if v.VisitorID != "vid" {
+		t.Fatalf("nil pseudonymizer should keep the visit as is")
+	}
+	anonymous := &models.Visit{}
+	p1.apply(anonymous)
+	if anonymous.VisitorID != "" || anonymous.IP != "" {
+		t.Fatalf("empty fields should stay empty: %+v", anonymous)
+	}
+}
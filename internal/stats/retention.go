@@ -0,0 +1,48 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package stats implements the maintenance of the collected visit
+// records, such as retention, erasure and backfilling.
+package stats
+
+import (
+	"context"
+	"time"
+
+	"changkun.de/x/redir/internal/db"
+)
+
+// Cutoff returns the time before which raw visit records are expired
+// under a retention of the given days. The cutoff is aligned to the
+// beginning of a UTC day so that a day is always rolled up and purged
+// as a whole.
+func Cutoff(now time.Time, days int) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).AddDate(0, 0, -days)
+}
+
+// Purge expires the raw visit records that are older than the given
+// retention days, and returns the number of expired records.
+//
+// If rollup is true, the daily PV/UV of the expired records are
+// aggregated before purging. If apply is false, nothing is changed and
+// only the number of records that would be purged is returned.
+func Purge(ctx context.Context, s *db.Store, days int, rollup, apply bool) (int64, error) {
+	before := Cutoff(time.Now(), days)
+
+	err := s.IndexVisitTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if !apply {
+		return s.CountVisitsBefore(ctx, before)
+	}
+	if rollup {
+		err = s.RollupVisits(ctx, before)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.PurgeVisits(ctx, before)
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/stats"
+)
+
+func TestCutoff(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("missing time zone database")
+	}
+
+	tests := []struct {
+		now  time.Time
+		days int
+		want time.Time
+	}{
+		{
+			now:  time.Date(2021, 11, 7, 15, 4, 5, 0, time.UTC),
+			days: 30,
+			want: time.Date(2021, 10, 8, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			now:  time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+			days: 1,
+			want: time.Date(2021, 2, 28, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			// 2021-11-07 00:30 in Berlin is still 2021-11-06 in UTC.
+			now:  time.Date(2021, 11, 7, 0, 30, 0, 0, berlin),
+			days: 0,
+			want: time.Date(2021, 11, 6, 0, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range tests {
+		got := stats.Cutoff(tt.now, tt.days)
+		if !got.Equal(tt.want) {
+			t.Fatalf("Cutoff(%v, %v) want %v, got %v", tt.now, tt.days, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package token
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+)
+
+// CreateCmd creates a token of the given role and groups and prints
+// it. The token cannot be shown again.
+func CreateCmd(user, name string, scope Scope, aliasPrefix string, ttl time.Duration,
+	role config.Role, groups []string) {
+	if !role.Valid() {
+		log.Fatalf("cannot create token: invalid role %q", role)
+	}
+	t, tok, err := New(user, name, scope, aliasPrefix, ttl)
+	if err != nil {
+		log.Fatalf("cannot create token: %v", err)
+	}
+	t.Role, t.Groups = string(role), groups
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.StoreToken(ctx, t); err != nil {
+		log.Fatalf("cannot create token: %v", err)
+	}
+	log.Printf("token %s has been created, it is only shown once:", t.ID)
+	fmt.Println(tok)
+}
+
+// ListCmd lists the tokens of the given user, or of all users if the
+// user is empty.
+func ListCmd(user string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	ts, err := s.FetchTokens(ctx, user)
+	if err != nil {
+		log.Fatalf("cannot list tokens: %v", err)
+	}
+
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tNAME\tSCOPE\tPREFIX\tROLE\tEXPIRES\tLAST USED")
+	for _, t := range ts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.User, t.Name,
+			t.Scope, t.Prefix, t.Role, date(t.ExpiresAt), date(t.LastUsed))
+	}
+	w.Flush()
+}
+
+// RevokeCmd revokes the token of the given ID.
+func RevokeCmd(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := db.NewStore(ctx, config.Get().Store)
+	if err != nil {
+		log.Fatalf("cannot create a new store: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.DeleteToken(ctx, id, ""); err != nil {
+		log.Fatalf("cannot revoke token %s: %v", id, err)
+	}
+	log.Printf("token %s has been revoked.", id)
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package token implements personal API tokens, which authenticate
+// automation such as CI jobs via the Authorization: Bearer header
+// instead of the credentials of a user.
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"changkun.de/x/redir/internal/models"
+	"changkun.de/x/redir/internal/short"
+)
+
+// Scope limits the operations of a token.
+type Scope string
+
+const (
+	// Read allows fetching aliases and reading their statistics.
+	Read Scope = "read"
+	// Create only allows creating aliases.
+	Create Scope = "create"
+	// Admin allows all operations on aliases and reading their
+	// statistics.
+	Admin Scope = "admin"
+)
+
+// Valid checks if the given scope is valid.
+func (s Scope) Valid() bool {
+	switch s {
+	case Read, Create, Admin:
+		return true
+	default:
+		return false
+	}
+}
+
+// prefix is the prefix of all tokens, which makes leaked tokens easy
+// to recognize, e.g. by secret scanners.
+const prefix = "redir_"
+
+// Hash returns the stored hash of the given token. Tokens are random,
+// hence a fast hash is sufficient.
+func Hash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// New returns a new token of the given user and the token itself. The
+// alias prefix restricts the token to the aliases that start with it,
+// and a zero ttl never expires.
+func New(user, name string, scope Scope, aliasPrefix string, ttl time.Duration) (*models.Token, string, error) {
+	if user == "" {
+		return nil, "", errors.New("missing token user")
+	}
+	if !scope.Valid() {
+		return nil, "", fmt.Errorf("invalid token scope %q", scope)
+	}
+	if ttl < 0 {
+		return nil, "", fmt.Errorf("invalid token ttl %v", ttl)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	tok := prefix + base64.RawURLEncoding.EncodeToString(b)
+
+	now := time.Now().UTC()
+	t := &models.Token{
+		Name:      name,
+		User:      user,
+		Hash:      Hash(tok),
+		Scope:     string(scope),
+		Prefix:    aliasPrefix,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		t.ExpiresAt = now.Add(ttl)
+	}
+	return t, tok, nil
+}
+
+// Expired reports whether the token is expired at the given time.
+func Expired(t *models.Token, now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+// Allows reports whether the token allows the given operation on the
+// given alias.
+func Allows(t *models.Token, op short.Op, alias string) bool {
+	if !strings.HasPrefix(alias, t.Prefix) {
+		return false
+	}
+	switch Scope(t.Scope) {
+	case Admin:
+		return true
+	case Create:
+		return op == short.OpCreate
+	case Read:
+		return op == short.OpFetch
+	default:
+		return false
+	}
+}
+
+// CanRead reports whether the token allows reading the statistics of the
+// given alias, or of all aliases if the alias is empty.
+func CanRead(t *models.Token, alias string) bool {
+	if s := Scope(t.Scope); s != Read && s != Admin {
+		return false
+	}
+	if alias == "" {
+		return t.Prefix == ""
+	}
+	return strings.HasPrefix(alias, t.Prefix)
+}
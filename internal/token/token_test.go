@@ -0,0 +1,78 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package token_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"changkun.de/x/redir/internal/short"
+	"changkun.de/x/redir/internal/token"
+)
+
+func TestNew(t *testing.T) {
+	tk, tok, err := token.New("changkun", "ci", token.Create, "release/", time.Hour)
+	if err != nil {
+		t.Fatalf("cannot create token: %v", err)
+	}
+	if !strings.HasPrefix(tok, "redir_") || len(tok) < 40 {
+		t.Fatalf("unexpected token: %s", tok)
+	}
+	if tk.Hash != token.Hash(tok) || strings.Contains(tk.Hash, tok) {
+		t.Fatalf("token is not stored as its hash: %s", tk.Hash)
+	}
+	if token.Expired(tk, time.Now()) || !token.Expired(tk, time.Now().Add(2*time.Hour)) {
+		t.Fatalf("unexpected expiry: %v", tk.ExpiresAt)
+	}
+
+	_, tok2, _ := token.New("changkun", "ci", token.Create, "", 0)
+	if tok2 == tok {
+		t.Fatalf("tokens are not random")
+	}
+
+	for _, tt := range []struct {
+		user  string
+		scope token.Scope
+		ttl   time.Duration
+	}{
+		{"", token.Read, 0},
+		{"changkun", "write", 0},
+		{"changkun", token.Read, -time.Hour},
+	} {
+		if _, _, err := token.New(tt.user, "", tt.scope, "", tt.ttl); err == nil {
+			t.Fatalf("invalid token %+v is created", tt)
+		}
+	}
+}
+
+func TestAllows(t *testing.T) {
+	read, _, _ := token.New("changkun", "", token.Read, "", 0)
+	create, _, _ := token.New("changkun", "", token.Create, "release/", 0)
+	admin, _, _ := token.New("changkun", "", token.Admin, "release/", 0)
+
+	for _, tt := range []struct {
+		name  string
+		ok    bool
+		allow bool
+	}{
+		{"read fetch", token.Allows(read, short.OpFetch, "a"), true},
+		{"read create", token.Allows(read, short.OpCreate, "a"), false},
+		{"create create", token.Allows(create, short.OpCreate, "release/v1"), true},
+		{"create outside prefix", token.Allows(create, short.OpCreate, "v1"), false},
+		{"create delete", token.Allows(create, short.OpDelete, "release/v1"), false},
+		{"admin delete", token.Allows(admin, short.OpDelete, "release/v1"), true},
+		{"admin outside prefix", token.Allows(admin, short.OpDelete, "v1"), false},
+		{"read all", token.CanRead(read, ""), true},
+		{"read alias", token.CanRead(read, "a"), true},
+		{"create read", token.CanRead(create, "release/v1"), false},
+		{"admin read all", token.CanRead(admin, ""), false},
+		{"admin read alias", token.CanRead(admin, "release/v1"), true},
+	} {
+		if tt.ok != tt.allow {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.ok, tt.allow)
+		}
+	}
+}
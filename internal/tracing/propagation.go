@@ -0,0 +1,90 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// TraceparentHeader is the header of the W3C trace context.
+//
+// See https://www.w3.org/TR/trace-context/#traceparent-header.
+const TraceparentHeader = "traceparent"
+
+// Extract returns a copy of ctx that carries the remote span context of
+// the traceparent header, or ctx itself if the header is absent or
+// invalid.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	sc, ok := parseTraceparent(h.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return ContextWithRemote(ctx, sc)
+}
+
+// Inject sets the traceparent header of the span of the context.
+func Inject(ctx context.Context, h http.Header) {
+	sc := spanContext(ctx)
+	if !sc.IsValid() {
+		return
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	h.Set(TraceparentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+}
+
+// Middleware wraps an http handler and returns a new handler that
+// propagates the incoming trace context to the request context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(Extract(r.Context(), r.Header)))
+	})
+}
+
+func parseTraceparent(v string) (sc SpanContext, ok bool) {
+	// version-traceid-spanid-flags, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	const size = 2 + 1 + 32 + 1 + 16 + 1 + 2
+	if len(v) < size || strings.ToLower(v) != v {
+		return
+	}
+	version := v[:2]
+	switch {
+	case version == "ff":
+		return
+	case version == "00" && len(v) != size:
+		return
+	case len(v) > size && v[size] != '-': // future versions
+		return
+	}
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return
+	}
+	var ver, flags [1]byte
+	if _, err := hex.Decode(ver[:], []byte(version)); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(v[3:35])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(v[36:52])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(flags[:], []byte(v[53:55])); err != nil {
+		return
+	}
+	if !sc.IsValid() {
+		return
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, true
+}
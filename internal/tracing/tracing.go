@@ -0,0 +1,386 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package tracing implements distributed tracing that is compatible with
+// OpenTelemetry. Trace context is propagated by the W3C traceparent
+// header, and finished spans are exported in batches, e.g. to an
+// OpenTelemetry collector via OTLP/HTTP.
+//
+// Tracing is disabled until a provider is installed by SetProvider, and
+// spans of a disabled tracer are nil, which are valid and do nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace.
+type TraceID [16]byte
+
+// IsValid reports whether the trace id is not all zeros.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+
+// SpanID identifies a span of a trace.
+type SpanID [8]byte
+
+// IsValid reports whether the span id is not all zeros.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool // the span context is propagated from a remote parent
+}
+
+// IsValid reports whether the span context has a valid trace and span id.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Kind is the kind of a span, the values are the same as the SpanKind
+// of OpenTelemetry.
+type Kind int
+
+// All kinds of spans.
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// StatusCode is the status of a span, the values are the same as the
+// StatusCode of OpenTelemetry.
+type StatusCode int
+
+// All status codes.
+const (
+	StatusUnset StatusCode = 0
+	StatusOK    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+// Attr is a key-value attribute of a span. The value is either a
+// string, an int64, a float64 or a bool.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(k, v string) Attr { return Attr{k, v} }
+
+// Int returns an integer attribute.
+func Int(k string, v int) Attr { return Attr{k, int64(v)} }
+
+// Float64 returns a floating point attribute.
+func Float64(k string, v float64) Attr { return Attr{k, v} }
+
+// Bool returns a boolean attribute.
+func Bool(k string, v bool) Attr { return Attr{k, v} }
+
+// SpanData is a finished span.
+type SpanData struct {
+	Name          string
+	Kind          Kind
+	SpanContext   SpanContext
+	Parent        SpanID
+	Start         time.Time
+	End           time.Time
+	Attrs         []Attr
+	Status        StatusCode
+	StatusMessage string
+}
+
+// Span is an operation of a trace. A nil span is valid and does nothing.
+type Span struct {
+	provider *Provider
+	sc       SpanContext
+
+	mu   sync.Mutex
+	data *SpanData // nil if the span is not sampled or already ended
+}
+
+// SpanContext returns the span context of the span.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// IsRecording reports whether the span is sampled and not ended.
+func (s *Span) IsRecording() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data != nil
+}
+
+// SetAttributes adds attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data != nil {
+		s.data.Attrs = append(s.data.Attrs, attrs...)
+	}
+}
+
+// SetError marks the span as failed if the given error is not nil.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data != nil {
+		s.data.Status = StatusError
+		s.data.StatusMessage = err.Error()
+	}
+}
+
+// End ends the span. Calling End more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	d := s.data
+	s.data = nil
+	s.mu.Unlock()
+	if d == nil {
+		return
+	}
+	d.End = time.Now()
+	s.provider.enqueue(d)
+}
+
+type spanKey struct{}
+
+// SpanFromContext returns the span of the context, or nil if the context
+// does not carry a span.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+type remoteKey struct{}
+
+// ContextWithRemote returns a copy of ctx that carries a span context
+// propagated from a remote parent.
+func ContextWithRemote(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, remoteKey{}, sc)
+}
+
+// spanContext returns the span context of the parent of new spans of
+// the given context.
+func spanContext(ctx context.Context) SpanContext {
+	if s := SpanFromContext(ctx); s != nil {
+		return s.sc
+	}
+	sc, _ := ctx.Value(remoteKey{}).(SpanContext)
+	return sc
+}
+
+var global atomic.Pointer[Provider]
+
+// SetProvider installs the provider of the package level Start. A nil
+// provider disables tracing.
+func SetProvider(p *Provider) {
+	global.Store(p)
+}
+
+// Start starts a new span that is a child of the span of the given
+// context, and returns the span as well as a context that carries the
+// span. The returned span is nil if tracing is disabled.
+func Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	p := global.Load()
+	if p == nil {
+		return ctx, nil
+	}
+	return p.Start(ctx, name, kind, attrs...)
+}
+
+// Start starts a new span of the provider, see the package level Start.
+func (p *Provider) Start(ctx context.Context, name string, kind Kind, attrs ...Attr) (context.Context, *Span) {
+	parent := spanContext(ctx)
+
+	s := &Span{provider: p}
+	if parent.IsValid() {
+		s.sc.TraceID = parent.TraceID
+		s.sc.Sampled = parent.Sampled
+	} else {
+		s.sc.TraceID = newTraceID()
+		s.sc.Sampled = p.sample(s.sc.TraceID)
+	}
+	s.sc.SpanID = newSpanID()
+
+	if s.sc.Sampled {
+		s.data = &SpanData{
+			Name:        name,
+			Kind:        kind,
+			SpanContext: s.sc,
+			Parent:      parent.SpanID,
+			Start:       time.Now(),
+			Attrs:       attrs,
+		}
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func newTraceID() (t TraceID) {
+	for !t.IsValid() {
+		if _, err := rand.Read(t[:]); err != nil {
+			panic(err) // impossible unless system error.
+		}
+	}
+	return
+}
+
+func newSpanID() (s SpanID) {
+	for !s.IsValid() {
+		if _, err := rand.Read(s[:]); err != nil {
+			panic(err) // impossible unless system error.
+		}
+	}
+	return
+}
+
+// The provider batches finished spans before they are exported.
+const (
+	maxQueueSize  = 2048
+	maxBatchSize  = 512
+	batchInterval = 5 * time.Second
+)
+
+// Provider creates spans and exports them when they are finished.
+type Provider struct {
+	exporter Exporter
+	ratio    float64
+
+	mu      sync.Mutex
+	queue   []*SpanData
+	dropped int64
+
+	exportMu sync.Mutex // serializes exports
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewProvider returns a provider that exports spans to the given
+// exporter. Traces without a sampled remote parent are sampled by the
+// given ratio in [0, 1].
+func NewProvider(e Exporter, ratio float64) *Provider {
+	p := &Provider{
+		exporter: e,
+		ratio:    ratio,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// sample decides whether a new trace is sampled. The decision is derived
+// from the trace id so that it is consistent across services.
+func (p *Provider) sample(t TraceID) bool {
+	switch {
+	case p.ratio >= 1:
+		return true
+	case p.ratio <= 0:
+		return false
+	}
+	x := binary.BigEndian.Uint64(t[8:]) >> 1
+	return x < uint64(p.ratio*(1<<63))
+}
+
+func (p *Provider) enqueue(d *SpanData) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) >= maxQueueSize {
+		p.dropped++
+		return
+	}
+	p.queue = append(p.queue, d)
+}
+
+// Dropped returns the number of spans that are dropped because the
+// export queue was full.
+func (p *Provider) Dropped() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+func (p *Provider) run() {
+	defer close(p.done)
+	t := time.NewTicker(batchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), batchInterval)
+			if err := p.ForceFlush(ctx); err != nil {
+				slog.Warn("cannot export spans", "err", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// ForceFlush exports all finished spans.
+func (p *Provider) ForceFlush(ctx context.Context) error {
+	p.exportMu.Lock()
+	defer p.exportMu.Unlock()
+
+	p.mu.Lock()
+	spans := p.queue
+	p.queue = nil
+	p.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		if err := p.exporter.Export(ctx, spans[:n]); err != nil {
+			return err
+		}
+		spans = spans[n:]
+	}
+	return nil
+}
+
+// Shutdown exports all finished spans and shuts down the exporter.
+// Spans that end after Shutdown are not exported.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	p.once.Do(func() { close(p.stop) })
+	<-p.done
+	err := p.ForceFlush(ctx)
+	if e := p.exporter.Shutdown(ctx); err == nil {
+		err = e
+	}
+	return err
+}
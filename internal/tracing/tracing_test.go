@@ -0,0 +1,192 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"changkun.de/x/redir/internal/tracing"
+)
+
+func TestSpans(t *testing.T) {
+	e := &tracing.MemoryExporter{}
+	p := tracing.NewProvider(e, 1)
+	defer p.Shutdown(context.Background())
+
+	ctx, root := p.Start(context.Background(), "root", tracing.KindServer)
+	_, child := p.Start(ctx, "child", tracing.KindClient, tracing.String("k", "v"))
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End() // no effect
+	root.End()
+
+	if err := p.ForceFlush(context.Background()); err != nil {
+		t.Fatalf("cannot flush spans: %v", err)
+	}
+	spans := e.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.Name != "child" || r.Name != "root" {
+		t.Fatalf("unexpected spans: %s, %s", c.Name, r.Name)
+	}
+	if c.SpanContext.TraceID != r.SpanContext.TraceID {
+		t.Fatalf("child span is not in the trace of its parent")
+	}
+	if c.Parent != r.SpanContext.SpanID || r.Parent.IsValid() {
+		t.Fatalf("unexpected parents: %v, %v", c.Parent, r.Parent)
+	}
+	if c.Status != tracing.StatusError || c.StatusMessage != "failed" {
+		t.Fatalf("unexpected status: %v %s", c.Status, c.StatusMessage)
+	}
+	if len(c.Attrs) != 1 || c.Attrs[0].Value != "v" {
+		t.Fatalf("unexpected attributes: %v", c.Attrs)
+	}
+	if c.End.Before(c.Start) {
+		t.Fatalf("span ends before it starts")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	tracing.SetProvider(nil)
+	ctx := context.Background()
+	got, s := tracing.Start(ctx, "noop", tracing.KindInternal)
+	if got != ctx || s != nil {
+		t.Fatalf("disabled tracing returns a span")
+	}
+	// A nil span is valid.
+	s.SetAttributes(tracing.Bool("k", true))
+	s.SetError(errors.New("failed"))
+	s.End()
+}
+
+func TestSampling(t *testing.T) {
+	e := &tracing.MemoryExporter{}
+	p := tracing.NewProvider(e, 0)
+	defer p.Shutdown(context.Background())
+
+	_, s := p.Start(context.Background(), "unsampled", tracing.KindServer)
+	if s.IsRecording() || !s.SpanContext().IsValid() {
+		t.Fatalf("unsampled span must be valid but not recording")
+	}
+	s.End()
+
+	// A sampled remote parent overrides the sampling ratio.
+	h := http.Header{}
+	h.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := tracing.Extract(context.Background(), h)
+	_, s = p.Start(ctx, "sampled", tracing.KindServer)
+	s.End()
+
+	p.ForceFlush(context.Background())
+	spans := e.Spans()
+	if len(spans) != 1 || spans[0].Name != "sampled" {
+		t.Fatalf("unexpected spans: %v", spans)
+	}
+	if got := spans[0].SpanContext.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("trace id is %s, want the trace id of the remote parent", got)
+	}
+	if got := spans[0].Parent.String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("parent is %s, want the remote parent", got)
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		ok          bool
+		sampled     bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-600f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		h.Set(tracing.TraceparentHeader, tt.traceparent)
+		ctx := tracing.Extract(context.Background(), h)
+
+		out := http.Header{}
+		tracing.Inject(ctx, out)
+		got := out.Get(tracing.TraceparentHeader)
+		if !tt.ok {
+			if got != "" {
+				t.Errorf("traceparent %q is accepted", tt.traceparent)
+			}
+			continue
+		}
+		want := "00" + tt.traceparent[2:55]
+		if got != want {
+			t.Errorf("traceparent %q is propagated as %q, want %q",
+				tt.traceparent, got, want)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	e := tracing.NewOTLPExporter(collector.URL, "redir", map[string]string{
+		"Authorization": "token",
+	})
+	p := tracing.NewProvider(e, 1)
+	_, s := p.Start(context.Background(), "span", tracing.KindServer, tracing.Int("n", 42))
+	s.End()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("cannot export spans: %v", err)
+	}
+
+	rs := body["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	attr := rs["resource"].(map[string]interface{})["attributes"].([]interface{})[0]
+	if v := attr.(map[string]interface{})["value"].(map[string]interface{})["stringValue"]; v != "redir" {
+		t.Fatalf("service name is %v, want redir", v)
+	}
+	ss := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	span := ss["spans"].([]interface{})[0].(map[string]interface{})
+	if span["name"] != "span" || span["kind"] != float64(tracing.KindServer) {
+		t.Fatalf("unexpected span: %v", span)
+	}
+	if len(span["traceId"].(string)) != 32 || len(span["spanId"].(string)) != 16 {
+		t.Fatalf("unexpected span ids: %v", span)
+	}
+	n := span["attributes"].([]interface{})[0].(map[string]interface{})
+	if v := n["value"].(map[string]interface{})["intValue"]; v != "42" {
+		t.Fatalf("int attribute is %v, want \"42\"", v)
+	}
+
+	bad := tracing.NewOTLPExporter(collector.URL, "redir", nil)
+	if err := bad.Export(context.Background(), []*tracing.SpanData{{Name: "span"}}); err == nil {
+		t.Fatalf("unauthorized export succeeds")
+	}
+}
@@ -5,12 +5,15 @@
 package utils
 
 import (
-	"crypto/sha1"
-	"fmt"
-	"io"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"changkun.de/x/redir/internal/config"
 )
@@ -22,18 +25,16 @@ import (
 //
 // The purpose of this function is to produce an identifier of visitor.
 // It does not matter wheather it is an real IP or not. Depending on the
-// configuration, the returned IP address might be an encrypted hash string.
+// configuration, the returned IP address might be pseudonymized, see
+// Pseudonymize.
+func ReadIP(r *http.Request) string {
+	return Pseudonymize(RealIP(r))
+}
+
+// RealIP is like ReadIP but always returns the IP address as is.
 //
 // This implementation is derived from gin-gonic/gin.
-func ReadIP(r *http.Request) (ip string) {
-	defer func() {
-		if config.Conf.GDPR.HideIP {
-			hh := sha1.New()
-			io.WriteString(hh, ip)
-			ip = fmt.Sprintf("%x", hh.Sum(nil))
-		}
-	}()
-
+func RealIP(r *http.Request) (ip string) {
 	ip = r.Header.Get("X-Forwarded-For")
 	ip = strings.TrimSpace(strings.Split(ip, ",")[0])
 	if ip == "" {
@@ -52,3 +53,77 @@ func ReadIP(r *http.Request) (ip string) {
 	}
 	return ip
 }
+
+// Pseudonymize applies the configured GDPR policy to the given IP
+// address. If IP hiding is enabled, the IP address is either hashed by
+// HMAC-SHA256 with a key that rotates daily, or truncated to its network
+// part. A hashed IP stays the same within a day, so that unique visitors
+// can still be counted, but cannot be linked across days.
+func Pseudonymize(ip string) string {
+	if !config.Get().GDPR.HideIP {
+		return ip
+	}
+	switch config.Get().GDPR.IPMode {
+	case config.IPTruncate:
+		return truncateIP(ip)
+	default:
+		return hashIP(ip, ipKey.get(time.Now(), config.Get().GDPR.IPSecret))
+	}
+}
+
+// ipKey is the key of the current day for hashing IP addresses.
+var ipKey dailyKey
+
+// dailyKey holds a key that is only valid for a single (UTC) day.
+//
+// If a secret is given, the key is derived from the secret and the day,
+// so that multiple redir instances agree on the same key. Otherwise, a
+// random key is generated and the key of the previous day is forgotten.
+type dailyKey struct {
+	mu     sync.Mutex
+	day    string
+	secret string
+	key    []byte
+}
+
+func (k *dailyKey) get(now time.Time, secret string) []byte {
+	day := now.UTC().Format("2006-01-02")
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.day == day && k.secret == secret {
+		return k.key
+	}
+	if secret != "" {
+		h := hmac.New(sha256.New, []byte(secret))
+		h.Write([]byte(day))
+		k.key = h.Sum(nil)
+	} else {
+		k.key = make([]byte, 32)
+		if _, err := rand.Read(k.key); err != nil {
+			panic(err) // impossible unless system error.
+		}
+	}
+	k.day, k.secret = day, secret
+	return k.key
+}
+
+func hashIP(ip string, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(ip))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// truncateIP zeros the last octet of an IPv4 address, or the last 80
+// bits of an IPv6 address. Anything else is returned as is.
+func truncateIP(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	if v4 := addr.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return addr.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTruncateIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"192.168.1.123", "192.168.1.0"},
+		{"::ffff:10.0.0.42", "10.0.0.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		if got := truncateIP(tt.ip); got != tt.want {
+			t.Fatalf("truncateIP(%v) want %v, got %v", tt.ip, tt.want, got)
+		}
+	}
+}
+
+func TestDailyKey(t *testing.T) {
+	day1 := time.Date(2021, 11, 7, 1, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+
+	for _, secret := range []string{"", "secret"} {
+		var k dailyKey
+		h1 := hashIP("192.168.1.123", k.get(day1, secret))
+		h2 := hashIP("192.168.1.123", k.get(day1.Add(time.Hour), secret))
+		if h1 != h2 {
+			t.Fatalf("hashed IP changed within a day: %v, %v", h1, h2)
+		}
+		h3 := hashIP("192.168.1.123", k.get(day2, secret))
+		if h1 == h3 {
+			t.Fatalf("hashed IP did not change across days: %v", h1)
+		}
+	}
+
+	// Derived keys are reproducible among instances.
+	var k1, k2 dailyKey
+	if hashIP("::1", k1.get(day1, "secret")) != hashIP("::1", k2.get(day1, "secret")) {
+		t.Fatalf("derived keys are not the same for the same secret")
+	}
+}
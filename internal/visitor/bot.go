@@ -0,0 +1,52 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+// Package visitor implements the classification of visitors from their
+// requests, which enriches the recorded visits for statistics.
+package visitor
+
+import (
+	_ "embed"
+	"net/http"
+	"strings"
+)
+
+//go:embed bots.txt
+var bots string
+
+var botPatterns = func() (ps []string) {
+	for _, l := range strings.Split(bots, "\n") {
+		l = strings.ToLower(strings.TrimSpace(l))
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		ps = append(ps, l)
+	}
+	return
+}()
+
+// IsBot reports whether the request is likely sent by a bot, such as
+// link previewers, search crawlers, uptime monitors, or HTTP libraries.
+//
+// A request is considered from a bot if its User-Agent matches a known
+// bot pattern, or it does not look like a browser navigation: HEAD
+// requests, and requests without User-Agent or Accept-Language.
+func IsBot(r *http.Request) bool {
+	if r.Method == http.MethodHead {
+		return true
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	if ua == "" {
+		return true
+	}
+	for _, p := range botPatterns {
+		if strings.Contains(ua, p) {
+			return true
+		}
+	}
+
+	// All major browsers send Accept-Language for navigations.
+	return r.Header.Get("Accept-Language") == ""
+}
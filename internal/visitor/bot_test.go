@@ -0,0 +1,43 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package visitor_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"changkun.de/x/redir/internal/visitor"
+)
+
+func TestIsBot(t *testing.T) {
+	tests := []struct {
+		method string
+		ua     string
+		lang   string
+		want   bool
+	}{
+		{http.MethodGet, "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15", "en-US", false},
+		{http.MethodGet, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:94.0) Gecko/20100101 Firefox/94.0", "de-DE,de;q=0.9", false},
+		{http.MethodHead, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:94.0) Gecko/20100101 Firefox/94.0", "de-DE", true},
+		{http.MethodGet, "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:94.0) Gecko/20100101 Firefox/94.0", "", true},
+		{http.MethodGet, "", "en-US", true},
+		{http.MethodGet, "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "", true},
+		{http.MethodGet, "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_11_1) AppleWebKit/601.2.4 (KHTML, like Gecko) Version/9.0.1 Safari/601.2.4 facebookexternalhit/1.1 Facebot Twitterbot/1.0", "en", true},
+		{http.MethodGet, "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "en", true},
+		{http.MethodGet, "Mozilla/5.0+(compatible; UptimeRobot/2.0; http://www.uptimerobot.com/)", "en", true},
+		{http.MethodGet, "curl/7.79.1", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/s/alias", nil)
+		r.Header.Set("User-Agent", tt.ua)
+		if tt.lang != "" {
+			r.Header.Set("Accept-Language", tt.lang)
+		}
+		if got := visitor.IsBot(r); got != tt.want {
+			t.Fatalf("IsBot(%v %q, %q) want %v, got %v", tt.method, tt.ua, tt.lang, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package visitor
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Classes of referrers.
+const (
+	RefererDirect = "direct"
+	RefererSearch = "search"
+	RefererSocial = "social"
+	RefererEmail  = "email"
+	RefererOther  = "other"
+)
+
+// Referer is the normalized information of a Referer header.
+type Referer struct {
+	Host  string // host without the www. prefix, e.g. google.com
+	Class string // well-known source class, e.g. search
+}
+
+// referers are the well-known sources of referrers. A domain matches the
+// host itself and all its subdomains, and a domain ending with .* matches
+// any top-level domain, e.g. google.* matches google.de and google.co.uk.
+// The order matters because, for instance, mail.google.com is a mail
+// client rather than a search engine.
+var referers = []struct {
+	class   string
+	domains []string
+}{
+	{RefererEmail, []string{
+		"mail.google.com", "inbox.google.com", "outlook.live.com",
+		"outlook.office.com", "outlook.office365.com", "mail.yahoo.com",
+		"mail.yandex.ru", "mail.qq.com", "exmail.qq.com", "mail.163.com",
+		"mail.proton.me", "mail.protonmail.com", "app.fastmail.com",
+		"mail.zoho.com", "com.google.android.gm",
+		"com.microsoft.office.outlook",
+	}},
+	{RefererSearch, []string{
+		"google.*", "bing.com", "duckduckgo.com", "search.yahoo.com",
+		"yahoo.*", "baidu.com", "yandex.*", "ecosia.org",
+		"search.brave.com", "startpage.com", "qwant.com", "sogou.com",
+		"so.com", "naver.com", "seznam.cz", "ask.com",
+		"com.google.android.googlequicksearchbox",
+	}},
+	{RefererSocial, []string{
+		"t.co", "twitter.com", "x.com", "facebook.com", "fb.me",
+		"fb.com", "instagram.com", "linkedin.com", "lnkd.in",
+		"reddit.com", "news.ycombinator.com", "youtube.com", "youtu.be",
+		"pinterest.com", "tiktok.com", "weibo.com", "weibo.cn",
+		"zhihu.com", "douban.com", "v2ex.com", "mastodon.social",
+		"slack.com", "discord.com", "t.me", "telegram.org",
+		"web.whatsapp.com", "vk.com", "tumblr.com", "medium.com",
+		"github.com", "com.slack", "org.telegram.messenger",
+		"com.twitter.android", "com.facebook.katana",
+		"com.linkedin.android", "com.reddit.frontpage",
+	}},
+}
+
+// ParseReferer normalizes the given Referer header to its host and
+// classifies it into a well-known source class. An empty referer is
+// classified as a direct visit. Referrers from Android apps, such as
+// android-app://com.google.android.gm/, use the package name as host.
+func ParseReferer(ref string) Referer {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return Referer{Class: RefererDirect}
+	}
+
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		// Referrers without a scheme, e.g. "t.co/abc".
+		u, err = url.Parse("http://" + ref)
+		if err != nil || u.Host == "" {
+			return Referer{Class: RefererOther}
+		}
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	host = strings.TrimPrefix(host, "www.")
+	if host == "" {
+		return Referer{Class: RefererOther}
+	}
+
+	for _, r := range referers {
+		for _, d := range r.domains {
+			if matchDomain(host, d) {
+				return Referer{Host: host, Class: r.class}
+			}
+		}
+	}
+	return Referer{Host: host, Class: RefererOther}
+}
+
+// matchDomain reports whether the host is the given domain or one of its
+// subdomains. A domain ending with .* matches any top-level domain.
+func matchDomain(host, domain string) bool {
+	if !strings.HasSuffix(domain, ".*") {
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	}
+
+	// Find the label of the domain in the host, the remaining part is
+	// the top-level domain, such as com, de, or co.uk.
+	name := strings.TrimSuffix(domain, ".*")
+	labels := strings.Split(host, ".")
+	for i, l := range labels[:len(labels)-1] {
+		if l != name {
+			continue
+		}
+		tld := labels[i+1:]
+		if len(tld) == 1 || len(tld) == 2 && len(tld[len(tld)-1]) == 2 {
+			return true
+		}
+	}
+	return false
+}
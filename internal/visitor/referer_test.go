@@ -0,0 +1,41 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package visitor_test
+
+import (
+	"testing"
+
+	"changkun.de/x/redir/internal/visitor"
+)
+
+func TestParseReferer(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want visitor.Referer
+	}{
+		{"", visitor.Referer{Class: visitor.RefererDirect}},
+		{"https://t.co/abc", visitor.Referer{Host: "t.co", Class: visitor.RefererSocial}},
+		{"https://t.co/def?amp=1", visitor.Referer{Host: "t.co", Class: visitor.RefererSocial}},
+		{"t.co/abc", visitor.Referer{Host: "t.co", Class: visitor.RefererSocial}},
+		{"https://www.google.com/search?q=redir", visitor.Referer{Host: "google.com", Class: visitor.RefererSearch}},
+		{"https://www.google.co.uk/", visitor.Referer{Host: "google.co.uk", Class: visitor.RefererSearch}},
+		{"https://WWW.Google.DE./url?sa=t", visitor.Referer{Host: "google.de", Class: visitor.RefererSearch}},
+		{"https://mail.google.com/mail/u/0/", visitor.Referer{Host: "mail.google.com", Class: visitor.RefererEmail}},
+		{"android-app://com.google.android.gm/", visitor.Referer{Host: "com.google.android.gm", Class: visitor.RefererEmail}},
+		{"https://l.facebook.com/l.php?u=x", visitor.Referer{Host: "l.facebook.com", Class: visitor.RefererSocial}},
+		{"https://news.ycombinator.com/item?id=1", visitor.Referer{Host: "news.ycombinator.com", Class: visitor.RefererSocial}},
+		{"https://duckduckgo.com/", visitor.Referer{Host: "duckduckgo.com", Class: visitor.RefererSearch}},
+		{"https://changkun.de/blog/", visitor.Referer{Host: "changkun.de", Class: visitor.RefererOther}},
+		{"https://googleblog.example.com/", visitor.Referer{Host: "googleblog.example.com", Class: visitor.RefererOther}},
+		{"https://google.example.com/", visitor.Referer{Host: "google.example.com", Class: visitor.RefererOther}},
+		{"https://notx.com/", visitor.Referer{Host: "notx.com", Class: visitor.RefererOther}},
+		{"://", visitor.Referer{Class: visitor.RefererOther}},
+	}
+	for _, tt := range tests {
+		if got := visitor.ParseReferer(tt.ref); got != tt.want {
+			t.Errorf("ParseReferer(%q) = %+v, want %+v", tt.ref, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package visitor
+
+import (
+	"strings"
+)
+
+// Device classes of user agents.
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceOther   = "other"
+)
+
+// Unknown is used if a User-Agent does not reveal the information.
+const Unknown = "unknown"
+
+// UserAgent is the structured information of a User-Agent string.
+type UserAgent struct {
+	Browser        string // browser family, e.g. Chrome
+	BrowserVersion string // major version of the browser, e.g. 96
+	OS             string // operating system family, e.g. Android
+	Device         string // device class, e.g. mobile
+}
+
+// browsers are the known browser families and the tokens that carry
+// their versions. The order matters because many browsers pretend to
+// be others, for instance, Edge pretends to be Chrome, and Chrome
+// pretends to be Safari.
+var browsers = []struct {
+	name   string
+	tokens []string
+}{
+	{"Edge", []string{"Edg/", "Edge/", "EdgA/", "EdgiOS/"}},
+	{"Opera", []string{"OPR/", "OPT/", "Opera/"}},
+	{"Samsung Internet", []string{"SamsungBrowser/"}},
+	{"Yandex", []string{"YaBrowser/"}},
+	{"Vivaldi", []string{"Vivaldi/"}},
+	{"UC Browser", []string{"UCBrowser/"}},
+	{"Firefox", []string{"Firefox/", "FxiOS/"}},
+	{"Chromium", []string{"Chromium/"}},
+	{"Chrome", []string{"Chrome/", "CriOS/"}},
+	{"Safari", []string{"Version/"}},
+	{"IE", []string{"MSIE ", "rv:"}},
+}
+
+// ParseUA parses the given User-Agent string into the browser family and
+// its major version, the operating system family, and the device class.
+func ParseUA(ua string) UserAgent {
+	if strings.TrimSpace(ua) == "" {
+		return UserAgent{Browser: Unknown, OS: Unknown, Device: DeviceOther}
+	}
+
+	u := UserAgent{Browser: "Other", OS: parseOS(ua)}
+	for _, b := range browsers {
+		// Safari and IE are only recognized by their own markers, the
+		// version tokens are also used by others.
+		if b.name == "Safari" && !strings.Contains(ua, "Safari/") ||
+			b.name == "IE" && !strings.Contains(ua, "MSIE ") && !strings.Contains(ua, "Trident/") {
+			continue
+		}
+		if v, ok := version(ua, b.tokens); ok {
+			u.Browser, u.BrowserVersion = b.name, v
+			break
+		}
+	}
+	u.Device = parseDevice(ua, u.OS)
+	return u
+}
+
+// version returns the major version that follows the first found token.
+func version(ua string, tokens []string) (string, bool) {
+	for _, t := range tokens {
+		i := strings.Index(ua, t)
+		if i < 0 {
+			continue
+		}
+		v := ua[i+len(t):]
+		end := strings.IndexFunc(v, func(r rune) bool {
+			return r < '0' || r > '9'
+		})
+		if end >= 0 {
+			v = v[:end]
+		}
+		return v, true
+	}
+	return "", false
+}
+
+func parseOS(ua string) string {
+	switch {
+	case strings.Contains(ua, "Windows Phone"):
+		return "Windows Phone"
+	case strings.Contains(ua, "Windows"):
+		return "Windows"
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"), strings.Contains(ua, "iPod"):
+		return "iOS"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "Android"):
+		return "Android"
+	case strings.Contains(ua, "CrOS"):
+		return "Chrome OS"
+	case strings.Contains(ua, "Linux"), strings.Contains(ua, "X11"):
+		return "Linux"
+	default:
+		return "Other"
+	}
+}
+
+func parseDevice(ua, os string) string {
+	lua := strings.ToLower(ua)
+	for _, p := range botPatterns {
+		if strings.Contains(lua, p) {
+			return DeviceBot
+		}
+	}
+
+	switch {
+	case strings.Contains(ua, "iPad"), strings.Contains(ua, "Tablet"),
+		strings.Contains(ua, "Kindle"), strings.Contains(ua, "Silk/"),
+		os == "Android" && !strings.Contains(ua, "Mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "Mobile"), strings.Contains(ua, "iPhone"),
+		strings.Contains(ua, "iPod"), os == "Windows Phone":
+		return DeviceMobile
+	case os == "Windows", os == "macOS", os == "Linux", os == "Chrome OS":
+		return DeviceDesktop
+	default:
+		return DeviceOther
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package visitor_test
+
+import (
+	"testing"
+
+	"changkun.de/x/redir/internal/visitor"
+)
+
+func TestParseUA(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want visitor.UserAgent
+	}{
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Safari/605.1.15",
+			visitor.UserAgent{Browser: "Safari", BrowserVersion: "15", OS: "macOS", Device: visitor.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36",
+			visitor.UserAgent{Browser: "Chrome", BrowserVersion: "96", OS: "Windows", Device: visitor.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/96.0.4664.45 Safari/537.36 Edg/96.0.1054.34",
+			visitor.UserAgent{Browser: "Edge", BrowserVersion: "96", OS: "Windows", Device: visitor.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:94.0) Gecko/20100101 Firefox/94.0",
+			visitor.UserAgent{Browser: "Firefox", BrowserVersion: "94", OS: "Linux", Device: visitor.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/96.0.4664.53 Mobile/15E148 Safari/604.1",
+			visitor.UserAgent{Browser: "Chrome", BrowserVersion: "96", OS: "iOS", Device: visitor.DeviceMobile},
+		},
+		{
+			"Mozilla/5.0 (iPad; CPU OS 15_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.1 Mobile/15E148 Safari/604.1",
+			visitor.UserAgent{Browser: "Safari", BrowserVersion: "15", OS: "iOS", Device: visitor.DeviceTablet},
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 12; SM-G991B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/16.0 Chrome/92.0.4515.166 Mobile Safari/537.36",
+			visitor.UserAgent{Browser: "Samsung Internet", BrowserVersion: "16", OS: "Android", Device: visitor.DeviceMobile},
+		},
+		{
+			"Mozilla/5.0 (Windows NT 6.1; WOW64; Trident/7.0; rv:11.0) like Gecko",
+			visitor.UserAgent{Browser: "IE", BrowserVersion: "11", OS: "Windows", Device: visitor.DeviceDesktop},
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			visitor.UserAgent{Browser: "Other", OS: "Other", Device: visitor.DeviceBot},
+		},
+		{
+			"",
+			visitor.UserAgent{Browser: visitor.Unknown, OS: visitor.Unknown, Device: visitor.DeviceOther},
+		},
+	}
+	for _, tt := range tests {
+		if got := visitor.ParseUA(tt.ua); got != tt.want {
+			t.Fatalf("ParseUA(%q) want %+v, got %+v", tt.ua, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/metrics"
+)
+
+// Outcomes of short link requests.
+const (
+	outcomeRedirect = "redirect"
+	outcomeWait     = "wait"
+	outcomeWarn     = "warn"
+	outcomeNotFound = "not_found"
+	outcomePDF      = "pdf"
+)
+
+var (
+	redirects = metrics.NewCounterVec("redir_redirects_total",
+		"Number of short link requests by outcome.", "outcome")
+	redirectDuration = metrics.NewHistogramVec("redir_redirect_duration_seconds",
+		"Latency of short link requests by outcome.", metrics.DefBuckets, "outcome")
+	visitsDropped = metrics.NewCounterVec("redir_visits_dropped_total",
+		"Number of visits that were dropped because the visit queue was full.")
+	authFailures = metrics.NewCounterVec("redir_auth_failures_total",
+		"Number of failed authentications by reason.", "reason")
+)
+
+func init() {
+	metrics.NewGaugeFunc("redir_blocked_ips",
+		"Number of IP addresses that are currently blocked because of too many failed authentications.",
+		func() float64 {
+			n := 0
+			now := time.Now().UTC()
+			blocklist.Range(func(_, v interface{}) bool {
+				if blocked(v.(*blockinfo), now) {
+					n++
+				}
+				return true
+			})
+			return float64(n)
+		})
+}
+
+// observe records the outcome and latency of a short link request.
+func observe(outcome string, start time.Time) {
+	redirects.Inc(outcome)
+	redirectDuration.Observe(time.Since(start).Seconds(), outcome)
+}
+
+// registerMetrics registers the metrics of the server components.
+func (s *server) registerMetrics() {
+	metrics.NewCounterFunc("redir_cache_hits_total", "Number of cache hits of short links.",
+		func() float64 {
+			hits, _ := s.cache.Stats()
+			return float64(hits)
+		})
+	metrics.NewCounterFunc("redir_cache_misses_total", "Number of cache misses of short links.",
+		func() float64 {
+			_, misses := s.cache.Stats()
+			return float64(misses)
+		})
+	metrics.NewGaugeFunc("redir_visit_queue_depth", "Number of visits waiting to be recorded.",
+		func() float64 { return float64(len(s.visits)) })
+	// Export the dropped visits before the first one is dropped, so that
+	// rate() does not miss the first increase.
+	visitsDropped.Add(0)
+	metrics.NewGaugeFunc("redir_visit_stream_subscribers", "Number of subscribers of the visit stream.",
+		func() float64 { return float64(s.events.Len()) })
+}
+
+// metricsHandler serves the metrics, and requires admin access if
+// metrics.auth is enabled.
+func (s *server) metricsHandler() http.Handler {
+	h := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.Get().Metrics.Auth {
+			id, err := s.handleAuth(w, r)
+			if err != nil {
+				return
+			}
+			if !id.canRead("") {
+				_ = forbid(w)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
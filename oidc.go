@@ -0,0 +1,180 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/oidc"
+)
+
+const (
+	// oidcSessionTTL is the session duration if auth.oidc.session_ttl is
+	// not set.
+	oidcSessionTTL = 24 * time.Hour
+	// oidcRetryInterval is the interval of retrying a failed discovery
+	// of the provider.
+	oidcRetryInterval = 30 * time.Second
+)
+
+// oidcProvider returns the OIDC provider of the current configuration.
+// The provider is discovered on first use, and again if its
+// configuration is reloaded. A failed discovery is retried after
+// oidcRetryInterval.
+func (s *server) oidcProvider(ctx context.Context) (*oidc.Provider, error) {
+	o := config.Get().Auth.OIDC
+	c := oidc.Config{
+		Issuer:       o.Issuer,
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       o.Scopes,
+		UserClaim:    o.UserClaim,
+		RoleClaim:    o.RoleClaim,
+		GroupClaim:   o.GroupClaim,
+		DefaultRole:  string(o.DefaultRole),
+		SessionKey:   []byte(o.SessionSecret),
+		SessionTTL:   o.SessionTTL,
+	}
+	for _, m := range o.Roles {
+		c.Roles = append(c.Roles, oidc.RoleMapping{Value: m.Value, Role: string(m.Role)})
+	}
+	if c.SessionTTL == 0 {
+		c.SessionTTL = oidcSessionTTL
+	}
+
+	p, err := s.oidcCached(&c)
+	if p != nil || err != nil {
+		return p, err
+	}
+
+	// Discover the provider without holding the lock, so that a slow
+	// provider does not block the requests of a discovered one.
+	p, err = oidc.New(ctx, c)
+
+	s.oidcMu.Lock()
+	defer s.oidcMu.Unlock()
+	if err != nil {
+		// A failed discovery is not retried for a while, unless the
+		// request is canceled.
+		if ctx.Err() == nil {
+			s.oidcFail = &oidcFailure{conf: c, err: err, at: time.Now()}
+		}
+		return nil, err
+	}
+	s.oidcConf, s.oidcProv, s.oidcFail = c, p, nil
+	return p, nil
+}
+
+// oidcCached returns the discovered provider of the given configuration,
+// or the error of its last failed discovery if it is not retried yet.
+// Both are nil if the provider needs to be discovered. It completes the
+// session key of the configuration.
+func (s *server) oidcCached(c *oidc.Config) (*oidc.Provider, error) {
+	s.oidcMu.Lock()
+	defer s.oidcMu.Unlock()
+
+	// Without a session secret, sessions are signed by a random key
+	// that is forgotten when redir restarts.
+	if len(c.SessionKey) == 0 {
+		if s.oidcKey == nil {
+			s.oidcKey = make([]byte, 32)
+			if _, err := rand.Read(s.oidcKey); err != nil {
+				s.oidcKey = nil
+				return nil, fmt.Errorf("cannot generate session key: %w", err)
+			}
+		}
+		c.SessionKey = s.oidcKey
+	}
+	if s.oidcProv != nil && reflect.DeepEqual(s.oidcConf, *c) {
+		return s.oidcProv, nil
+	}
+	if f := s.oidcFail; f != nil && reflect.DeepEqual(f.conf, *c) &&
+		time.Since(f.at) < oidcRetryInterval {
+		return nil, f.err
+	}
+	return nil, nil
+}
+
+// oidcFailure is the last failed discovery of the OIDC provider.
+type oidcFailure struct {
+	conf oidc.Config
+	err  error
+	at   time.Time
+}
+
+// oidcAuth authenticates the request by its OIDC session. GET requests
+// without a session are redirected to the provider to log in, and return
+// to the same URL afterwards.
+func (s *server) oidcAuth(w http.ResponseWriter, r *http.Request) (*identity, error) {
+	p, err := s.oidcProvider(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	sess, err := p.Session(r)
+	if err == nil {
+		return &identity{user: sess.User, role: config.Role(sess.Role), groups: sess.Groups}, nil
+	}
+
+	authFailures.Inc("oidc")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	if err := p.Login(w, r, r.URL.RequestURI()); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: login at the provider", errUnauthorized)
+}
+
+// oidcCallback completes a login at the provider, and redirects back to
+// the URL that started the login.
+func (s *server) oidcCallback(ctx context.Context, w http.ResponseWriter, r *http.Request, prefix string) error {
+	p, err := s.oidcProvider(ctx)
+	if err != nil {
+		return err
+	}
+	sess, returnTo, err := p.Callback(w, r)
+	if err != nil {
+		authFailures.Inc("oidc")
+		logging.FromContext(ctx).Warn("oidc login failed", "err", err)
+		http.Error(w, "login failed", http.StatusUnauthorized)
+		return fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	logging.FromContext(ctx).Info("oidc login", "user", sess.User, "role", sess.Role)
+
+	// The tokens of the user follow the role and groups of the login.
+	if err := s.db.UpdateTokenUser(ctx, sess.User, sess.Role, sess.Groups); err != nil {
+		logging.FromContext(ctx).Warn("cannot update tokens", "user", sess.User, "err", err)
+	}
+
+	// Only return to local URLs, so that the callback cannot redirect
+	// to somewhere else.
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") ||
+		strings.HasPrefix(returnTo, "/\\") {
+		returnTo = prefix
+	}
+	http.Redirect(w, r, returnTo, http.StatusFound)
+	return nil
+}
+
+// oidcLogout ends the OIDC session of the request.
+func (s *server) oidcLogout(ctx context.Context, w http.ResponseWriter, r *http.Request, prefix string) error {
+	p, err := s.oidcProvider(ctx)
+	if err != nil {
+		return err
+	}
+	p.Logout(w)
+	http.Redirect(w, r, prefix, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+var errCrossSite = errors.New("cross-site request is not allowed")
+
+// myData serves all visit records that are tied to the visitor cookie
+// of the requester as a JSON file.
+func (s *server) myData(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	var vid string
+	if c, err := r.Cookie(redirVidCookie); err == nil {
+		vid = c.Value
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="redir-visits.json"`)
+	if vid == "" {
+		_, _ = w.Write([]byte("[]"))
+		return nil
+	}
+
+	vs, err := s.db.FetchVisits(ctx, vid)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(vs, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, _ = w.Write(b)
+	return nil
+}
+
+// eraseMyData erases all visit records that are tied to the visitor
+// cookie of the requester, and removes the cookie.
+func (s *server) eraseMyData(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	if !sameOrigin(r) {
+		return errCrossSite
+	}
+
+	var n int64
+	if c, err := r.Cookie(redirVidCookie); err == nil && c.Value != "" {
+		n, err = s.db.EraseVisits(ctx, c.Value, "")
+		if err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: redirVidCookie, MaxAge: -1})
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(shortOutput{
+		Message: fmt.Sprintf("%d visit records have been erased.", n),
+	})
+	_, _ = w.Write(b)
+	return nil
+}
+
+// sameOrigin reports whether a request is sent from the same origin
+// of redir, if the browser tells us about it.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
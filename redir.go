@@ -9,12 +9,17 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/logging"
 	"changkun.de/x/redir/internal/models"
 	"changkun.de/x/redir/internal/short"
 	"changkun.de/x/redir/internal/version"
@@ -24,12 +29,14 @@ var (
 	daemon   = flag.Bool("s", false, "Run redir server")
 	fromfile = flag.String("f", "", "Import aliases from a YAML file")
 	dump     = flag.String("d", "", "Dump aliases from database and export as a YAML file")
-	operate  = flag.String("op", "create", "Operators, create/update/delete/fetch")
+	operate  = flag.String("op", "create", "Operators, create/update/delete/fetch/transfer")
 	alias    = flag.String("a", "", "Alias for a new link")
 	link     = flag.String("l", "", "Actual link for the alias, optional for delete/fetch")
 	private  = flag.Bool("p", false, "The link is private and will not be listed in the index page, avaliable for operator create/update")
 	trust    = flag.Bool("trust", false, "The link is either trusted to not show privacy warning page or untrusted to show privacy warning page for external redirects")
 	validt   = flag.String("vt", "", "the alias will start working from the specified time, format in RFC3339, e.g. 2006-01-02T15:04:05+07:00. Avaliable for operator create/update")
+	owner    = flag.String("owner", "", "The owner of the alias, avaliable for operator create/transfer")
+	group    = flag.String("group", "", "The group that the alias is shared with, avaliable for operator create/transfer")
 )
 
 func usage() {
@@ -43,10 +50,19 @@ GoVersion: %s
 
 Command line usage:
 
-$ redir [-s] [-f <file>] [-d <file>] [-op <operator> -a <alias> -l <link> -p -t -vt <time>]
+$ redir [-s] [-f <file>] [-d <file>] [-op <operator> -a <alias> -l <link> -p -t -vt <time> -owner <user> -group <group>]
+$ redir stats purge [-days <days>] [-apply]
+$ redir stats erase [-vid <visitor id>] [-ip <ip>]
+$ redir stats backfill
+$ redir config check
+$ redir passwd [-cost <cost>]
+$ redir token create -u <user> [-name <name>] [-scope read|create|admin] [-prefix <prefix>] [-ttl <duration>] [-role viewer|editor|admin] [-groups <groups>]
+$ redir token list [-u <user>]
+$ redir token revoke -id <id>
+$ redir stats export [-a <alias>] [-t0 <time>] [-t1 <time>] [-format csv|ndjson] [-data visits|daily] [-traffic all|human|bot] [-o <file>]
 
 options:
-`, config.Conf.Store, version.Version, runtime.Version())
+`, config.Get().Store, version.Version, runtime.Version())
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, `
 examples:
@@ -79,6 +95,33 @@ redir -op update -a changkun -l https://blog.changkun.de -vt 2022-01-01T00:00:00
 
 redir -op delete -a changkun
 	Delete the alias from database
+
+redir -op transfer -a changkun -owner alice -group blog
+	Transfer the alias to alice and share it with the members of blog
+
+echo secret | redir passwd
+	Print the bcrypt hash of a password for auth.basic
+
+redir token create -u changkun -name ci -scope create -prefix release/ -ttl 2160h
+	Create an API token that can only create aliases under release/ for 90 days
+
+redir config check
+	Validate the configuration and print it with secrets redacted
+
+redir stats purge -days 90
+	Preview how many visit records are older than 90 days
+
+redir stats purge -days 90 -apply
+	Purge visit records that are older than 90 days
+
+redir stats erase -vid 4f1e1c6c-1bd4-4b9f-9e0e-5a9d3b0f7e21
+	Erase all visit records of a visitor
+
+redir stats export -a changkun -t0 2021-11-01 -format ndjson -o visits.ndjson
+	Export visit records of an alias since 2021-11-01 as JSON Lines
+
+redir stats export -data daily -o daily.csv
+	Export daily PV/UV of all aliases as CSV
 `)
 	os.Exit(2)
 }
@@ -87,6 +130,13 @@ func main() {
 	log.SetPrefix("redir: ")
 	log.SetFlags(log.Lmsgprefix | log.LstdFlags | log.Lshortfile)
 	flag.CommandLine.Usage = usage
+
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
 
 	if len(os.Args) < 2 {
@@ -102,13 +152,102 @@ func main() {
 }
 
 func runServer() {
-	s := newServer(context.Background())
+	err := logging.Setup(config.Get().Log.Level, config.Get().Log.Format)
+	if err != nil {
+		log.Fatalf("cannot setup logging: %v", err)
+	}
+	if config.DefaultAccounts() {
+		log.Fatalf("refuse to start with the default basic auth accounts, " +
+			"configure the accounts by REDIR_CONF or REDIR_AUTH_BASIC, " +
+			"or disable basic auth by REDIR_AUTH_ENABLE")
+	}
+	warnPlaintext()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	s := newServer(ctx)
 	s.registerHandler()
-	log.Printf("serving at %s\n", config.Conf.Addr)
-	if err := http.ListenAndServe(config.Conf.Addr, nil); err != nil {
-		log.Printf("ListenAndServe %s: %v\n", config.Conf.Addr, err)
+
+	servers := []*http.Server{newHTTPServer(config.Get().Addr, http.DefaultServeMux)}
+	var watch func(context.Context)
+	if config.Get().TLS.Enable {
+		https, plain, w, err := tlsServers(http.DefaultServeMux)
+		if err != nil {
+			log.Fatalf("cannot setup TLS: %v", err)
+		}
+		servers, watch = []*http.Server{plain, https}, w
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		// Streams never finish on their own, end them so that the
+		// shutdown does not wait for them.
+		srv.RegisterOnShutdown(s.events.Close)
+
+		// Listen before serving, so that the certificate manager can
+		// answer challenges right away.
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Fatalf("cannot listen on %s: %v", srv.Addr, err)
+		}
+		slog.Info("serving", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+		go func(srv *http.Server) {
+			if srv.TLSConfig != nil {
+				errCh <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errCh <- srv.Serve(ln)
+		}(srv)
+	}
+	if watch != nil {
+		go watch(ctx)
+	}
+	go watchConfig(ctx)
+
+	c := config.Get().Server
+	select {
+	case err := <-errCh:
+		slog.Error("cannot serve", "err", err)
+	case <-ctx.Done():
+		stop() // a second signal terminates immediately.
+		slog.Info("shutting down", "drain", c.DrainDelay, "timeout", c.ShutdownTimeout)
+		s.draining.Store(true)
+		select {
+		case <-time.After(c.DrainDelay):
+		case err := <-errCh:
+			slog.Error("cannot serve", "err", err)
+		}
+	}
+
+	// Same as the timeouts of http.Server, zero means no timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.ShutdownTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.ShutdownTimeout)
+	}
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("cannot shutdown gracefully", "addr", srv.Addr, "err", err)
+		}
+	}
+	s.close(ctx)
+	slog.Info("server is stopped")
+}
+
+// newHTTPServer returns a server of the given address and handler with
+// the configured timeouts.
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	c := config.Get().Server
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
 	}
-	s.close()
 }
 
 func runCmd() {
@@ -133,7 +272,7 @@ func runCmd() {
 			flag.Usage()
 			return
 		}
-	case short.OpUpdate, short.OpDelete, short.OpFetch:
+	case short.OpUpdate, short.OpDelete, short.OpFetch, short.OpTransfer:
 		if *alias == "" {
 			flag.Usage()
 			return
@@ -168,6 +307,8 @@ func runCmd() {
 			Private:   *private,
 			Trust:     *trust,
 			ValidFrom: t.UTC(),
+			Owner:     *owner,
+			Group:     *group,
 		})
 		if err != nil {
 			log.Println(err)
@@ -0,0 +1,70 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/logging"
+)
+
+// confReloadInterval is the interval of checking whether the
+// configuration file is changed.
+const confReloadInterval = 10 * time.Second
+
+// watchConfig reloads the configuration on SIGHUP, or when the
+// configuration file is changed, until ctx is done.
+func watchConfig(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	go config.Watch(ctx, confReloadInterval, logReload)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logReload(config.Reload())
+		}
+	}
+}
+
+// logReload logs the changes of a reloaded configuration, and applies
+// the changed log settings.
+func logReload(changes []config.Change, err error) {
+	if err != nil {
+		slog.Error("cannot reload configuration, keeping the current one", "err", err)
+		return
+	}
+
+	restart, relog := 0, false
+	for _, c := range changes {
+		if c.Restart {
+			restart++
+			slog.Warn("configuration change requires a restart",
+				"field", c.Field, "old", c.Old, "new", c.New)
+			continue
+		}
+		slog.Info("configuration changed", "field", c.Field, "old", c.Old, "new", c.New)
+		relog = relog || strings.HasPrefix(c.Field, "log.")
+	}
+	if relog {
+		c := config.Get().Log
+		if err := logging.Setup(c.Level, c.Format); err != nil {
+			slog.Error("cannot setup logging", "err", err)
+		}
+	}
+	warnPlaintext()
+	slog.Info("reloaded configuration",
+		"changes", len(changes)-restart, "pending_restart", restart)
+}
@@ -11,21 +11,56 @@ import (
 	"html/template"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"changkun.de/x/redir/internal/cache"
 	"changkun.de/x/redir/internal/config"
 	"changkun.de/x/redir/internal/db"
-	"changkun.de/x/redir/internal/utils"
+	"changkun.de/x/redir/internal/events"
+	"changkun.de/x/redir/internal/geoip"
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/models"
+	"changkun.de/x/redir/internal/oidc"
+	"changkun.de/x/redir/internal/stats"
+	"changkun.de/x/redir/internal/tracing"
 )
 
 type server struct {
-	db    *db.Store
-	cache *cache.LRU
+	db     *db.Store
+	cache  *cache.LRU
+	geo    *geoip.Reader
+	events *events.Broker
+	visits chan *models.Visit // queued visits to be recorded
+	tracer *tracing.Provider  // nil if tracing is disabled
+
+	visitsMu     sync.RWMutex // protects visitsClosed and closing visits
+	visitsClosed bool
+	workers      sync.WaitGroup // visit workers
+
+	cancel context.CancelFunc // stops the periodic jobs
+	jobs   sync.WaitGroup     // periodic jobs
+
+	draining atomic.Bool // the server is shutting down
+
+	oidcMu   sync.Mutex // protects the OIDC provider
+	oidcConf oidc.Config
+	oidcProv *oidc.Provider // nil until the first OIDC login
+	oidcFail *oidcFailure   // the last failed discovery
+	oidcKey  []byte         // random session key without a session secret
 }
 
+// The visit queue buffers visits that are waiting to be recorded by the
+// visit workers.
+const (
+	visitQueueSize = 4096
+	visitWorkers   = 4
+)
+
 var (
 	//go:embed templates/x.html
 	xtmpl string
@@ -79,30 +114,166 @@ func newServer(ctx context.Context) *server {
 
 	ctx, cancel := context.WithTimeout(ctx, time.Second)
 	defer cancel()
-	db, err := db.NewStore(ctx, config.Conf.Store)
+	conf := config.Get()
+	db, err := db.NewStore(ctx, conf.Store)
 	if err != nil {
 		log.Fatalf("cannot establish connection to %s, details: \n%v",
-			config.Conf.Store, err)
+			conf.Store, err)
+	}
+	slog.Info("connected to database", "store", conf.Store)
+
+	s := &server{
+		db:     db,
+		cache:  cache.NewLRU(true),
+		events: &events.Broker{},
+		visits: make(chan *models.Visit, visitQueueSize),
+	}
+	s.registerMetrics()
+	if c := conf.Tracing; c.Enable {
+		s.tracer = tracing.NewProvider(
+			tracing.NewOTLPExporter(c.Endpoint, c.ServiceName, nil), c.SampleRatio)
+		tracing.SetProvider(s.tracer)
+		slog.Info("tracing is enabled", "endpoint", c.Endpoint)
+	}
+	if f := conf.Stats.GeoIPDB; conf.Stats.Enable && f != "" {
+		s.geo, err = geoip.Open(f)
+		if err != nil {
+			log.Fatalf("cannot load GeoIP database: %v", err)
+		}
+		slog.Info("loaded GeoIP database", "path", f)
+	}
+	if conf.Stats.Enable {
+		s.workers.Add(visitWorkers)
+		for i := 0; i < visitWorkers; i++ {
+			go func() {
+				defer s.workers.Done()
+				s.recordVisits()
+			}()
+		}
+	}
+
+	jobs, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.jobs.Add(1)
+	go func() {
+		defer s.jobs.Done()
+		clearBlocklist(jobs)
+	}()
+	if conf.Stats.Enable {
+		s.jobs.Add(1)
+		go func() {
+			defer s.jobs.Done()
+			s.backfill(jobs)
+		}()
+	}
+	if conf.Stats.Enable && conf.Stats.Retention.Days > 0 {
+		s.jobs.Add(1)
+		go func() {
+			defer s.jobs.Done()
+			s.purge(jobs)
+		}()
 	}
-	log.Printf("connected to %s", config.Conf.Store)
-	return &server{db: db, cache: cache.NewLRU(true)}
+	return s
 }
 
-func (s *server) close() {
-	log.Println(s.db.Close())
+// backfill hashes the unique visitors of the visit records that were
+// recorded before the hashes existed, so that their UVs can be estimated
+// without running `redir stats backfill` by hand.
+func (s *server) backfill(ctx context.Context) {
+	n, err := s.db.BackfillVisits(ctx, "uv_hash", db.HashVisitor)
+	if err != nil && ctx.Err() == nil {
+		slog.Error("cannot backfill unique visitor hashes", "err", err)
+	} else if n > 0 {
+		slog.Info("backfilled unique visitor hashes", "count", n)
+	}
+}
+
+// purge expires the visit records periodically according to the
+// configured retention policy until ctx is done.
+func (s *server) purge(ctx context.Context) {
+	conf := config.Get()
+	days := conf.Stats.Retention.Days
+	rollup := conf.Stats.Retention.Rollup
+
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	for {
+		pctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+		n, err := stats.Purge(pctx, s.db, days, rollup, true)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot purge expired visits", "err", err)
+		} else if n > 0 {
+			slog.Info("purged expired visits", "count", n, "days", days)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// close stops the server in order: the periodic jobs and visit streams
+// first, then the visit workers after the queued visits are recorded,
+// then the tracer, and the database connection at last. Queued visits
+// that are not recorded until ctx is done are lost.
+func (s *server) close(ctx context.Context) {
+	s.cancel()
+	s.cache.Stop()
+	s.events.Close()
+	s.jobs.Wait()
+
+	s.visitsMu.Lock()
+	s.visitsClosed = true
+	close(s.visits)
+	s.visitsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Error("cannot record all queued visits", "lost", len(s.visits))
+	}
+
+	if s.tracer != nil {
+		tctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.tracer.Shutdown(tctx); err != nil {
+			slog.Error("cannot export spans", "err", err)
+		}
+		cancel()
+	}
+	if err := s.db.Close(); err != nil {
+		slog.Error("cannot close database", "err", err)
+	}
 }
 
 func (s *server) registerHandler() {
-	l := utils.Logging()
+	l := func(h http.Handler) http.Handler {
+		return logging.Middleware(tracing.Middleware(h))
+	}
+
+	conf := config.Get()
 
 	// semantic shortener (default)
-	log.Println("router /s is enabled.")
-	http.Handle(config.Conf.S.Prefix, l(s.sHandler()))
+	slog.Info("router is enabled", "prefix", conf.S.Prefix)
+	http.Handle(conf.S.Prefix, l(s.sHandler()))
 
 	// repo redirector
-	if config.Conf.X.Enable {
-		log.Println("router /x is enabled.")
-		http.Handle(config.Conf.X.Prefix, l(s.xHandler()))
+	if conf.X.Enable {
+		slog.Info("router is enabled", "prefix", conf.X.Prefix)
+		http.Handle(conf.X.Prefix, l(s.xHandler()))
+	}
+
+	// metrics
+	if conf.Metrics.Enable {
+		slog.Info("router is enabled", "prefix", conf.Metrics.Path)
+		http.Handle(conf.Metrics.Path, s.metricsHandler())
 	}
 }
 
@@ -112,11 +283,12 @@ func (s *server) registerHandler() {
 // imports by checking out code from repoPath using the configured VCS.
 func (s *server) xHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
-		importPath := strings.TrimSuffix(req.Host+config.Conf.X.Prefix, "/")
+		conf := config.Get()
+		importPath := strings.TrimSuffix(req.Host+conf.X.Prefix, "/")
 		path := strings.TrimSuffix(req.Host+req.URL.Path, "/")
 		var importRoot, repoRoot, suffix string
 		if path == importPath {
-			http.Redirect(w, req, config.Conf.X.GoDocHost+importPath, http.StatusFound)
+			http.Redirect(w, req, conf.X.GoDocHost+importPath, http.StatusFound)
 			return
 		}
 		elem := path[len(importPath)+1:]
@@ -124,7 +296,7 @@ func (s *server) xHandler() http.HandlerFunc {
 			elem, suffix = elem[:i], elem[i:]
 		}
 		importRoot = importPath + "/" + elem
-		repoRoot = config.Conf.X.RepoPath + "/" + elem
+		repoRoot = conf.X.RepoPath + "/" + elem
 
 		// Handling 'git clone https://changkun.de/x/repo'.
 		if suffix == "/info/refs" && strings.HasPrefix(req.URL.Query().Get("service"), "git-") && elem != "" {
@@ -139,7 +311,7 @@ func (s *server) xHandler() http.HandlerFunc {
 			Suffix     string
 		}{
 			ImportRoot: importRoot,
-			VCS:        config.Conf.X.VCS,
+			VCS:        conf.X.VCS,
 			VCSRoot:    repoRoot,
 			Suffix:     suffix,
 		}
@@ -11,7 +11,7 @@ import (
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"path/filepath"
@@ -20,9 +20,14 @@ import (
 	"time"
 
 	"changkun.de/x/redir/internal/config"
+	"changkun.de/x/redir/internal/db"
+	"changkun.de/x/redir/internal/events"
+	"changkun.de/x/redir/internal/logging"
 	"changkun.de/x/redir/internal/models"
 	"changkun.de/x/redir/internal/short"
+	"changkun.de/x/redir/internal/tracing"
 	"changkun.de/x/redir/internal/utils"
+	"changkun.de/x/redir/internal/visitor"
 )
 
 // sHandler redirects the current request to a known link if the alias is
@@ -31,8 +36,8 @@ func (s *server) sHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 		// for development.
-		if config.Conf.CORS {
-			log.Println("CORS is activated.")
+		if config.Get().CORS {
+			slog.Debug("CORS is activated.")
 			w.Header().Set("Access-Control-Allow-Headers", "*")
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
@@ -43,7 +48,7 @@ func (s *server) sHandler() http.Handler {
 			// nothing, really.
 		case http.MethodPost:
 			s.sHandlerPost(w, r)
-		case http.MethodGet:
+		case http.MethodGet, http.MethodHead:
 			w.Header().Set("Cache-Control", "no-store")
 			w.Header().Set("Cache-Control", "max-age=0")
 			s.sHandlerGet(w, r)
@@ -70,6 +75,11 @@ type shortOutput struct {
 // to use. We are currently limited the single index router, which is the /s.
 func (s *server) sHandlerPost(w http.ResponseWriter, r *http.Request) {
 	var err error
+	r, span := startSpan(r, "sHandlerPost")
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	defer func() {
 		if err != nil {
 			b, _ := json.Marshal(shortOutput{
@@ -80,11 +90,21 @@ func (s *server) sHandlerPost(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
+	// Visitors can erase their own visit records without authentication.
+	if conf := config.Get(); conf.Stats.Enable && r.URL.Path == conf.S.Prefix+".mydata" {
+		err = s.eraseMyData(r.Context(), w, r)
+		return
+	}
+
 	// All post request must be authenticated.
-	user, err := s.handleAuth(w, r)
+	id, err := s.handleAuth(w, r)
 	if err != nil {
 		return
 	}
+	if r.URL.Path == config.Get().S.Prefix+".tokens" {
+		err = s.tokensPost(r.Context(), w, r, id)
+		return
+	}
 
 	w.Header().Add("Content-Type", "application/json")
 
@@ -96,6 +116,8 @@ func (s *server) sHandlerPost(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	span.SetAttributes(tracing.String("redir.op", string(red.Op)))
+
 	// Validating the operator and decode the redir data
 	if !short.Op(red.Op).Valid() {
 		err = errors.New("unsupported operator")
@@ -112,33 +134,76 @@ func (s *server) sHandlerPost(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	redir.UpdatedBy = user
+	redir.UpdatedBy = id.user
+
+	// API tokens are limited to their scopes and alias prefixes. An
+	// update is checked against both the old and the new alias, and the
+	// role of the user is checked by short.Edit.
+	aliases := []string{red.Alias}
+	switch red.Op {
+	case short.OpCreate:
+		aliases = []string{redir.Alias}
+	case short.OpUpdate:
+		aliases = append(aliases, redir.Alias)
+	}
+	for _, a := range aliases {
+		if !id.can(red.Op, a) {
+			err = forbid(w)
+			return
+		}
+	}
 
 	// Edit redirect data.
-	err = short.Edit(r.Context(), s.db, short.Op(red.Op), red.Alias, &redir)
-	if err == nil {
+	err = short.Edit(r.Context(), s.db, id.actor(), short.Op(red.Op), red.Alias, &redir)
+	switch {
+	case err == nil:
 		// Flush the cache so that the changes can be effected immediately.
 		s.cache.Flush()
+	case errors.Is(err, short.ErrForbidden):
+		err = forbid(w)
 	}
 }
 
 // sHandlerGet is the core of redir service. It redirects a given
 // alias to the actual destination.
+//
+// HEAD requests are served without side effects: the visit is not
+// recorded, a repository link is not stored, and a PDF is not fetched.
 func (s *server) sHandlerGet(w http.ResponseWriter, r *http.Request) {
-	var err error
+	var (
+		err     error
+		start   = time.Now()
+		outcome string // only set for short link requests
+		head    = r.Method == http.MethodHead
+	)
+	r, span := startSpan(r, "sHandlerGet")
+	defer func() {
+		if outcome != "" {
+			span.SetAttributes(tracing.String("redir.outcome", outcome))
+		}
+		span.SetError(err)
+		span.End()
+	}()
 	defer func() {
 		if err != nil && !errors.Is(err, errUnauthorized) {
 			// Just redirect the user we could not find the record rather than
 			// throw 50x. The server logs should be able to identify the issue.
-			log.Printf("request err: %v\n", err)
+			logging.FromContext(r.Context()).Warn("request failed", "err", err)
 			http.Redirect(w, r, "/404.html", http.StatusTemporaryRedirect)
+			if outcome != "" {
+				outcome = outcomeNotFound
+			}
+		}
+		if outcome != "" {
+			observe(outcome, start)
 		}
 	}()
 
 	ctx := r.Context()
 
 	// statistic page
-	prefix := config.Conf.S.Prefix
+	conf := config.Get()
+	prefix := conf.S.Prefix
 
 	// URLs with /s/.* is reserved for internal usage.
 	if strings.HasPrefix(r.URL.Path, prefix+".") {
@@ -156,38 +221,46 @@ func (s *server) sHandlerGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Only allow valid aliases.
+	outcome = outcomeRedirect
+	logging.AddAttrs(ctx, slog.String("alias", alias))
 	if !short.Validity.MatchString(alias) {
 		err = short.ErrInvalidAlias
 		return
 	}
 
-	// Process visitor information, wait maximum 5 seconds.
-	if config.Conf.Stats.Enable {
-		recordCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		defer cancel()
-		s.recognizeVisitor(recordCtx, w, r, alias)
+	// Process visitor information. HEAD requests are recorded as bot
+	// visits, see visitor.IsBot.
+	if conf.Stats.Enable {
+		s.recognizeVisitor(w, r, alias)
 	}
 
 	// Figure out redirect location
+	_, cspan := tracing.Start(ctx, "cache.Get", tracing.KindInternal,
+		tracing.String("alias", alias))
 	red, ok := s.cache.Get(alias)
+	cspan.SetAttributes(tracing.Bool("cache.hit", ok))
+	cspan.End()
 	if !ok {
 		red, err = s.checkdb(ctx, alias)
 		if err != nil {
-			red, err = s.checkvcs(ctx, alias)
+			red, err = s.checkvcs(ctx, alias, !head)
 			if err != nil {
 				return
 			}
 		}
-		s.cache.Put(alias, red)
+		if !head {
+			s.cache.Put(alias, red)
+		}
 	}
 
 	// Send a wait page if time does not permitting
 	if time.Now().UTC().Sub(red.ValidFrom.UTC()) < 0 {
+		outcome = outcomeWait
 		err = waitTmpl.Execute(w, &pageInfo{
 			ValidFrom:     red.ValidFrom.UTC().Format("2006-01-02T15:04:05"),
-			ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-			ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-			ShowContact:   config.Conf.GDPR.Contact.Enable,
+			ShowImpressum: conf.GDPR.Impressum.Enable,
+			ShowPrivacy:   conf.GDPR.Privacy.Enable,
+			ShowContact:   conf.GDPR.Contact.Enable,
 		})
 		return
 	}
@@ -210,13 +283,15 @@ func (s *server) sHandlerGet(w http.ResponseWriter, r *http.Request) {
 		// If a redirect is accidentally configured as non-trustable,
 		// but still an internal website, then we don't show the warn page.
 		if !allowRedir && !strings.Contains(red.URL, r.Host) {
+			outcome = outcomeWarn
 			err = warnTmpl.Execute(w, &pageInfo{
-				OwnerName:     config.Conf.GDPR.Owner.Name,
-				OwnerDomain:   config.Conf.GDPR.Owner.Domain,
+				OwnerName:     conf.GDPR.Owner.Name,
+				OwnerDomain:   conf.GDPR.Owner.Domain,
 				URL:           red.URL,
-				ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-				ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-				ShowContact:   config.Conf.GDPR.Contact.Enable,
+				AskConsent:    askConsent(r),
+				ShowImpressum: conf.GDPR.Impressum.Enable,
+				ShowPrivacy:   conf.GDPR.Privacy.Enable,
+				ShowContact:   conf.GDPR.Contact.Enable,
 			})
 			return
 		}
@@ -225,14 +300,33 @@ func (s *server) sHandlerGet(w http.ResponseWriter, r *http.Request) {
 	// If this is a page that refers to a PDF, we prefer serve it as a PDF
 	// content directly rather than redirect.
 	if strings.HasSuffix(red.URL, ".pdf") {
+		outcome = outcomePDF
+		if head {
+			w.Header().Set("Content-Type", "application/pdf")
+			return
+		}
+		_, pspan := tracing.Start(ctx, "pdf.proxy", tracing.KindClient,
+			tracing.String("http.url", red.URL))
+		defer pspan.End()
+
 		var resp *http.Response
 		resp, err = http.Get(red.URL)
 		if err != nil {
+			pspan.SetError(err)
 			return
 		}
 		defer resp.Body.Close()
+		pspan.SetAttributes(tracing.Int("http.status_code", resp.StatusCode))
 
+		// A large PDF may take longer than the write timeout of the
+		// server.
+		err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			pspan.SetError(err)
+			return
+		}
 		_, err = io.Copy(w, resp.Body)
+		pspan.SetError(err)
 		return
 	}
 
@@ -247,6 +341,8 @@ type pageInfo struct {
 	ValidFrom     string
 	Body          template.HTML
 	Email         string
+	AskConsent    bool
+	ShowMyData    bool
 	ShowImpressum bool
 	ShowPrivacy   bool
 	ShowContact   bool
@@ -258,6 +354,7 @@ func (s *server) serveStatic(
 	r *http.Request,
 	prefix string,
 ) error {
+	conf := config.Get()
 	var (
 		t *template.Template
 		d *pageInfo
@@ -285,35 +382,72 @@ func (s *server) serveStatic(
 		}
 		_, err = w.Write(b)
 		return err
+	case r.URL.Path == prefix+".healthz":
+		s.healthz(w, r)
+		return nil
+	case r.URL.Path == prefix+".readyz":
+		s.readyz(ctx, w, r)
+		return nil
+	case r.URL.Path == prefix+".version":
+		s.versionz(w, r)
+		return nil
+	case r.URL.Path == prefix+".tokens":
+		return s.tokensGet(ctx, w, r)
+	case r.URL.Path == prefix+".oidc/callback":
+		if conf.Auth.Enable != config.OIDC {
+			return nil
+		}
+		return s.oidcCallback(ctx, w, r, prefix)
+	case r.URL.Path == prefix+".oidc/logout":
+		if conf.Auth.Enable != config.OIDC {
+			return nil
+		}
+		return s.oidcLogout(ctx, w, r, prefix)
+	case strings.HasPrefix(r.URL.Path, prefix+".stream"):
+		if !conf.Stats.Enable {
+			return nil
+		}
+		return s.stream(ctx, w, r)
+	case strings.HasPrefix(r.URL.Path, prefix+".export"):
+		if !conf.Stats.Enable {
+			return nil
+		}
+		return s.export(ctx, w, r)
+	case strings.HasPrefix(r.URL.Path, prefix+".mydata"):
+		if !conf.Stats.Enable {
+			return nil
+		}
+		return s.myData(ctx, w, r)
 	case strings.HasPrefix(r.URL.Path, prefix+".impressum"):
-		if config.Conf.GDPR.Impressum.Enable {
+		if conf.GDPR.Impressum.Enable {
 			t = impressumTmpl
 		}
 		d = &pageInfo{
-			Body:          template.HTML(config.Conf.GDPR.Impressum.Content),
-			ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-			ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-			ShowContact:   config.Conf.GDPR.Contact.Enable,
+			Body:          template.HTML(conf.GDPR.Impressum.Content),
+			ShowImpressum: conf.GDPR.Impressum.Enable,
+			ShowPrivacy:   conf.GDPR.Privacy.Enable,
+			ShowContact:   conf.GDPR.Contact.Enable,
 		}
 	case strings.HasPrefix(r.URL.Path, prefix+".privacy"):
-		if config.Conf.GDPR.Privacy.Enable {
+		if conf.GDPR.Privacy.Enable {
 			t = privacyTmpl
 		}
 		d = &pageInfo{
-			Body:          template.HTML(config.Conf.GDPR.Privacy.Content),
-			ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-			ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-			ShowContact:   config.Conf.GDPR.Contact.Enable,
+			Body:          template.HTML(conf.GDPR.Privacy.Content),
+			ShowMyData:    conf.Stats.Enable,
+			ShowImpressum: conf.GDPR.Impressum.Enable,
+			ShowPrivacy:   conf.GDPR.Privacy.Enable,
+			ShowContact:   conf.GDPR.Contact.Enable,
 		}
 	case strings.HasPrefix(r.URL.Path, prefix+".contact"):
-		if config.Conf.GDPR.Contact.Enable {
+		if conf.GDPR.Contact.Enable {
 			t = contactTmpl
 		}
 		d = &pageInfo{
-			Email:         config.Conf.GDPR.Contact.Email,
-			ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-			ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-			ShowContact:   config.Conf.GDPR.Contact.Enable,
+			Email:         conf.GDPR.Contact.Email,
+			ShowImpressum: conf.GDPR.Impressum.Enable,
+			ShowPrivacy:   conf.GDPR.Privacy.Enable,
+			ShowContact:   conf.GDPR.Contact.Enable,
 		}
 	}
 	if t != nil {
@@ -323,52 +457,174 @@ func (s *server) serveStatic(
 }
 
 const (
-	redirVidCookie   = "redir_vid"
-	redirAllowCookie = "redir_allow"
+	redirVidCookie     = "redir_vid"
+	redirAllowCookie   = "redir_allow"
+	redirConsentCookie = "redir_consent"
 )
 
 // recognizeVisitor implements a best effort visitor recording.
 //
 // If the redir's cookie is presented, then we use cookie id.
 // If the cookie does not present any data, we read the IP address, and
-// allocates a new visitor id for the visitor.
+// allocates a new visitor id for the visitor. Visitors without the cookie
+// are counted by their IP address.
+//
+// If the visitor opts out from tracking via Do Not Track or Global
+// Privacy Control, the visit is either recorded anonymously or not
+// recorded at all. In consent mode, the visitor cookie is neither read
+// nor set until the visitor accepted it. HEAD requests never set the
+// cookie either.
 //
-// We don't care if any error happens inside.
+// The visit is recorded asynchronously by the visit workers, so that the
+// redirect is never blocked by the database. If the visit queue is full,
+// the visit is dropped. We don't care if any error happens inside.
 func (s *server) recognizeVisitor(
-	ctx context.Context,
 	w http.ResponseWriter,
 	r *http.Request,
 	alias string,
 ) {
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	_, span := tracing.Start(r.Context(), "recognizeVisitor", tracing.KindInternal,
+		tracing.String("alias", alias))
+	defer span.End()
 
-	var cookieVid string
-	c, err := r.Cookie(redirVidCookie)
-	if err != nil {
-		cookieVid = ""
-	} else {
-		cookieVid = c.Value
+	v := &models.Visit{
+		Alias: alias,
+		Time:  time.Now().UTC(),
+		Bot:   visitor.IsBot(r),
+	}
+	if optedOut(r) {
+		switch config.Get().GDPR.DNT {
+		case config.DNTSkip:
+			return
+		case config.DNTAnonymous:
+			v.Anonymous = true
+		}
+	}
+
+	useCookie := !v.Anonymous && consented(r)
+	if !v.Anonymous {
+		if c, err := r.Cookie(redirVidCookie); err == nil && useCookie {
+			v.VisitorID = c.Value
+		}
+		if s.geo != nil {
+			loc, err := s.geo.Locate(utils.RealIP(r))
+			if err != nil {
+				logging.FromContext(r.Context()).Warn("cannot locate visitor",
+					"alias", alias, "err", err)
+			}
+			v.Country, v.City = loc.Country, loc.City
+		}
+		v.IP = utils.ReadIP(r)
+		v.UA = r.UserAgent()
+		v.Referer = r.Referer()
+
+		ref := visitor.ParseReferer(v.Referer)
+		v.RefererHost, v.RefererClass = ref.Host, ref.Class
+
+		ua := visitor.ParseUA(v.UA)
+		v.Browser, v.BrowserVersion = ua.Browser, ua.BrowserVersion
+		v.OS, v.Device = ua.OS, ua.Device
+	}
+
+	// Allocate a new visitor id if the visitor is new, so that the
+	// cookie can be set before the visit is recorded. Without the cookie,
+	// the id would be different on every visit, hence the visit is
+	// recorded without one.
+	setCookie := useCookie && r.Method != http.MethodHead
+	if v.VisitorID == "" && setCookie {
+		id, err := utils.NewUUID()
+		if err != nil {
+			panic(err) // impossible unless system error.
+		}
+		v.VisitorID = id.String()
 	}
 
 	// count visit and set cookie.
-	vid, err := s.db.RecordVisit(ctx, &models.Visit{
-		VisitorID: cookieVid,
-		Alias:     alias,
-		IP:        utils.ReadIP(r),
-		UA:        r.UserAgent(),
-		Referer:   r.Referer(),
-		Time:      time.Now().UTC(),
-	})
-	if err != nil {
-		log.Printf("cannot record alias %s's visit: %v", alias, err)
-	} else {
-		w.Header().Set("Set-Cookie", redirVidCookie+"="+vid)
+	if !s.enqueueVisit(v) {
+		visitsDropped.Inc()
+		logging.FromContext(r.Context()).Warn("cannot record visit: visit queue is full or closed",
+			"alias", alias)
+		return
+	}
+	if setCookie {
+		w.Header().Set("Set-Cookie", redirVidCookie+"="+v.VisitorID)
+	}
+}
+
+// enqueueVisit queues the given visit without blocking. It reports
+// whether the visit is queued, which fails if the queue is full or
+// already closed on shutdown.
+func (s *server) enqueueVisit(v *models.Visit) bool {
+	s.visitsMu.RLock()
+	defer s.visitsMu.RUnlock()
+	if s.visitsClosed {
+		return false
+	}
+	select {
+	case s.visits <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordVisits records the queued visits until the queue is closed.
+func (s *server) recordVisits() {
+	for v := range s.visits {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := s.db.RecordVisit(ctx, v)
+		cancel()
+		if err != nil {
+			slog.Error("cannot record visit", "alias", v.Alias, "err", err)
+			continue
+		}
+
+		s.events.Publish(events.Visit{
+			Alias:   v.Alias,
+			Time:    v.Time,
+			Referer: v.RefererHost,
+			Country: v.Country,
+			Bot:     v.Bot,
+		})
+	}
+}
+
+// optedOut reports whether the visitor opts out from tracking via the
+// Do Not Track or Global Privacy Control signals.
+func optedOut(r *http.Request) bool {
+	return r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// consented reports whether the visitor cookie can be used. It is always
+// true unless the consent mode is enabled.
+func consented(r *http.Request) bool {
+	if !config.Get().GDPR.Consent {
+		return true
 	}
+	c, err := r.Cookie(redirConsentCookie)
+	return err == nil && c.Value == "1"
+}
+
+// askConsent reports whether the visitor should be asked for accepting
+// the visitor cookie, which is the case if the visitor has not decided
+// yet in consent mode.
+func askConsent(r *http.Request) bool {
+	if conf := config.Get(); !conf.Stats.Enable || !conf.GDPR.Consent || optedOut(r) {
+		return false
+	}
+	_, err := r.Cookie(redirConsentCookie)
+	return err != nil
 }
 
 // checkdb checks whether the given alias is exsited in the redir database
-func (s *server) checkdb(ctx context.Context, alias string) (*models.Redir, error) {
+func (s *server) checkdb(ctx context.Context, alias string) (_ *models.Redir, err error) {
+	ctx, span := tracing.Start(ctx, "checkdb", tracing.KindInternal,
+		tracing.String("alias", alias))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	a, err := s.db.FetchAlias(ctx, alias)
 	if err != nil {
 		return nil, err
@@ -377,11 +633,18 @@ func (s *server) checkdb(ctx context.Context, alias string) (*models.Redir, erro
 }
 
 // checkvcs checks whether the given alias is an repository on VCS, if so,
-// then creates a new alias and returns url of the vcs repository.
-func (s *server) checkvcs(ctx context.Context, alias string) (*models.Redir, error) {
+// then creates a new alias if store is true, and returns url of the vcs
+// repository.
+func (s *server) checkvcs(ctx context.Context, alias string, store bool) (_ *models.Redir, err error) {
+	ctx, span := tracing.Start(ctx, "checkvcs", tracing.KindInternal,
+		tracing.String("alias", alias))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 
 	// construct the try path and make the request to vcs
-	repoPath := config.Conf.X.RepoPath
+	repoPath := config.Get().X.RepoPath
 	repoPath = strings.TrimSuffix(repoPath, "/*")
 	tryPath := fmt.Sprintf("%s/%s", repoPath, alias)
 	resp, err := http.Get(tryPath)
@@ -407,6 +670,9 @@ func (s *server) checkvcs(ctx context.Context, alias string) (*models.Redir, err
 		Trust:     false,
 		ValidFrom: time.Now().UTC(),
 	}
+	if !store {
+		return r, nil
+	}
 	err = s.db.StoreAlias(ctx, r)
 	if err != nil {
 		return s.checkdb(ctx, alias)
@@ -431,11 +697,14 @@ var (
 //
 // If the query parameter contaisn mode=stat, then it returns application/json
 // data, which contains data for data visualizations in the index page.
+// Stats across all aliases, i.e. without the a query parameter, are only
+// accessible to admins.
 func (s *server) sIndex(
 	ctx context.Context,
 	w http.ResponseWriter,
 	r *http.Request,
 ) error {
+	conf := config.Get()
 	e := struct {
 		AdminView     bool
 		StatsMode     bool
@@ -443,40 +712,53 @@ func (s *server) sIndex(
 		ShowImpressum bool
 		ShowPrivacy   bool
 		ShowContact   bool
+		User          string
+		Role          config.Role
 	}{
 		AdminView:     false,
-		StatsMode:     config.Conf.Stats.Enable,
-		DevMode:       config.Conf.Development,
-		ShowImpressum: config.Conf.GDPR.Impressum.Enable,
-		ShowPrivacy:   config.Conf.GDPR.Privacy.Enable,
-		ShowContact:   config.Conf.GDPR.Contact.Enable,
+		StatsMode:     conf.Stats.Enable,
+		DevMode:       conf.Development,
+		ShowImpressum: conf.GDPR.Impressum.Enable,
+		ShowPrivacy:   conf.GDPR.Privacy.Enable,
+		ShowContact:   conf.GDPR.Contact.Enable,
 	}
 
 	mode := r.URL.Query().Get("mode")
 	switch mode {
-	case "stats": // stats data is public to everyone
-		if config.Conf.Stats.Enable {
+	case "stats": // stats data is public to everyone, except instance stats
+		if conf.Stats.Enable {
+			if r.URL.Query().Get("a") == "" {
+				id, err := s.handleAuth(w, r)
+				if err != nil {
+					return err
+				}
+				if !id.canRead("") {
+					return forbid(w)
+				}
+			}
 			err := s.statData(ctx, w, r)
 			if !errors.Is(err, errInvalidStatParam) {
 				return err
 			}
-			log.Println(err)
+			logging.FromContext(ctx).Warn("invalid stat request", "err", err)
 		}
 	case "index": // public visible index data
 		return s.indexData(ctx, w, r, true)
 	case "index-pro": // data with statistics
 		return s.indexData(ctx, w, r, false)
 	case "admin":
-		_, err := s.handleAuth(w, r)
+		id, err := s.handleAuth(w, r)
 		if err != nil {
 			return err
 		}
+		if !id.canRead("") {
+			return forbid(w)
+		}
 		e.AdminView = true
+		e.User, e.Role = id.user, id.role
 	default:
-		// Process visitor information for public index, wait maximum 5 seconds.
-		recordCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		defer cancel()
-		s.recognizeVisitor(recordCtx, w, r, "")
+		// Process visitor information for public index.
+		s.recognizeVisitor(w, r, "")
 	}
 
 	// Serve the index page.
@@ -498,10 +780,22 @@ func (s *server) indexData(
 	public bool,
 ) error {
 	if !public {
-		_, err := s.handleAuth(w, r)
+		id, err := s.handleAuth(w, r)
 		if err != nil {
 			return err
 		}
+		if !id.canRead("") {
+			return forbid(w)
+		}
+	}
+	traffic := db.TrafficAll
+	if t := r.URL.Query().Get("traffic"); t != "" {
+		traffic = db.Traffic(t)
+		if !traffic.Valid() {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = fmt.Fprintf(w, "%s traffic is not supported", t)
+			return nil
+		}
 	}
 	w.Header().Add("Content-Type", "application/json")
 
@@ -517,7 +811,9 @@ func (s *server) indexData(
 		pageNum = 1
 	}
 
-	rs, total, err := s.db.FetchAliasAll(ctx, public, int64(pageSize), int64(pageNum))
+	owner := r.URL.Query().Get("owner")
+	rs, total, err := s.db.FetchAliasAll(ctx, public, owner, traffic,
+		int64(pageSize), int64(pageNum))
 	if err != nil {
 		return err
 	}
@@ -547,42 +843,131 @@ func (s *server) statData(
 	}()
 
 	params := r.URL.Query()
-	a := params.Get("a")
-	if a == "" {
-		retErr = fmt.Errorf("%s: alias (a)", errMissingStatParam)
-		return
-	}
-
 	stat := params.Get("stat")
 	if stat == "" {
 		retErr = fmt.Errorf("%s: stat mode (stat)", errMissingStatParam)
 		return
 	}
 
-	start, end, err := parseDuration(params)
+	// Without an alias, the stats are computed across all aliases.
+	a := params.Get("a")
+	switch stat {
+	case "referer", "ua":
+		if a == "" {
+			retErr = fmt.Errorf("%s: alias (a)", errMissingStatParam)
+			return
+		}
+	case "aliases", "links":
+		if a != "" {
+			retErr = fmt.Errorf("%s stat mode does not support an alias", stat)
+			return
+		}
+	}
+
+	loc := time.UTC
+	if tz := params.Get("tz"); tz != "" {
+		l, err := time.LoadLocation(tz)
+		if err != nil || l == time.Local {
+			retErr = fmt.Errorf("%s timezone is not supported", tz)
+			return
+		}
+		loc = l
+	}
+
+	start, end, err := parseDuration(params, loc)
 	if err != nil {
 		retErr = fmt.Errorf("%s: %v", errInvalidStatParam, err)
 		return
 	}
 
+	g := db.GranularityHour
+	if v := params.Get("granularity"); v != "" {
+		g = db.Granularity(v)
+		if !g.Valid() {
+			retErr = fmt.Errorf("%s granularity is not supported", v)
+			return
+		}
+	}
+
+	traffic := db.TrafficAll
+	if t := params.Get("traffic"); t != "" {
+		traffic = db.Traffic(t)
+		if !traffic.Valid() {
+			retErr = fmt.Errorf("%s traffic is not supported", t)
+			return
+		}
+	}
+
 	w.Header().Add("Content-Type", "application/json")
 
 	var results interface{}
 	switch stat {
 	case "referer":
-		results, err = s.db.StatReferer(ctx, a, start, end)
+		results, err = s.db.StatReferer(ctx, a, start, end, traffic)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "referer-domain":
+		results, err = s.db.StatRefererDomain(ctx, a, start, end, traffic)
 		if err != nil {
 			retErr = err
 			return
 		}
 	case "ua":
-		results, err = s.db.StatUA(ctx, a, start, end)
+		results, err = s.db.StatUA(ctx, a, start, end, traffic)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "browser":
+		results, err = s.db.StatBrowser(ctx, a, start, end, traffic)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "os":
+		results, err = s.db.StatOS(ctx, a, start, end, traffic)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "device":
+		results, err = s.db.StatDevice(ctx, a, start, end, traffic)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "country":
+		results, err = s.db.StatCountry(ctx, a, start, end, traffic)
 		if err != nil {
 			retErr = err
 			return
 		}
 	case "time":
-		results, err = s.db.StatVisitHist(ctx, a, start, end)
+		results, err = s.db.StatVisitHist(ctx, a, start, end, traffic, g, loc)
+		if errors.Is(err, db.ErrTooManyBuckets) {
+			return badStatRequest(w, err)
+		}
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "aliases":
+		n, err := strconv.ParseInt(params.Get("n"), 10, 64)
+		if err != nil || n <= 0 || n > 100 {
+			n = 10
+		}
+		results, err = s.db.StatAliases(ctx, start, end, traffic, n)
+		if err != nil {
+			retErr = err
+			return
+		}
+	case "links":
+		results, err = s.db.StatLinks(ctx, start, end, g, loc)
+		if errors.Is(err, db.ErrTooManyBuckets) {
+			return badStatRequest(w, err)
+		}
 		if err != nil {
 			retErr = err
 			return
@@ -601,24 +986,65 @@ func (s *server) statData(
 	return
 }
 
-func parseDuration(p url.Values) (start, end time.Time, err error) {
+// badStatRequest responds a stat request that cannot be served with the
+// given parameters by a bad request and the reason.
+func badStatRequest(w http.ResponseWriter, err error) error {
+	b, _ := json.Marshal(shortOutput{Message: err.Error()})
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(b)
+	return nil
+}
+
+// parseDuration parses the time range of the t0 and t1 parameters, which
+// are either RFC3339 timestamps or dates in the given location. A date t1
+// includes the whole day. The time range is the last week by default, or
+// the last day for the minute granularity, which would exceed the
+// maximum number of buckets of a week.
+func parseDuration(p url.Values, loc *time.Location) (start, end time.Time, err error) {
 	t0 := p.Get("t0")
 	if t0 != "" {
-		start, err = time.Parse("2006-01-02", t0)
+		start, err = parseTime(t0, loc)
 		if err != nil {
 			return
 		}
+	} else if db.Granularity(p.Get("granularity")) == db.GranularityMinute {
+		start = time.Now().UTC().Add(-time.Hour * 24) // last day
 	} else {
 		start = time.Now().UTC().Add(-time.Hour * 24 * 7) // last week
 	}
 	t1 := p.Get("t1")
 	if t1 != "" {
-		end, err = time.Parse("2006-01-02", t1)
+		end, err = parseEnd(t1, loc)
 		if err != nil {
 			return
 		}
 	} else {
 		end = time.Now().UTC()
 	}
+	if !start.Before(end) {
+		err = fmt.Errorf("t0 must be before t1")
+	}
 	return
 }
+
+func parseTime(v string, loc *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, loc)
+}
+
+// parseEnd is like parseTime, but parses the exclusive end of a time
+// range, such that a date ends at the beginning of the next day.
+func parseEnd(v string, loc *time.Location) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", v, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.AddDate(0, 0, 1), nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"changkun.de/x/redir/internal/short"
+)
+
+var errStreamUnsupported = errors.New("streaming is not supported")
+
+// heartbeat is the interval of comments that keep idle streams alive
+// through proxies.
+const heartbeat = 15 * time.Second
+
+// stream streams the visit events as Server-Sent Events, require admin
+// access. The optional query parameter a filters the events of an alias.
+func (s *server) stream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := s.handleAuth(w, r)
+	if err != nil {
+		return err
+	}
+
+	a := r.URL.Query().Get("a")
+	if a != "" && !short.Validity.MatchString(a) {
+		return short.ErrInvalidAlias
+	}
+	if !id.canRead(a) {
+		return forbid(w)
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return errStreamUnsupported
+	}
+
+	// The stream lasts longer than the write timeout of the server.
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+
+	sub := s.events.Subscribe(a)
+	defer s.events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	t := time.NewTicker(heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case e, ok := <-sub.C:
+			if !ok {
+				return nil
+			}
+			var b []byte
+			b, err = json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "event: visit\ndata: %s\n\n", b)
+		}
+		if err != nil {
+			// The client is gone.
+			return nil
+		}
+		f.Flush()
+	}
+}
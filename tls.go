@@ -0,0 +1,92 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"changkun.de/x/redir/internal/certs"
+	"changkun.de/x/redir/internal/config"
+)
+
+// certReloadInterval is the interval of checking whether the
+// certificate files are changed.
+const certReloadInterval = time.Minute
+
+// tlsServers returns the HTTPS server on tls.addr and the plain HTTP
+// server on addr that serve the given handler, as well as a function
+// that keeps the certificate up to date until the given context is done.
+func tlsServers(h http.Handler) (https, plain *http.Server, watch func(context.Context), err error) {
+	c := config.Get().TLS
+
+	var getCert func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	challenge := func(h http.Handler) http.Handler { return h }
+	switch {
+	case c.ACME.Enable:
+		m, err := certs.NewManager(c.ACME.DirectoryURL, c.ACME.Email, c.ACME.CacheDir, c.ACME.Hosts)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		getCert, challenge, watch = m.GetCertificate, m.HTTPHandler, m.Watch
+	case c.CertFile != "" && c.KeyFile != "":
+		r, err := certs.NewReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		getCert = r.GetCertificate
+		watch = func(ctx context.Context) { r.Watch(ctx, certReloadInterval) }
+	default:
+		return nil, nil, nil, errors.New("either cert_file and key_file, or acme is required")
+	}
+
+	https = newHTTPServer(c.Addr, hsts(h, c.HSTSMaxAge))
+	https.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: getCert,
+	}
+
+	if c.RedirectHTTP {
+		h = redirectHTTPS(c.Addr)
+	}
+	plain = newHTTPServer(config.Get().Addr, challenge(h))
+	return https, plain, watch, nil
+}
+
+// redirectHTTPS returns a handler that redirects requests to the HTTPS
+// server of the given address.
+func redirectHTTPS(addr string) http.Handler {
+	_, port, _ := net.SplitHostPort(addr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// hsts wraps the given handler and sets the Strict-Transport-Security
+// header with the given max age if it is not zero.
+func hsts(h http.Handler, maxAge time.Duration) http.Handler {
+	if maxAge <= 0 {
+		return h
+	}
+	v := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", v)
+		h.ServeHTTP(w, r)
+	})
+}
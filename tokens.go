@@ -0,0 +1,95 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/token"
+)
+
+type tokenInput struct {
+	Op     string      `json:"op"`
+	ID     string      `json:"id"`
+	Name   string      `json:"name"`
+	Scope  token.Scope `json:"scope"`
+	Prefix string      `json:"prefix"`
+	TTL    string      `json:"ttl"`
+}
+
+type tokenOutput struct {
+	ID    string `json:"id"`
+	Token string `json:"token"`
+}
+
+// tokensGet lists the API tokens of the authenticated user. Tokens
+// cannot manage tokens.
+func (s *server) tokensGet(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	id, err := s.handleAuth(w, r)
+	if err != nil {
+		return err
+	}
+	if id.token != nil {
+		return forbid(w)
+	}
+
+	ts, err := s.db.FetchTokens(ctx, id.user)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(ts)
+}
+
+// tokensPost creates or revokes an API token of the authenticated user.
+// Tokens cannot manage tokens.
+func (s *server) tokensPost(ctx context.Context, w http.ResponseWriter, r *http.Request, id *identity) error {
+	if id.token != nil {
+		return forbid(w)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	var in tokenInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		return err
+	}
+
+	switch in.Op {
+	case "create":
+		var ttl time.Duration
+		if in.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(in.TTL)
+			if err != nil {
+				return fmt.Errorf("invalid ttl: %w", err)
+			}
+		}
+		t, tok, err := token.New(id.user, in.Name, in.Scope, in.Prefix, ttl)
+		if err != nil {
+			return err
+		}
+		t.Role, t.Groups = string(id.role), id.groups
+		if err := s.db.StoreToken(ctx, t); err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("token has been created",
+			"token", t.ID, "user", t.User, "scope", t.Scope, "prefix", t.Prefix)
+		return json.NewEncoder(w).Encode(tokenOutput{ID: t.ID, Token: tok})
+	case "revoke":
+		if err := s.db.DeleteToken(ctx, in.ID, id.user); err != nil {
+			return err
+		}
+		logging.FromContext(ctx).Info("token has been revoked", "token", in.ID, "user", id.user)
+		return nil
+	default:
+		return errors.New("unsupported operator")
+	}
+}
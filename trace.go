@@ -0,0 +1,26 @@
+// Copyright 2021 Changkun Ou. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"changkun.de/x/redir/internal/logging"
+	"changkun.de/x/redir/internal/tracing"
+)
+
+// startSpan starts a server span of the given request and returns a
+// request that carries the span. The trace id is added to the request
+// log, so that logs and traces can be correlated.
+func startSpan(r *http.Request, name string) (*http.Request, *tracing.Span) {
+	ctx, span := tracing.Start(r.Context(), name, tracing.KindServer,
+		tracing.String("http.method", r.Method),
+		tracing.String("http.target", r.URL.Path))
+	if sc := span.SpanContext(); sc.Sampled {
+		logging.AddAttrs(ctx, slog.String("trace_id", sc.TraceID.String()))
+	}
+	return r.WithContext(ctx), span
+}